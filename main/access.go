@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// accessPolicy restricts a route to client IPs by address or CIDR range, IPv4 or IPv6. Deny
+// and DenyFiles win over everything, and once Allow or AllowFiles lists anything only the
+// clients it lists get in. The files hold one address or range per line and are reloaded with
+// the route config. Denied clients get DenyStatus, 403 by default, and DenyMessage.
+type accessPolicy struct {
+	Allow       []string `json:"allow,omitempty"`
+	AllowFiles  []string `json:"allowFiles,omitempty"`
+	Deny        []string `json:"deny,omitempty"`
+	DenyFiles   []string `json:"denyFiles,omitempty"`
+	DenyStatus  int      `json:"denyStatus,omitempty"`
+	DenyMessage string   `json:"denyMessage,omitempty"`
+
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// build parses the policy's addresses and reads its files, returning the files it read.
+func (aP *accessPolicy) build() ([]string, error) {
+	var err error
+
+	files := append(append([]string(nil), aP.AllowFiles...), aP.DenyFiles...)
+
+	if aP.allow, err = buildNetworks(aP.Allow, aP.AllowFiles); err != nil {
+		return files, fmt.Errorf("allow: %s", err)
+	}
+
+	if aP.deny, err = buildNetworks(aP.Deny, aP.DenyFiles); err != nil {
+		return files, fmt.Errorf("deny: %s", err)
+	}
+
+	if len(aP.allow) == 0 && len(aP.Allow)+len(aP.AllowFiles) != 0 {
+		// An allow list that ended up empty would silently let everyone in
+		return files, errors.New("allow lists nothing")
+	}
+
+	if aP.DenyStatus != 0 && (aP.DenyStatus < 400 || aP.DenyStatus > 599) {
+		return files, fmt.Errorf("denyStatus %d is not a 4xx or 5xx status", aP.DenyStatus)
+	}
+
+	return files, nil
+}
+
+func buildNetworks(values, files []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+
+	for _, value := range values {
+		network, err := parseNetwork(value)
+
+		if err != nil {
+			return nil, err
+		}
+
+		networks = append(networks, network)
+	}
+
+	for _, file := range files {
+		fileNetworks, err := readNetworksFile(file)
+
+		if err != nil {
+			return nil, err
+		}
+
+		networks = append(networks, fileNetworks...)
+	}
+
+	return networks, nil
+}
+
+func networksContain(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Allows reports whether clientIP may reach the route, unparsable addresses never can.
+func (aP *accessPolicy) Allows(clientIP string) bool {
+	ip := net.ParseIP(clientIP)
+
+	if ip == nil || networksContain(aP.deny, ip) {
+		return false
+	}
+
+	return len(aP.allow) == 0 || networksContain(aP.allow, ip)
+}
+
+// Check answers requests from clients the policy denies, reporting whether it did.
+func (aP *accessPolicy) Check(c *gin.Context, settings routeSettings) bool {
+	clientIP := requestClientIP(c)
+
+	if aP.Allows(clientIP) {
+		return false
+	}
+
+	accessMetrics.Add("denied", 1)
+	accessDeniedByProject.Add(metricsProjectName(settings.project), 1)
+
+	log.Printf("access: event=denied domain=%s project=%s route=%s client_ip=%s method=%s path=%s\n", settings.domain, settings.project, settings.route, clientIP, c.Request.Method, c.Request.URL.Path)
+
+	message := aP.DenyMessage
+
+	if message == "" {
+		message = "access to this route is not allowed from your address"
+	}
+
+	if isGRPCRequest(c.Request) {
+		writeGRPCError(c.Writer, c.Request, grpcPermissionDenied, message)
+
+		c.Abort()
+
+		return true
+	}
+
+	status := aP.DenyStatus
+
+	if status == 0 {
+		status = http.StatusForbidden
+	}
+
+	c.AbortWithStatusJSON(status, gin.H{
+		"msg":  message,
+		"err":  true,
+		"data": gin.H{},
+	})
+
+	return true
+}
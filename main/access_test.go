@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAccessPolicyClientIP(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	policy := &accessPolicy{Allow: []string{"203.0.113.0/24"}}
+
+	if _, err := policy.build(); err != nil {
+		t.Fatal(err)
+	}
+
+	proxiesPath := filepath.Join(t.TempDir(), "proxies.txt")
+
+	if err := ioutil.WriteFile(proxiesPath, []byte("192.0.2.0/24\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	proxies, err := newTrustedProxies(proxiesPath)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := func(c *gin.Context) {
+		if policy.Check(c, routeSettings{domain: "example.com", project: "dashboard", route: "/"}) {
+			return
+		}
+
+		c.String(http.StatusOK, "ok")
+	}
+
+	// Set up like main without -trusted-proxies, leaving gin's X-Forwarded-For handling on
+	direct := gin.New()
+
+	direct.GET("/", handler)
+
+	proxied := gin.New()
+
+	proxied.ForwardedByClientIP = false
+
+	proxied.Use(proxies.Middleware(false))
+
+	proxied.GET("/", handler)
+
+	for _, test := range []struct {
+		name         string
+		router       *gin.Engine
+		peer         string
+		forwardedFor string
+		status       int
+	}{
+		{"allowed peer", direct, "203.0.113.9:4000", "", http.StatusOK},
+		{"denied peer", direct, "192.0.2.1:4000", "", http.StatusForbidden},
+		{"spoofed X-Forwarded-For", direct, "192.0.2.1:4000", "203.0.113.5", http.StatusForbidden},
+		{"X-Forwarded-For from a trusted proxy", proxied, "192.0.2.1:4000", "203.0.113.5", http.StatusOK},
+		{"X-Forwarded-For from an untrusted peer", proxied, "198.51.100.1:4000", "203.0.113.5", http.StatusForbidden},
+	} {
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+
+		request.RemoteAddr = test.peer
+
+		if test.forwardedFor != "" {
+			request.Header.Set("X-Forwarded-For", test.forwardedFor)
+		}
+
+		recorder := httptest.NewRecorder()
+
+		test.router.ServeHTTP(recorder, request)
+
+		if recorder.Code != test.status {
+			t.Errorf("%s: got %d, want %d", test.name, recorder.Code, test.status)
+		}
+	}
+}
@@ -0,0 +1,536 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	acmeTLSALPNProtocol  = "acme-tls/1"
+	acmeHTTPChallenge    = "http-01"
+	acmeTLSALPNChallenge = "tls-alpn-01"
+
+	// Issued certificates are stored in the certificate directory under this prefix
+	acmeCertificatePrefix = "acme-"
+)
+
+// id-pe-acmeIdentifier from RFC 8737, carried by TLS-ALPN-01 challenge certificates
+var acmeIdentifierOID = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+type acmeIssuance struct {
+	done chan struct{}
+	err  error
+}
+
+// acmeManager issues certificates through ACME for hosts in the routing table the first
+// time a client asks for one, storing them in the certificate store's directory and
+// renewing them before they expire. It answers HTTP-01 challenges through
+// HTTPChallengeHandler and TLS-ALPN-01 challenges through GetCertificate.
+type acmeManager struct {
+	client       *acmeClient
+	certStore    *certificateStore
+	isRouted     func(host string) bool
+	challenges   []string
+	renewBefore  time.Duration
+	retryAfter   time.Duration
+	issueTimeout time.Duration
+
+	lock         *sync.Mutex
+	issuances    map[string]*acmeIssuance
+	failures     map[string]time.Time
+	httpTokens   map[string]string
+	tlsALPNCerts map[string]*tls.Certificate
+}
+
+func newACMEManager(client *acmeClient, certStore *certificateStore, isRouted func(string) bool, challenges []string, renewBefore time.Duration) *acmeManager {
+	return &acmeManager{
+		client:       client,
+		certStore:    certStore,
+		isRouted:     isRouted,
+		challenges:   challenges,
+		renewBefore:  renewBefore,
+		retryAfter:   10 * time.Minute,
+		issueTimeout: 5 * time.Minute,
+		lock:         &sync.Mutex{},
+		issuances:    make(map[string]*acmeIssuance),
+		failures:     make(map[string]time.Time),
+		httpTokens:   make(map[string]string),
+		tlsALPNCerts: make(map[string]*tls.Certificate),
+	}
+}
+
+// isACMETLSALPNHello reports whether hello is a TLS-ALPN-01 validation handshake, which by
+// RFC 8737 offers acme-tls/1 as its only protocol. Clients offering it next to others are
+// ordinary clients and get no special treatment.
+func isACMETLSALPNHello(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acmeTLSALPNProtocol
+}
+
+// GetCertificate answers TLS-ALPN-01 validation handshakes, serves stored certificates,
+// and issues a certificate on demand for routed hosts that have none, falling back to the
+// store's default certificate while issuance isn't possible.
+func (aM *acmeManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	serverName := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+
+	if isACMETLSALPNHello(hello) {
+		aM.lock.Lock()
+
+		certificate, exists := aM.tlsALPNCerts[serverName]
+
+		aM.lock.Unlock()
+
+		if !exists {
+			return nil, fmt.Errorf("no tls-alpn-01 challenge pending for %q", serverName)
+		}
+
+		return certificate, nil
+	}
+
+	if certificate, exists := aM.certStore.Match(serverName); exists {
+		return certificate, nil
+	}
+
+	if aM.canIssue(serverName) {
+		if err := aM.Obtain(hello.Context(), serverName); err != nil {
+			log.Printf("acme: event=on_demand_failed domain=%s err=%q\n", serverName, err)
+		} else if certificate, exists := aM.certStore.Match(serverName); exists {
+			return certificate, nil
+		}
+	}
+
+	return aM.certStore.GetCertificate(hello)
+}
+
+// HTTPChallengeHandler serves HTTP-01 key authorizations, handing every other request to next.
+func (aM *acmeManager) HTTPChallengeHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/.well-known/acme-challenge/") {
+			next.ServeHTTP(w, r)
+
+			return
+		}
+
+		aM.lock.Lock()
+
+		keyAuthorization, exists := aM.httpTokens[strings.TrimPrefix(r.URL.Path, "/.well-known/acme-challenge/")]
+
+		aM.lock.Unlock()
+
+		if !exists {
+			http.NotFound(w, r)
+
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain")
+
+		w.Write([]byte(keyAuthorization))
+	})
+}
+
+// canIssue limits issuance to syntactically valid hosts the routing table names literally,
+// and not more often than retryAfter for hosts whose last issuance failed.
+func (aM *acmeManager) canIssue(serverName string) bool {
+	if serverName == "" || net.ParseIP(serverName) != nil || !isHostname(serverName) || !aM.isRouted(serverName) {
+		return false
+	}
+
+	aM.lock.Lock()
+
+	defer aM.lock.Unlock()
+
+	failedAt, failed := aM.failures[serverName]
+
+	return !failed || time.Since(failedAt) > aM.retryAfter
+}
+
+// Obtain issues a certificate for domain, sharing a single issuance between concurrent
+// callers. Issuance runs to completion in the background even if ctx ends first.
+func (aM *acmeManager) Obtain(ctx context.Context, domain string) error {
+	aM.lock.Lock()
+
+	issuance, inFlight := aM.issuances[domain]
+
+	if !inFlight {
+		issuance = &acmeIssuance{done: make(chan struct{})}
+
+		aM.issuances[domain] = issuance
+
+		go func() {
+			issueCtx, cancel := context.WithTimeout(context.Background(), aM.issueTimeout)
+
+			defer cancel()
+
+			issuance.err = aM.issue(issueCtx, domain)
+
+			aM.lock.Lock()
+
+			delete(aM.issuances, domain)
+
+			if issuance.err != nil {
+				aM.failures[domain] = time.Now()
+			} else {
+				delete(aM.failures, domain)
+			}
+
+			aM.lock.Unlock()
+
+			close(issuance.done)
+		}()
+	}
+
+	aM.lock.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-issuance.done:
+		return issuance.err
+	}
+}
+
+func (aM *acmeManager) issue(ctx context.Context, domain string) error {
+	log.Printf("acme: event=issuing domain=%s\n", domain)
+
+	acmeMetrics.Add("issuances", 1)
+
+	err := aM.client.register(ctx)
+
+	if err == nil {
+		err = aM.order(ctx, domain)
+	}
+
+	if err != nil {
+		acmeMetrics.Add("failures", 1)
+
+		return err
+	}
+
+	log.Printf("acme: event=issued domain=%s\n", domain)
+
+	return nil
+}
+
+func (aM *acmeManager) order(ctx context.Context, domain string) error {
+	order, orderURL, err := aM.client.newOrder(ctx, domain)
+
+	if err != nil {
+		return err
+	}
+
+	for _, authorizationURL := range order.Authorizations {
+		if err := aM.authorize(ctx, authorizationURL); err != nil {
+			return err
+		}
+	}
+
+	certificateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		return err
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domain},
+		DNSNames: []string{domain},
+	}, certificateKey)
+
+	if err != nil {
+		return err
+	}
+
+	chainPEM, err := aM.client.finalize(ctx, order, orderURL, csr)
+
+	if err != nil {
+		return err
+	}
+
+	return aM.store(domain, chainPEM, certificateKey)
+}
+
+// authorize completes one authorization with the first configured challenge type the
+// server offers, tearing the challenge response down again once it is decided.
+func (aM *acmeManager) authorize(ctx context.Context, authorizationURL string) error {
+	authorization, err := aM.client.getAuthorization(ctx, authorizationURL)
+
+	if err != nil {
+		return err
+	}
+
+	if authorization.Status == "valid" {
+		return nil
+	}
+
+	domain := authorization.Identifier.Value
+
+	for _, challengeType := range aM.challenges {
+		for _, challenge := range authorization.Challenges {
+			if challenge.Type != challengeType {
+				continue
+			}
+
+			cleanup, err := aM.prepareChallenge(domain, challenge)
+
+			if err != nil {
+				return err
+			}
+
+			defer cleanup()
+
+			if err := aM.client.acceptChallenge(ctx, challenge); err != nil {
+				return err
+			}
+
+			return aM.client.waitAuthorization(ctx, authorizationURL)
+		}
+	}
+
+	return fmt.Errorf("acme: no supported challenge offered for %s", domain)
+}
+
+func (aM *acmeManager) prepareChallenge(domain string, challenge acmeChallenge) (func(), error) {
+	keyAuthorization := aM.client.KeyAuthorization(challenge.Token)
+
+	aM.lock.Lock()
+
+	defer aM.lock.Unlock()
+
+	switch challenge.Type {
+	case acmeHTTPChallenge:
+		aM.httpTokens[challenge.Token] = keyAuthorization
+
+		return func() {
+			aM.lock.Lock()
+
+			delete(aM.httpTokens, challenge.Token)
+
+			aM.lock.Unlock()
+		}, nil
+	case acmeTLSALPNChallenge:
+		certificate, err := newTLSALPNChallengeCertificate(domain, keyAuthorization)
+
+		if err != nil {
+			return nil, err
+		}
+
+		aM.tlsALPNCerts[domain] = certificate
+
+		return func() {
+			aM.lock.Lock()
+
+			delete(aM.tlsALPNCerts, domain)
+
+			aM.lock.Unlock()
+		}, nil
+	}
+
+	return nil, fmt.Errorf("acme: unsupported challenge %s", challenge.Type)
+}
+
+// store writes the issued pair into the certificate directory, key first so the store
+// never sees a certificate without its key, and reloads the store.
+func (aM *acmeManager) store(domain string, chainPEM []byte, certificateKey *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalECPrivateKey(certificateKey)
+
+	if err != nil {
+		return err
+	}
+
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	if _, err := tls.X509KeyPair(chainPEM, keyPEM); err != nil {
+		return fmt.Errorf("acme: issued certificate doesn't match its key: %s", err)
+	}
+
+	basePath := filepath.Join(aM.certStore.dir, acmeCertificatePrefix+domain)
+
+	if err := writeFileAtomic(basePath+".key", keyPEM, 0600); err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(basePath+".crt", chainPEM, 0644); err != nil {
+		return err
+	}
+
+	_, err = aM.certStore.Reload()
+
+	return err
+}
+
+// RenewLoop checks the issued certificates every interval, renewing those that expire
+// within renewBefore as long as their domain is still routed.
+func (aM *acmeManager) RenewLoop(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+
+	defer ticker.Stop()
+
+	for {
+		aM.renewExpiring()
+
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (aM *acmeManager) renewExpiring() {
+	for _, certificate := range aM.certStore.Certificates() {
+		if !strings.HasPrefix(certificate.Name, acmeCertificatePrefix) || time.Until(certificate.NotAfter) > aM.renewBefore {
+			continue
+		}
+
+		domain := strings.TrimPrefix(certificate.Name, acmeCertificatePrefix)
+
+		if !aM.isRouted(domain) {
+			log.Printf("acme: event=renewal_skipped domain=%s reason=%q not_after=%s\n", domain, "no longer routed", certificate.NotAfter.Format(time.RFC3339))
+
+			continue
+		}
+
+		acmeMetrics.Add("renewals", 1)
+
+		if err := aM.Obtain(context.Background(), domain); err != nil {
+			log.Printf("acme: event=renewal_failed domain=%s not_after=%s err=%q\n", domain, certificate.NotAfter.Format(time.RFC3339), err)
+		}
+	}
+}
+
+// newTLSALPNChallengeCertificate builds the self-signed certificate RFC 8737 validation
+// expects, carrying the SHA-256 of the key authorization in a critical extension.
+func newTLSALPNChallengeCertificate(domain, keyAuthorization string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.Sum256([]byte(keyAuthorization))
+
+	extensionValue, err := asn1.Marshal(digest[:])
+
+	if err != nil {
+		return nil, err
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:    serialNumber,
+		Subject:         pkix.Name{CommonName: domain},
+		DNSNames:        []string{domain},
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(24 * time.Hour),
+		ExtraExtensions: []pkix.Extension{{Id: acmeIdentifierOID, Critical: true, Value: extensionValue}},
+	}
+
+	certificateDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{Certificate: [][]byte{certificateDER}, PrivateKey: key}, nil
+}
+
+// newACMEHTTPClient trusts the system roots plus those in caFile, if set, which is how a
+// local Pebble server's self-signed API certificate gets trusted.
+func newACMEHTTPClient(caFile string) (*http.Client, error) {
+	if caFile == "" {
+		return &http.Client{Timeout: time.Minute}, nil
+	}
+
+	caPEM, err := ioutil.ReadFile(caFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rootCAs, err := x509.SystemCertPool()
+
+	if err != nil || rootCAs == nil {
+		rootCAs = x509.NewCertPool()
+	}
+
+	if !rootCAs.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	transport.TLSClientConfig = &tls.Config{RootCAs: rootCAs}
+
+	return &http.Client{Timeout: time.Minute, Transport: transport}, nil
+}
+
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tempFile, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tempFile.Name())
+
+	if _, err := tempFile.Write(data); err != nil {
+		tempFile.Close()
+
+		return err
+	}
+
+	if err := tempFile.Chmod(perm); err != nil {
+		tempFile.Close()
+
+		return err
+	}
+
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tempFile.Name(), path)
+}
+
+func isHostname(host string) bool {
+	if len(host) > 253 {
+		return false
+	}
+
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return false
+		}
+
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-') {
+				return false
+			}
+		}
+	}
+
+	return true
+}
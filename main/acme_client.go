@@ -0,0 +1,532 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const acmeProblemBadNonce = "urn:ietf:params:acme:error:badNonce"
+
+// acmeProblem is an RFC 7807 problem document returned by the ACME server.
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+func (aP *acmeProblem) Error() string {
+	return fmt.Sprintf("acme: %s (%s, status %d)", aP.Detail, aP.Type, aP.Status)
+}
+
+type acmeDirectory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+type acmeIdentifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type acmeOrder struct {
+	Status         string           `json:"status"`
+	Identifiers    []acmeIdentifier `json:"identifiers"`
+	Authorizations []string         `json:"authorizations"`
+	Finalize       string           `json:"finalize"`
+	Certificate    string           `json:"certificate"`
+	Error          *acmeProblem     `json:"error"`
+}
+
+type acmeChallenge struct {
+	Type   string       `json:"type"`
+	URL    string       `json:"url"`
+	Token  string       `json:"token"`
+	Status string       `json:"status"`
+	Error  *acmeProblem `json:"error"`
+}
+
+type acmeAuthorization struct {
+	Status     string          `json:"status"`
+	Identifier acmeIdentifier  `json:"identifier"`
+	Challenges []acmeChallenge `json:"challenges"`
+}
+
+// acmeClient speaks just enough RFC 8555 to register an account and issue certificates
+// for single domains, signing every request with an ECDSA P-256 account key.
+type acmeClient struct {
+	directoryURL string
+	contact      []string
+	accountKey   *ecdsa.PrivateKey
+	httpClient   *http.Client
+
+	// Held for the whole of register so concurrent issuances register the account once
+	registerLock *sync.Mutex
+
+	lock      *sync.Mutex
+	directory *acmeDirectory
+	accountID string
+	nonces    []string
+}
+
+func newACMEClient(directoryURL string, contact []string, accountKey *ecdsa.PrivateKey, httpClient *http.Client) *acmeClient {
+	return &acmeClient{
+		directoryURL: directoryURL,
+		contact:      contact,
+		accountKey:   accountKey,
+		httpClient:   httpClient,
+		registerLock: &sync.Mutex{},
+		lock:         &sync.Mutex{},
+	}
+}
+
+// register fetches the directory and finds or creates the account for the account key.
+func (aC *acmeClient) register(ctx context.Context) error {
+	aC.registerLock.Lock()
+
+	defer aC.registerLock.Unlock()
+
+	aC.lock.Lock()
+
+	registered := aC.accountID != ""
+
+	aC.lock.Unlock()
+
+	if registered {
+		return nil
+	}
+
+	request, err := http.NewRequest(http.MethodGet, aC.directoryURL, nil)
+
+	if err != nil {
+		return err
+	}
+
+	response, err := aC.httpClient.Do(request.WithContext(ctx))
+
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	var directory acmeDirectory
+
+	if err := json.NewDecoder(response.Body).Decode(&directory); err != nil {
+		return fmt.Errorf("acme: failed to decode directory: %s", err)
+	}
+
+	aC.lock.Lock()
+
+	aC.directory = &directory
+
+	aC.lock.Unlock()
+
+	account := map[string]interface{}{"termsOfServiceAgreed": true}
+
+	if len(aC.contact) != 0 {
+		account["contact"] = aC.contact
+	}
+
+	response, err = aC.post(ctx, directory.NewAccount, account, nil)
+
+	if err != nil {
+		return err
+	}
+
+	response.Body.Close()
+
+	accountID := response.Header.Get("Location")
+
+	if accountID == "" {
+		return errors.New("acme: account response has no location")
+	}
+
+	aC.lock.Lock()
+
+	aC.accountID = accountID
+
+	aC.lock.Unlock()
+
+	return nil
+}
+
+// KeyAuthorization is what a challenge responder has to prove it holds for token.
+func (aC *acmeClient) KeyAuthorization(token string) string {
+	return token + "." + aC.thumbprint()
+}
+
+func (aC *acmeClient) thumbprint() string {
+	jwk := aC.jwk()
+
+	// Members in lexicographic order, as RFC 7638 requires
+	canonical := fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q,"y":%q}`, jwk["crv"], jwk["kty"], jwk["x"], jwk["y"])
+
+	sum := sha256.Sum256([]byte(canonical))
+
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func (aC *acmeClient) jwk() map[string]string {
+	byteLen := (aC.accountKey.Curve.Params().BitSize + 7) / 8
+
+	return map[string]string{
+		"crv": aC.accountKey.Curve.Params().Name,
+		"kty": "EC",
+		"x":   base64.RawURLEncoding.EncodeToString(padBytes(aC.accountKey.X.Bytes(), byteLen)),
+		"y":   base64.RawURLEncoding.EncodeToString(padBytes(aC.accountKey.Y.Bytes(), byteLen)),
+	}
+}
+
+func (aC *acmeClient) newOrder(ctx context.Context, domain string) (*acmeOrder, string, error) {
+	aC.lock.Lock()
+
+	directory := aC.directory
+
+	aC.lock.Unlock()
+
+	if directory == nil {
+		return nil, "", errors.New("acme: no account registered")
+	}
+
+	var order acmeOrder
+
+	response, err := aC.post(ctx, directory.NewOrder, map[string]interface{}{
+		"identifiers": []acmeIdentifier{{Type: "dns", Value: domain}},
+	}, &order)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	response.Body.Close()
+
+	return &order, response.Header.Get("Location"), nil
+}
+
+func (aC *acmeClient) getAuthorization(ctx context.Context, authorizationURL string) (*acmeAuthorization, error) {
+	var authorization acmeAuthorization
+
+	response, err := aC.post(ctx, authorizationURL, nil, &authorization)
+
+	if err != nil {
+		return nil, err
+	}
+
+	response.Body.Close()
+
+	return &authorization, nil
+}
+
+func (aC *acmeClient) acceptChallenge(ctx context.Context, challenge acmeChallenge) error {
+	response, err := aC.post(ctx, challenge.URL, struct{}{}, nil)
+
+	if err != nil {
+		return err
+	}
+
+	return response.Body.Close()
+}
+
+// waitAuthorization polls an authorization until the server has validated or rejected it.
+func (aC *acmeClient) waitAuthorization(ctx context.Context, authorizationURL string) error {
+	for {
+		authorization, err := aC.getAuthorization(ctx, authorizationURL)
+
+		if err != nil {
+			return err
+		}
+
+		switch authorization.Status {
+		case "valid":
+			return nil
+		case "pending", "processing":
+		default:
+			for _, challenge := range authorization.Challenges {
+				if challenge.Error != nil {
+					return challenge.Error
+				}
+			}
+
+			return fmt.Errorf("acme: authorization for %s is %s", authorization.Identifier.Value, authorization.Status)
+		}
+
+		if err := sleepContext(ctx, time.Second); err != nil {
+			return err
+		}
+	}
+}
+
+// finalize submits the CSR and waits for the order to be issued, returning the PEM chain.
+func (aC *acmeClient) finalize(ctx context.Context, order *acmeOrder, orderURL string, csr []byte) ([]byte, error) {
+	response, err := aC.post(ctx, order.Finalize, map[string]string{"csr": base64.RawURLEncoding.EncodeToString(csr)}, order)
+
+	if err != nil {
+		return nil, err
+	}
+
+	response.Body.Close()
+
+	for order.Status != "valid" {
+		switch order.Status {
+		case "pending", "ready", "processing":
+		default:
+			if order.Error != nil {
+				return nil, order.Error
+			}
+
+			return nil, fmt.Errorf("acme: order is %s", order.Status)
+		}
+
+		if err := sleepContext(ctx, time.Second); err != nil {
+			return nil, err
+		}
+
+		response, err := aC.post(ctx, orderURL, nil, order)
+
+		if err != nil {
+			return nil, err
+		}
+
+		response.Body.Close()
+	}
+
+	response, err = aC.post(ctx, order.Certificate, nil, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer response.Body.Close()
+
+	return ioutil.ReadAll(response.Body)
+}
+
+// post sends a JWS signed request, with a nil payload meaning POST-as-GET, and decodes
+// the JSON response into result when it isn't nil. It retries once on a stale nonce.
+func (aC *acmeClient) post(ctx context.Context, url string, payload interface{}, result interface{}) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		body, err := aC.signedBody(ctx, url, payload)
+
+		if err != nil {
+			return nil, err
+		}
+
+		request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+
+		if err != nil {
+			return nil, err
+		}
+
+		request.Header.Set("Content-Type", "application/jose+json")
+
+		response, err := aC.httpClient.Do(request.WithContext(ctx))
+
+		if err != nil {
+			return nil, err
+		}
+
+		aC.saveNonce(response)
+
+		if response.StatusCode >= http.StatusBadRequest {
+			problem := &acmeProblem{Status: response.StatusCode}
+
+			json.NewDecoder(response.Body).Decode(problem)
+
+			response.Body.Close()
+
+			if problem.Type == acmeProblemBadNonce && attempt == 0 {
+				continue
+			}
+
+			return nil, problem
+		}
+
+		if result != nil {
+			err = json.NewDecoder(response.Body).Decode(result)
+
+			response.Body.Close()
+
+			if err != nil {
+				return nil, fmt.Errorf("acme: failed to decode response from %s: %s", url, err)
+			}
+		}
+
+		return response, nil
+	}
+}
+
+func (aC *acmeClient) signedBody(ctx context.Context, url string, payload interface{}) ([]byte, error) {
+	nonce, err := aC.nonce(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	protected := map[string]interface{}{
+		"alg":   "ES256",
+		"nonce": nonce,
+		"url":   url,
+	}
+
+	aC.lock.Lock()
+
+	if aC.accountID != "" {
+		protected["kid"] = aC.accountID
+	} else {
+		protected["jwk"] = aC.jwk()
+	}
+
+	aC.lock.Unlock()
+
+	protectedBytes, err := json.Marshal(protected)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var payloadBytes []byte
+
+	if payload != nil {
+		if payloadBytes, err = json.Marshal(payload); err != nil {
+			return nil, err
+		}
+	}
+
+	encodedProtected := base64.RawURLEncoding.EncodeToString(protectedBytes)
+	encodedPayload := base64.RawURLEncoding.EncodeToString(payloadBytes)
+
+	digest := crypto.SHA256.New()
+
+	digest.Write([]byte(encodedProtected + "." + encodedPayload))
+
+	r, s, err := ecdsa.Sign(rand.Reader, aC.accountKey, digest.Sum(nil))
+
+	if err != nil {
+		return nil, err
+	}
+
+	byteLen := (aC.accountKey.Curve.Params().BitSize + 7) / 8
+
+	signature := append(padBytes(r.Bytes(), byteLen), padBytes(s.Bytes(), byteLen)...)
+
+	return json.Marshal(map[string]string{
+		"protected": encodedProtected,
+		"payload":   encodedPayload,
+		"signature": base64.RawURLEncoding.EncodeToString(signature),
+	})
+}
+
+func (aC *acmeClient) nonce(ctx context.Context) (string, error) {
+	aC.lock.Lock()
+
+	if len(aC.nonces) != 0 {
+		nonce := aC.nonces[len(aC.nonces)-1]
+
+		aC.nonces = aC.nonces[:len(aC.nonces)-1]
+
+		aC.lock.Unlock()
+
+		return nonce, nil
+	}
+
+	newNonceURL := aC.directory.NewNonce
+
+	aC.lock.Unlock()
+
+	request, err := http.NewRequest(http.MethodHead, newNonceURL, nil)
+
+	if err != nil {
+		return "", err
+	}
+
+	response, err := aC.httpClient.Do(request.WithContext(ctx))
+
+	if err != nil {
+		return "", err
+	}
+
+	response.Body.Close()
+
+	nonce := response.Header.Get("Replay-Nonce")
+
+	if nonce == "" {
+		return "", errors.New("acme: server returned no nonce")
+	}
+
+	return nonce, nil
+}
+
+func (aC *acmeClient) saveNonce(response *http.Response) {
+	if nonce := response.Header.Get("Replay-Nonce"); nonce != "" {
+		aC.lock.Lock()
+
+		aC.nonces = append(aC.nonces, nonce)
+
+		aC.lock.Unlock()
+	}
+}
+
+func padBytes(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+
+	return append(make([]byte, size-len(b)), b...)
+}
+
+func sleepContext(ctx context.Context, delay time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
+
+func loadOrCreateECKey(path string) (*ecdsa.PrivateKey, error) {
+	keyPEM, err := ioutil.ReadFile(path)
+
+	if err == nil {
+		block, _ := pem.Decode(keyPEM)
+
+		if block == nil {
+			return nil, fmt.Errorf("no PEM data in %s", path)
+		}
+
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		return nil, err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// verifyACMERequest checks a JWS request body the way an ACME server would, returning its
+// protected header.
+func verifyACMERequest(r *http.Request, accountKey *ecdsa.PublicKey) (map[string]interface{}, error) {
+	var body struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+		Signature string `json:"signature"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+
+	protectedBytes, err := base64.RawURLEncoding.DecodeString(body.Protected)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var protected map[string]interface{}
+
+	if err := json.Unmarshal(protectedBytes, &protected); err != nil {
+		return nil, err
+	}
+
+	if protected["alg"] != "ES256" || protected["nonce"] == "" || protected["url"] != "http://"+r.Host+r.URL.Path {
+		return nil, fmt.Errorf("bad protected header %v", protected)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(body.Signature)
+
+	if err != nil || len(signature) != 64 {
+		return nil, fmt.Errorf("bad signature %q", body.Signature)
+	}
+
+	digest := sha256.Sum256([]byte(body.Protected + "." + body.Payload))
+
+	if !ecdsa.Verify(accountKey, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+		return nil, errors.New("signature doesn't verify")
+	}
+
+	return protected, nil
+}
+
+func TestACMEClientRegistersOnce(t *testing.T) {
+	accountKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var accounts, nonces int64
+
+	var server *httptest.Server
+
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", atomic.AddInt64(&nonces, 1)))
+
+		switch r.URL.Path {
+		case "/directory":
+			json.NewEncoder(w).Encode(acmeDirectory{NewNonce: server.URL + "/nonce", NewAccount: server.URL + "/account", NewOrder: server.URL + "/order"})
+		case "/nonce":
+		case "/account":
+			protected, err := verifyACMERequest(r, &accountKey.PublicKey)
+
+			if err == nil && protected["jwk"] == nil {
+				err = errors.New("new account request without a jwk")
+			}
+
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+
+				json.NewEncoder(w).Encode(acmeProblem{Type: "urn:ietf:params:acme:error:malformed", Detail: err.Error()})
+
+				return
+			}
+
+			atomic.AddInt64(&accounts, 1)
+
+			// Long enough for every concurrent caller to be waiting on the registration
+			time.Sleep(50 * time.Millisecond)
+
+			w.Header().Set("Location", server.URL+"/account/1")
+
+			w.WriteHeader(http.StatusCreated)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+
+	defer server.Close()
+
+	aC := newACMEClient(server.URL+"/directory", nil, accountKey, server.Client())
+
+	if _, _, err := aC.newOrder(context.Background(), "example.com"); err == nil {
+		t.Fatal("newOrder succeeded before the account was registered")
+	}
+
+	var wg sync.WaitGroup
+
+	errs := make(chan error, 10)
+
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			errs <- aC.register(context.Background())
+		}()
+	}
+
+	wg.Wait()
+
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("register: %s", err)
+		}
+	}
+
+	if accounts != 1 {
+		t.Fatalf("registered the account %d times, want once", accounts)
+	}
+
+	if aC.accountID != server.URL+"/account/1" {
+		t.Fatalf("account ID %q, want the Location of the new account", aC.accountID)
+	}
+}
+
+// TestACMEPebble issues certificates end to end against a local Pebble server, started
+// from Pebble's source directory with
+//
+//	pebble-challtestsrv -defaultIPv6 "" -defaultIPv4 127.0.0.1 -http01 "" -https01 "" -tlsalpn01 ""
+//	PEBBLE_VA_NOSLEEP=1 pebble -config test/config/pebble-config.json -dnsserver 127.0.0.1:8053
+//
+// and run with ACME_PEBBLE_DIRECTORY=https://localhost:14000/dir and ACME_PEBBLE_CA set to
+// Pebble's test/certs/pebble.minica.pem. The test DNS server resolves every name to this
+// machine, where the challenges are answered on Pebble's httpPort and tlsPort, 5002 and 5001
+// in that config.
+func TestACMEPebble(t *testing.T) {
+	directoryURL := os.Getenv("ACME_PEBBLE_DIRECTORY")
+
+	if directoryURL == "" {
+		t.Skip("ACME_PEBBLE_DIRECTORY is not set")
+	}
+
+	httpClient, err := newACMEHTTPClient(os.Getenv("ACME_PEBBLE_CA"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accountKey, err := loadOrCreateECKey(t.TempDir() + "/account.key")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certStore, err := newCertificateStore(t.TempDir(), "")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	domains := map[string]string{
+		acmeHTTPChallenge:    "http-01.example.com",
+		acmeTLSALPNChallenge: "tls-alpn-01.example.com",
+	}
+
+	isRouted := func(host string) bool {
+		return host == domains[acmeHTTPChallenge] || host == domains[acmeTLSALPNChallenge]
+	}
+
+	client := newACMEClient(directoryURL, nil, accountKey, httpClient)
+
+	// One manager per challenge type, sharing the client like the router's renewals and
+	// on demand issuances do
+	managers := map[string]*acmeManager{
+		acmeHTTPChallenge:    newACMEManager(client, certStore, isRouted, []string{acmeHTTPChallenge}, 30*24*time.Hour),
+		acmeTLSALPNChallenge: newACMEManager(client, certStore, isRouted, []string{acmeTLSALPNChallenge}, 30*24*time.Hour),
+	}
+
+	httpListener, err := net.Listen("tcp", ":"+envOrDefault("ACME_PEBBLE_HTTP_PORT", "5002"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go http.Serve(httpListener, managers[acmeHTTPChallenge].HTTPChallengeHandler(http.NotFoundHandler()))
+
+	defer httpListener.Close()
+
+	tlsListener, err := tls.Listen("tcp", ":"+envOrDefault("ACME_PEBBLE_TLS_PORT", "5001"), &tls.Config{
+		GetCertificate: managers[acmeTLSALPNChallenge].GetCertificate,
+		NextProtos:     []string{acmeTLSALPNProtocol},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go http.Serve(tlsListener, http.NotFoundHandler())
+
+	defer tlsListener.Close()
+
+	var wg sync.WaitGroup
+
+	for challengeType, domain := range domains {
+		wg.Add(1)
+
+		go func(challengeType, domain string) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+
+			defer cancel()
+
+			if err := managers[challengeType].Obtain(ctx, domain); err != nil {
+				t.Errorf("%s: issuing for %s: %s", challengeType, domain, err)
+			}
+		}(challengeType, domain)
+	}
+
+	wg.Wait()
+
+	for challengeType, domain := range domains {
+		certificate, exists := certStore.Match(domain)
+
+		if !exists {
+			t.Errorf("%s: no certificate stored for %s", challengeType, domain)
+
+			continue
+		}
+
+		leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := leaf.VerifyHostname(domain); err != nil {
+			t.Errorf("%s: %s", challengeType, err)
+		}
+
+		if len(certificate.Certificate) < 2 {
+			t.Errorf("%s: stored certificate for %s has no intermediate", challengeType, domain)
+		}
+	}
+}
+
+func envOrDefault(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+
+	return fallback
+}
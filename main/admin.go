@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// adminAuth guards the admin endpoints, which inspect or change routing, requiring
+// "Authorization: Bearer <secret>". With no secret configured those endpoints are disabled
+// entirely.
+func adminAuth(adminSecret string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if adminSecret == "" {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"msg":  "admin endpoints are disabled, ROUTER_ADMIN_SECRET is not set",
+				"err":  true,
+				"data": gin.H{},
+			})
+
+			return
+		}
+
+		authorization := c.GetHeader("Authorization")
+
+		if !strings.HasPrefix(authorization, "Bearer ") || subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(authorization, "Bearer ")), []byte(adminSecret)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"msg":  "invalid admin credentials",
+				"err":  true,
+				"data": gin.H{},
+			})
+
+			return
+		}
+
+		c.Next()
+	}
+}
+
+func revisionParam(c *gin.Context, value string) (int64, bool) {
+	revision, err := strconv.ParseInt(value, 10, 64)
+
+	if err != nil || revision < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"msg":  "revision must be a positive integer",
+			"err":  true,
+			"data": gin.H{},
+		})
+
+		return 0, false
+	}
+
+	return revision, true
+}
+
+func routingErrorStatus(err error) int {
+	switch err {
+	case errRevisionNotFound:
+		return http.StatusNotFound
+	case errNotPinned:
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// registerRoutingHistoryRoutes adds the endpoints for inspecting, diffing and rolling back
+// the routing history.
+func registerRoutingHistoryRoutes(r *gin.Engine, routesManager *routesManager, adminSecret string) {
+	admin := adminAuth(adminSecret)
+
+	r.GET("/routing/history", admin, func(c *gin.Context) {
+		revision, pinnedRevision := routesManager.Revisions()
+
+		c.JSON(http.StatusOK, gin.H{
+			"msg": "",
+			"err": false,
+			"data": gin.H{
+				"revision":       revision,
+				"pinnedRevision": pinnedRevision,
+				"entries":        routesManager.History(),
+			},
+		})
+	})
+
+	r.GET("/routing/history/:revision", admin, func(c *gin.Context) {
+		revision, ok := revisionParam(c, c.Param("revision"))
+
+		if !ok {
+			return
+		}
+
+		entry, projectsMap, err := routesManager.HistoryEntry(revision)
+
+		if err != nil {
+			c.JSON(routingErrorStatus(err), gin.H{
+				"msg":  err.Error(),
+				"err":  true,
+				"data": gin.H{},
+			})
+
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"msg": "",
+			"err": false,
+			"data": gin.H{
+				"entry":    entry,
+				"projects": projectsMap,
+			},
+		})
+	})
+
+	// Diffs default to comparing the requested revision with the live one
+	r.GET("/routing/diff", admin, func(c *gin.Context) {
+		currentRevision, _ := routesManager.Revisions()
+
+		fromRevision, ok := revisionParam(c, c.Query("from"))
+
+		if !ok {
+			return
+		}
+
+		toRevision, ok := revisionParam(c, c.DefaultQuery("to", strconv.FormatInt(currentRevision, 10)))
+
+		if !ok {
+			return
+		}
+
+		diffs, err := routesManager.Diff(fromRevision, toRevision)
+
+		if err != nil {
+			c.JSON(routingErrorStatus(err), gin.H{
+				"msg":  err.Error(),
+				"err":  true,
+				"data": gin.H{},
+			})
+
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"msg": "",
+			"err": false,
+			"data": gin.H{
+				"from":    fromRevision,
+				"to":      toRevision,
+				"changes": diffs,
+			},
+		})
+	})
+
+	r.POST("/routing/rollback/:revision", admin, func(c *gin.Context) {
+		revision, ok := revisionParam(c, c.Param("revision"))
+
+		if !ok {
+			return
+		}
+
+		newRevision, err := routesManager.Rollback(revision)
+
+		if err != nil {
+			c.JSON(routingErrorStatus(err), gin.H{
+				"msg":  err.Error(),
+				"err":  true,
+				"data": gin.H{},
+			})
+
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"msg": "routing rolled back and pinned",
+			"err": false,
+			"data": gin.H{
+				"revision":       newRevision,
+				"pinnedRevision": revision,
+			},
+		})
+	})
+
+	r.POST("/routing/release", admin, func(c *gin.Context) {
+		newRevision, err := routesManager.Release()
+
+		if err != nil {
+			c.JSON(routingErrorStatus(err), gin.H{
+				"msg":  err.Error(),
+				"err":  true,
+				"data": gin.H{},
+			})
+
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"msg": "routing released",
+			"err": false,
+			"data": gin.H{
+				"revision": newRevision,
+			},
+		})
+	})
+}
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// authPolicy puts a route behind a login. Requests get through with a user from HtpasswdFile,
+// over basic auth, or with a key from APIKeysFile, in an X-API-Key header or bearer token. When
+// neither lets them in and ForwardAuth is set, the auth service it names decides. Users and key
+// names reach the upstream in UserHeader, X-Auth-User by default, and the credentials the
+// router checked don't reach it at all.
+type authPolicy struct {
+	HtpasswdFile string             `json:"htpasswdFile,omitempty"`
+	APIKeysFile  string             `json:"apiKeysFile,omitempty"`
+	ForwardAuth  *forwardAuthPolicy `json:"forwardAuth,omitempty"`
+	Realm        string             `json:"realm,omitempty"`
+	UserHeader   string             `json:"userHeader,omitempty"`
+
+	users   map[string]string
+	apiKeys map[[sha256.Size]byte]string
+}
+
+// forwardAuthPolicy asks the auth service at URL about each request, sending it the request's
+// headers along with X-Forwarded-Method, -Proto, -Host, -Uri and -For. A 2xx answer lets the
+// request through with the answer's CopyHeaders, anything else is sent back to the client, so
+// the service can redirect to a login page.
+type forwardAuthPolicy struct {
+	URL         string         `json:"url"`
+	CopyHeaders []string       `json:"copyHeaders,omitempty"`
+	Timeout     configDuration `json:"timeout,omitempty"`
+
+	client *http.Client
+}
+
+// build reads the policy's files, returning the files it read.
+func (aP *authPolicy) build() ([]string, error) {
+	var files []string
+
+	if aP.HtpasswdFile == "" && aP.APIKeysFile == "" && aP.ForwardAuth == nil {
+		return nil, errors.New("set at least one of htpasswdFile, apiKeysFile and forwardAuth")
+	}
+
+	if aP.HtpasswdFile != "" {
+		files = append(files, aP.HtpasswdFile)
+
+		users, err := readHtpasswdFile(aP.HtpasswdFile)
+
+		if err != nil {
+			return files, err
+		}
+
+		aP.users = users
+	}
+
+	if aP.APIKeysFile != "" {
+		files = append(files, aP.APIKeysFile)
+
+		apiKeys, err := readAPIKeysFile(aP.APIKeysFile)
+
+		if err != nil {
+			return files, err
+		}
+
+		aP.apiKeys = apiKeys
+	}
+
+	if aP.ForwardAuth != nil {
+		if err := aP.ForwardAuth.build(); err != nil {
+			return files, fmt.Errorf("forwardAuth: %s", err)
+		}
+	}
+
+	return files, nil
+}
+
+func (fAP *forwardAuthPolicy) build() error {
+	parsed, err := url.Parse(fAP.URL)
+
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("url %q is not an http or https URL", fAP.URL)
+	}
+
+	timeout := time.Duration(fAP.Timeout)
+
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+
+	fAP.client = &http.Client{
+		Timeout: timeout,
+		// Redirects are the service's answer to the client, not something to follow
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	return nil
+}
+
+func (aP *authPolicy) userHeader() string {
+	if aP.UserHeader != "" {
+		return aP.UserHeader
+	}
+
+	return "X-Auth-User"
+}
+
+// Check lets authenticated requests through, reporting whether it answered the request
+// itself instead.
+func (aP *authPolicy) Check(c *gin.Context, settings routeSettings) bool {
+	request := c.Request
+
+	// Only the router gets to say who the user is
+	request.Header.Del(aP.userHeader())
+
+	if aP.ForwardAuth != nil {
+		for _, header := range aP.ForwardAuth.CopyHeaders {
+			request.Header.Del(header)
+		}
+	}
+
+	if user, ok := aP.basicAuthUser(request); ok {
+		request.Header.Del("Authorization")
+		request.Header.Set(aP.userHeader(), user)
+
+		return false
+	}
+
+	if name, ok := aP.apiKeyName(request); ok {
+		request.Header.Del("Authorization")
+		request.Header.Del("X-API-Key")
+		request.Header.Set(aP.userHeader(), name)
+
+		return false
+	}
+
+	if aP.ForwardAuth != nil {
+		return aP.ForwardAuth.check(c, settings)
+	}
+
+	authMetrics.Add("rejected", 1)
+
+	log.Printf("auth: event=rejected domain=%s project=%s route=%s client_ip=%s\n", settings.domain, settings.project, settings.route, requestClientIP(c))
+
+	if isGRPCRequest(request) {
+		writeGRPCError(c.Writer, request, grpcUnauthenticated, "authentication required")
+
+		c.Abort()
+
+		return true
+	}
+
+	if aP.users != nil {
+		realm := aP.Realm
+
+		if realm == "" {
+			realm = "restricted"
+		}
+
+		c.Header("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", realm))
+	}
+
+	c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+		"msg":  "authentication required",
+		"err":  true,
+		"data": gin.H{},
+	})
+
+	return true
+}
+
+func (aP *authPolicy) basicAuthUser(r *http.Request) (string, bool) {
+	if aP.users == nil {
+		return "", false
+	}
+
+	user, password, ok := r.BasicAuth()
+
+	if !ok {
+		return "", false
+	}
+
+	hash, exists := aP.users[user]
+
+	if !exists || !htpasswdMatches(hash, password) {
+		return "", false
+	}
+
+	return user, true
+}
+
+func (aP *authPolicy) apiKeyName(r *http.Request) (string, bool) {
+	if aP.apiKeys == nil {
+		return "", false
+	}
+
+	apiKey := r.Header.Get("X-API-Key")
+
+	if authorization := r.Header.Get("Authorization"); apiKey == "" && strings.HasPrefix(authorization, "Bearer ") {
+		apiKey = strings.TrimPrefix(authorization, "Bearer ")
+	}
+
+	if apiKey == "" {
+		return "", false
+	}
+
+	// Looking up the hash keeps the comparison from leaking the key through timing
+	name, exists := aP.apiKeys[sha256.Sum256([]byte(apiKey))]
+
+	return name, exists
+}
+
+func (fAP *forwardAuthPolicy) check(c *gin.Context, settings routeSettings) bool {
+	request := c.Request
+
+	authRequest, err := http.NewRequestWithContext(request.Context(), http.MethodGet, fAP.URL, nil)
+
+	if err != nil {
+		return fAP.unavailable(c, settings, err)
+	}
+
+	for key, values := range request.Header {
+		authRequest.Header[key] = values
+	}
+
+	proto := "https"
+
+	if request.TLS == nil {
+		proto = "http"
+	}
+
+	authRequest.Header.Set("X-Forwarded-Method", request.Method)
+	authRequest.Header.Set("X-Forwarded-Proto", proto)
+	authRequest.Header.Set("X-Forwarded-Host", request.Host)
+	authRequest.Header.Set("X-Forwarded-Uri", request.URL.RequestURI())
+	authRequest.Header.Set("X-Forwarded-For", requestClientIP(c))
+
+	resp, err := fAP.client.Do(authRequest)
+
+	if err != nil {
+		return fAP.unavailable(c, settings, err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		for _, header := range fAP.CopyHeaders {
+			if values := resp.Header.Values(header); len(values) != 0 {
+				request.Header[http.CanonicalHeaderKey(header)] = values
+			}
+		}
+
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+
+		return false
+	}
+
+	authMetrics.Add("rejected", 1)
+
+	log.Printf("auth: event=forward_rejected domain=%s project=%s route=%s client_ip=%s status=%d\n", settings.domain, settings.project, settings.route, requestClientIP(c), resp.StatusCode)
+
+	for key, values := range resp.Header {
+		switch http.CanonicalHeaderKey(key) {
+		case "Connection", "Content-Length", "Keep-Alive", "Transfer-Encoding":
+			continue
+		}
+
+		c.Writer.Header()[key] = values
+	}
+
+	c.Status(resp.StatusCode)
+
+	io.Copy(c.Writer, io.LimitReader(resp.Body, 1024*1024))
+
+	c.Abort()
+
+	return true
+}
+
+func (fAP *forwardAuthPolicy) unavailable(c *gin.Context, settings routeSettings, err error) bool {
+	authMetrics.Add("forwardErrors", 1)
+
+	log.Printf("auth: event=forward_failed domain=%s project=%s route=%s url=%s err=%q\n", settings.domain, settings.project, settings.route, fAP.URL, err)
+
+	if isGRPCRequest(c.Request) {
+		writeGRPCError(c.Writer, c.Request, grpcUnavailable, "auth service unavailable")
+
+		c.Abort()
+
+		return true
+	}
+
+	c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+		"msg":  "auth service unavailable",
+		"err":  true,
+		"data": gin.H{},
+	})
+
+	return true
+}
+
+// readHtpasswdFile reads user:hash lines, the hashes being bcrypt, {SHA} or $apr1$ ones as
+// written by htpasswd -B, -s and -m.
+func readHtpasswdFile(path string) (map[string]string, error) {
+	users := make(map[string]string)
+
+	err := readSecretsFile(path, func(lineNumber int, line string) error {
+		separator := strings.IndexByte(line, ':')
+
+		if separator <= 0 {
+			return fmt.Errorf("%s:%d: expected user:hash", path, lineNumber)
+		}
+
+		hash := line[separator+1:]
+
+		switch {
+		case isBcryptHash(hash):
+			if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+				return fmt.Errorf("%s:%d: malformed bcrypt hash: %s", path, lineNumber, err)
+			}
+		case strings.HasPrefix(hash, "{SHA}"), strings.HasPrefix(hash, "$apr1$"):
+		default:
+			return fmt.Errorf("%s:%d: unsupported hash, only bcrypt, {SHA} and $apr1$ are", path, lineNumber)
+		}
+
+		users[line[:separator]] = hash
+
+		return nil
+	})
+
+	return users, err
+}
+
+// readAPIKeysFile reads name:key lines, keeping hashes of the keys.
+func readAPIKeysFile(path string) (map[[sha256.Size]byte]string, error) {
+	apiKeys := make(map[[sha256.Size]byte]string)
+
+	err := readSecretsFile(path, func(lineNumber int, line string) error {
+		separator := strings.IndexByte(line, ':')
+
+		if separator <= 0 || separator == len(line)-1 {
+			return fmt.Errorf("%s:%d: expected name:key", path, lineNumber)
+		}
+
+		apiKeys[sha256.Sum256([]byte(line[separator+1:]))] = line[:separator]
+
+		return nil
+	})
+
+	return apiKeys, err
+}
+
+// readSecretsFile calls parse with every line of the file that isn't blank or a # comment.
+func readSecretsFile(path string, parse func(lineNumber int, line string) error) error {
+	file, err := os.Open(path)
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if err := parse(lineNumber, line); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+// isBcryptHash reports whether hash is a bcrypt one, htpasswd -B writing $2y$ and other tools
+// $2a$ or $2b$.
+func isBcryptHash(hash string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$"} {
+		if strings.HasPrefix(hash, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func htpasswdMatches(hash, password string) bool {
+	var computed string
+
+	switch {
+	case isBcryptHash(hash):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+
+		computed = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt := strings.TrimPrefix(hash, "$apr1$")
+
+		if end := strings.IndexByte(salt, '$'); end != -1 {
+			salt = salt[:end]
+		}
+
+		computed = apr1Hash(password, salt)
+	default:
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1
+}
+
+// apr1Hash is Apache's MD5 based crypt, as produced by htpasswd -m.
+func apr1Hash(password, salt string) string {
+	const magic = "$apr1$"
+
+	const alphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+
+	alternate := md5.Sum([]byte(password + salt + password))
+
+	digest := md5.New()
+
+	digest.Write([]byte(password + magic + salt))
+
+	for remaining := len(password); remaining > 0; remaining -= 16 {
+		if remaining > 16 {
+			digest.Write(alternate[:])
+		} else {
+			digest.Write(alternate[:remaining])
+		}
+	}
+
+	for bits := len(password); bits > 0; bits >>= 1 {
+		if bits&1 == 1 {
+			digest.Write([]byte{0})
+		} else {
+			digest.Write([]byte{password[0]})
+		}
+	}
+
+	final := digest.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+
+		if i&1 == 1 {
+			round.Write([]byte(password))
+		} else {
+			round.Write(final)
+		}
+
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+
+		if i%7 != 0 {
+			round.Write([]byte(password))
+		}
+
+		if i&1 == 1 {
+			round.Write(final)
+		} else {
+			round.Write([]byte(password))
+		}
+
+		final = round.Sum(nil)
+	}
+
+	var encoded strings.Builder
+
+	encode := func(value uint, characters int) {
+		for ; characters > 0; characters-- {
+			encoded.WriteByte(alphabet[value&0x3f])
+
+			value >>= 6
+		}
+	}
+
+	for _, group := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint(final[group[0]])<<16|uint(final[group[1]])<<8|uint(final[group[2]]), 4)
+	}
+
+	encode(uint(final[11]), 2)
+
+	return magic + salt + "$" + encoded.String()
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestHtpasswdMatches(t *testing.T) {
+	for _, test := range []struct {
+		hash     string
+		password string
+		want     bool
+	}{
+		// htpasswd -s and openssl passwd -apr1
+		{"{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", "password", true},
+		{"{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", "Password", false},
+		{"$apr1$saltsalt$yAAkm4libquA.ZWLHbSBq/", "password", true},
+		{"$apr1$saltsalt$yAAkm4libquA.ZWLHbSBq/", "passwort", false},
+		{"$apr1$r31.....$p5RA8YqZ1VaIub6spKsXN.", "p@ss w0rd!", true},
+		{"$apr1$abcdefgh$KxnTlry9zkkkUhSc6GrVg/", "a password longer than sixteen bytes", true},
+		// crypt_blowfish test vectors, the $2y$ one with a password outside ASCII
+		{"$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW", "U*U", true},
+		{"$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW", "U*V", false},
+		{"$2a$05$CCCCCCCCCCCCCCCCCCCCC.7uG0VCzI2bS7j6ymqJi9CdcdxiRTWNy", "", true},
+		{"$2a$05$XXXXXXXXXXXXXXXXXXXXXOAcXxm9kjPGEMsLznoKqmqw7tc8WCx4a", "U*U*U", true},
+		{"$2y$05$/OK.fbVrR/bpIqNJ5ianF.CE5elHaaO4EbggVDjb8P19RukzXSM3e", "\xff\xff\xa3", true},
+		{"$2b$05$/OK.fbVrR/bpIqNJ5ianF.CE5elHaaO4EbggVDjb8P19RukzXSM3e", "\xff\xff\xa3", true},
+		{"$2y$05$/OK.fbVrR/bpIqNJ5ianF.CE5elHaaO4EbggVDjb8P19RukzXSM3e", "\xff\xff\xa4", false},
+		{"$1$saltsalt$qjXMvbEw8oaL.CzflDtaK/", "password", false},
+		{"password", "password", false},
+	} {
+		if got := htpasswdMatches(test.hash, test.password); got != test.want {
+			t.Errorf("%s with %q: got %t, want %t", test.hash, test.password, got, test.want)
+		}
+	}
+}
+
+func writeTestFile(t *testing.T, name, contents string) string {
+	path := filepath.Join(t.TempDir(), name)
+
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestReadHtpasswdFile(t *testing.T) {
+	for _, test := range []struct {
+		contents string
+		valid    bool
+	}{
+		{"# users\nalice:$2y$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW\n\nbob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\ncarol:$apr1$saltsalt$yAAkm4libquA.ZWLHbSBq/\n", true},
+		{"alice:$2y$05$tooshort\n", false},
+		{"alice:$2y$99$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW\n", false},
+		{"alice:$1$saltsalt$qjXMvbEw8oaL.CzflDtaK/\n", false},
+		{"alice:password\n", false},
+		{":{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n", false},
+	} {
+		users, err := readHtpasswdFile(writeTestFile(t, "htpasswd", test.contents))
+
+		if (err == nil) != test.valid {
+			t.Errorf("%q: got %v, want valid %t", test.contents, err, test.valid)
+		}
+
+		if test.valid && len(users) != 3 {
+			t.Errorf("%q: got %d users, want 3", test.contents, len(users))
+		}
+	}
+}
+
+func TestReadAPIKeysFile(t *testing.T) {
+	apiKeys, err := readAPIKeysFile(writeTestFile(t, "keys", "# deploys\ndeploy:s3cret\nci:key:with:colons\n"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only hashes of the keys are kept
+	for key, name := range map[string]string{"s3cret": "deploy", "key:with:colons": "ci"} {
+		if got := apiKeys[sha256.Sum256([]byte(key))]; got != name {
+			t.Errorf("%q: got %q, want %q", key, got, name)
+		}
+	}
+
+	if len(apiKeys) != 2 {
+		t.Errorf("got %d keys, want 2", len(apiKeys))
+	}
+
+	for _, contents := range []string{"deploy:\n", ":s3cret\n", "s3cret\n"} {
+		if _, err := readAPIKeysFile(writeTestFile(t, "keys", contents)); err == nil {
+			t.Errorf("%q: got no error", contents)
+		}
+	}
+}
+
+func TestAuthPolicyCheck(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	forwardAuth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for header, want := range map[string]string{
+			"X-Forwarded-Method": "POST",
+			"X-Forwarded-Proto":  "http",
+			"X-Forwarded-Host":   "example.com",
+			"X-Forwarded-Uri":    "/private?page=2",
+			"X-Forwarded-For":    "192.0.2.1",
+		} {
+			if got := r.Header.Get(header); got != want {
+				t.Errorf("forward auth got %s %q, want %q", header, got, want)
+			}
+		}
+
+		if cookie, err := r.Cookie("session"); err != nil || cookie.Value != "valid" {
+			w.Header().Set("Location", "https://login.example.com/")
+			w.Header().Set("Set-Cookie", "return_to=/private")
+			w.WriteHeader(http.StatusFound)
+
+			return
+		}
+
+		w.Header().Set("X-Auth-User", "dave")
+		w.Header()["X-Auth-Groups"] = []string{"eng", "ops"}
+		w.Header().Set("X-Internal-Token", "not for the upstream")
+	}))
+
+	defer forwardAuth.Close()
+
+	policy := &authPolicy{
+		HtpasswdFile: writeTestFile(t, "htpasswd", "alice:$2y$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW\n"),
+		APIKeysFile:  writeTestFile(t, "keys", "deploy:s3cret\n"),
+		ForwardAuth:  &forwardAuthPolicy{URL: forwardAuth.URL, CopyHeaders: []string{"X-Auth-User", "X-Auth-Groups"}},
+	}
+
+	if _, err := policy.build(); err != nil {
+		t.Fatal(err)
+	}
+
+	var upstreamHeader http.Header
+
+	router := gin.New()
+
+	router.Any("/private", func(c *gin.Context) {
+		if policy.Check(c, routeSettings{domain: "example.com", project: "site", route: "/private"}) {
+			return
+		}
+
+		upstreamHeader = c.Request.Header.Clone()
+
+		c.String(http.StatusOK, "upstream")
+	})
+
+	for _, test := range []struct {
+		name     string
+		header   http.Header
+		status   int
+		upstream http.Header
+	}{
+		{
+			"basic auth",
+			http.Header{"Authorization": {"Basic YWxpY2U6VSpV"}, "X-Auth-User": {"mallory"}},
+			http.StatusOK,
+			http.Header{"X-Auth-User": {"alice"}, "Authorization": nil},
+		},
+		{
+			"api key",
+			http.Header{"X-Api-Key": {"s3cret"}},
+			http.StatusOK,
+			http.Header{"X-Auth-User": {"deploy"}, "X-Api-Key": nil},
+		},
+		{
+			"api key bearer token",
+			http.Header{"Authorization": {"Bearer s3cret"}},
+			http.StatusOK,
+			http.Header{"X-Auth-User": {"deploy"}, "Authorization": nil},
+		},
+		{
+			"forward auth",
+			http.Header{"Cookie": {"session=valid"}, "X-Auth-User": {"mallory"}, "X-Auth-Groups": {"admin"}},
+			http.StatusOK,
+			http.Header{"X-Auth-User": {"dave"}, "X-Auth-Groups": {"eng", "ops"}, "X-Internal-Token": nil, "Cookie": {"session=valid"}},
+		},
+		{
+			"forward auth redirect",
+			http.Header{"Authorization": {"Basic YWxpY2U6d3Jvbmc="}, "X-Auth-User": {"mallory"}},
+			http.StatusFound,
+			nil,
+		},
+	} {
+		upstreamHeader = nil
+
+		request := httptest.NewRequest(http.MethodPost, "http://example.com/private?page=2", nil)
+
+		request.RemoteAddr = "192.0.2.1:52000"
+
+		for key, values := range test.header {
+			request.Header[key] = values
+		}
+
+		recorder := httptest.NewRecorder()
+
+		router.ServeHTTP(recorder, request)
+
+		if recorder.Code != test.status {
+			t.Errorf("%s: got status %d, want %d", test.name, recorder.Code, test.status)
+
+			continue
+		}
+
+		if test.upstream == nil {
+			if upstreamHeader != nil {
+				t.Errorf("%s: reached the upstream", test.name)
+			}
+
+			// The auth service's answer goes back to the client as it is
+			if location, cookie := recorder.Header().Get("Location"), recorder.Header().Get("Set-Cookie"); location != "https://login.example.com/" || cookie != "return_to=/private" {
+				t.Errorf("%s: got Location %q and Set-Cookie %q from the auth service", test.name, location, cookie)
+			}
+
+			continue
+		}
+
+		for key, values := range test.upstream {
+			if got := upstreamHeader.Values(key); strings.Join(got, "|") != strings.Join(values, "|") {
+				t.Errorf("%s: upstream got %s %q, want %q", test.name, key, got, values)
+			}
+		}
+	}
+}
+
+func TestForwardAuthUnavailable(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	forwardAuth := httptest.NewServer(http.NotFoundHandler())
+
+	forwardAuth.Close()
+
+	policy := &authPolicy{ForwardAuth: &forwardAuthPolicy{URL: forwardAuth.URL}}
+
+	if _, err := policy.build(); err != nil {
+		t.Fatal(err)
+	}
+
+	router := gin.New()
+
+	router.GET("/", func(c *gin.Context) {
+		if !policy.Check(c, routeSettings{}) {
+			c.String(http.StatusOK, "upstream")
+		}
+	})
+
+	recorder := httptest.NewRecorder()
+
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d, want %d", recorder.Code, http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Certificate files in the store's directory pair up by name, "example.crt" with
+// "example.key", falling back to "example.secret" like the original cloudflare pair.
+var (
+	certificateExtensions = []string{".crt", ".pem", ".cert"}
+	keyExtensions         = []string{".key", ".secret"}
+)
+
+type storedCertificate struct {
+	Name      string    `json:"name"`
+	DNSNames  []string  `json:"dnsNames"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+
+	certificate *tls.Certificate
+}
+
+// certificateStore serves TLS certificates by SNI out of a directory of cert and key pairs,
+// reloading them when the directory changes. Handshakes already in flight keep the
+// certificate they started with, so reloading never drops a connection.
+type certificateStore struct {
+	dir         string
+	defaultName string
+
+	lock         *sync.RWMutex
+	certificates map[string]*storedCertificate
+	byName       map[string][]*storedCertificate
+	fallback     *storedCertificate
+	signature    string
+}
+
+// newCertificateStore loads the pairs in dir. Handshakes for names no certificate covers get
+// the defaultName pair, or the first pair by name if there is no such pair.
+func newCertificateStore(dir, defaultName string) (*certificateStore, error) {
+	cS := &certificateStore{
+		dir:          dir,
+		defaultName:  defaultName,
+		lock:         &sync.RWMutex{},
+		certificates: make(map[string]*storedCertificate),
+	}
+
+	if _, err := cS.Reload(); err != nil {
+		return nil, err
+	}
+
+	return cS, nil
+}
+
+// Watch polls the directory every interval and reloads the certificates when it changes.
+func (cS *certificateStore) Watch(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		if reloaded, err := cS.Reload(); err != nil {
+			log.Printf("certificates: event=reload_failed dir=%s err=%q\n", cS.dir, err)
+		} else if reloaded {
+			log.Printf("certificates: event=reloaded dir=%s certificates=%d\n", cS.dir, len(cS.Certificates()))
+		}
+	}
+}
+
+// Reload loads every pair in the directory if anything in it changed since the last load,
+// reporting whether it did. A pair that fails to load, say because it is halfway through
+// being rewritten, keeps its previously loaded certificate.
+func (cS *certificateStore) Reload() (bool, error) {
+	files, err := ioutil.ReadDir(cS.dir)
+
+	if err != nil {
+		return false, err
+	}
+
+	var signature strings.Builder
+
+	for _, file := range files {
+		fmt.Fprintf(&signature, "%s:%d:%d;", file.Name(), file.Size(), file.ModTime().UnixNano())
+	}
+
+	cS.lock.RLock()
+
+	unchanged := signature.String() == cS.signature
+
+	cS.lock.RUnlock()
+
+	if unchanged {
+		return false, nil
+	}
+
+	certificates := make(map[string]*storedCertificate)
+
+	for _, file := range files {
+		name, isCertificate := trimExtension(file.Name(), certificateExtensions)
+
+		if file.IsDir() || !isCertificate {
+			continue
+		}
+
+		certificate, err := cS.loadPair(name, filepath.Join(cS.dir, file.Name()))
+
+		if err != nil {
+			log.Printf("certificates: event=load_failed name=%s err=%q\n", name, err)
+
+			cS.lock.RLock()
+
+			certificate = cS.certificates[name]
+
+			cS.lock.RUnlock()
+
+			if certificate == nil {
+				continue
+			}
+		}
+
+		certificates[name] = certificate
+	}
+
+	cS.setCertificates(certificates, signature.String())
+
+	return true, nil
+}
+
+func (cS *certificateStore) loadPair(name, certificatePath string) (*storedCertificate, error) {
+	var keyPath string
+
+	for _, keyExtension := range keyExtensions {
+		candidate := filepath.Join(cS.dir, name+keyExtension)
+
+		if _, err := os.Stat(candidate); err == nil {
+			keyPath = candidate
+
+			break
+		}
+	}
+
+	if keyPath == "" {
+		return nil, errors.New("no matching key file")
+	}
+
+	certificate, err := tls.LoadX509KeyPair(certificatePath, keyPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+
+	if err != nil {
+		return nil, err
+	}
+
+	certificate.Leaf = leaf
+
+	dnsNames := leaf.DNSNames
+
+	if len(dnsNames) == 0 && leaf.Subject.CommonName != "" {
+		dnsNames = []string{leaf.Subject.CommonName}
+	}
+
+	return &storedCertificate{
+		Name:        name,
+		DNSNames:    dnsNames,
+		NotBefore:   leaf.NotBefore,
+		NotAfter:    leaf.NotAfter,
+		certificate: &certificate,
+	}, nil
+}
+
+func (cS *certificateStore) setCertificates(certificates map[string]*storedCertificate, signature string) {
+	byName := make(map[string][]*storedCertificate)
+
+	var fallback *storedCertificate
+
+	names := make([]string, 0, len(certificates))
+
+	for name := range certificates {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		certificate := certificates[name]
+
+		for _, dnsName := range certificate.DNSNames {
+			dnsName = strings.ToLower(dnsName)
+
+			byName[dnsName] = append(byName[dnsName], certificate)
+		}
+
+		if fallback == nil || name == cS.defaultName {
+			fallback = certificate
+		}
+	}
+
+	// Prefer whichever certificate for a name stays valid the longest
+	for _, candidates := range byName {
+		sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].NotAfter.After(candidates[j].NotAfter) })
+	}
+
+	cS.lock.Lock()
+
+	defer cS.lock.Unlock()
+
+	cS.certificates = certificates
+	cS.byName = byName
+	cS.fallback = fallback
+	cS.signature = signature
+}
+
+// GetCertificate picks a certificate for the handshake's server name, trying an exact
+// match, then a wildcard for its parent domain, and finally the default certificate.
+func (cS *certificateStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certificate, exists := cS.Lookup(hello.ServerName)
+
+	if !exists {
+		return nil, fmt.Errorf("no certificate for %q", hello.ServerName)
+	}
+
+	return certificate, nil
+}
+
+func (cS *certificateStore) Lookup(serverName string) (*tls.Certificate, bool) {
+	if certificate, exists := cS.Match(serverName); exists {
+		return certificate, true
+	}
+
+	cS.lock.RLock()
+
+	defer cS.lock.RUnlock()
+
+	if cS.fallback != nil {
+		return cS.fallback.certificate, true
+	}
+
+	return nil, false
+}
+
+// Match finds a certificate covering serverName exactly or through a wildcard, without
+// falling back to the default certificate.
+func (cS *certificateStore) Match(serverName string) (*tls.Certificate, bool) {
+	serverName = strings.ToLower(strings.TrimSuffix(serverName, "."))
+
+	cS.lock.RLock()
+
+	defer cS.lock.RUnlock()
+
+	if candidates := cS.byName[serverName]; len(candidates) != 0 {
+		return candidates[0].certificate, true
+	}
+
+	if dot := strings.IndexByte(serverName, '.'); dot > 0 {
+		if candidates := cS.byName["*"+serverName[dot:]]; len(candidates) != 0 {
+			return candidates[0].certificate, true
+		}
+	}
+
+	return nil, false
+}
+
+func (cS *certificateStore) Certificates() []storedCertificate {
+	cS.lock.RLock()
+
+	defer cS.lock.RUnlock()
+
+	certificates := make([]storedCertificate, 0, len(cS.certificates))
+
+	for _, certificate := range cS.certificates {
+		certificates = append(certificates, *certificate)
+	}
+
+	sort.Slice(certificates, func(i, j int) bool { return certificates[i].Name < certificates[j].Name })
+
+	return certificates
+}
+
+func trimExtension(fileName string, extensions []string) (string, bool) {
+	for _, extension := range extensions {
+		if strings.HasSuffix(fileName, extension) {
+			return strings.TrimSuffix(fileName, extension), true
+		}
+	}
+
+	return fileName, false
+}
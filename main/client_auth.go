@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+)
+
+// clientAuthPolicy requires TLS clients connecting to server names matching domain to present a
+// certificate issued by one of the CAs in roots, e.g. Cloudflare's origin pull CA. The domain is
+// an exact name, a "*.example.com" wildcard, or "*" for every server name.
+type clientAuthPolicy struct {
+	domain string
+	caFile string
+	roots  *x509.CertPool
+}
+
+// parseClientAuthPolicies parses a comma separated list of "domain=ca-bundle.pem" entries,
+// loading each CA bundle once.
+func parseClientAuthPolicies(value string) ([]clientAuthPolicy, error) {
+	var policies []clientAuthPolicy
+
+	pools := make(map[string]*x509.CertPool)
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+
+		if entry == "" {
+			continue
+		}
+
+		separator := strings.IndexByte(entry, '=')
+
+		if separator <= 0 || separator == len(entry)-1 {
+			return nil, fmt.Errorf("%q is not a domain=ca-bundle.pem pair", entry)
+		}
+
+		domain, caFile := strings.ToLower(strings.TrimSpace(entry[:separator])), strings.TrimSpace(entry[separator+1:])
+
+		roots, exists := pools[caFile]
+
+		if !exists {
+			caPEM, err := ioutil.ReadFile(caFile)
+
+			if err != nil {
+				return nil, err
+			}
+
+			roots = x509.NewCertPool()
+
+			if !roots.AppendCertsFromPEM(caPEM) {
+				return nil, fmt.Errorf("no certificates found in %s", caFile)
+			}
+
+			pools[caFile] = roots
+		}
+
+		policies = append(policies, clientAuthPolicy{domain: domain, caFile: caFile, roots: roots})
+	}
+
+	return policies, nil
+}
+
+// clientAuthenticator hands out a per handshake TLS config that verifies client certificates
+// for server names with a policy, leaving every other server name untouched. With acmeEnabled,
+// TLS-ALPN-01 validation handshakes are let through without a certificate.
+type clientAuthenticator struct {
+	base        *tls.Config
+	policies    []clientAuthPolicy
+	acmeEnabled bool
+}
+
+func newClientAuthenticator(base *tls.Config, policies []clientAuthPolicy, acmeEnabled bool) *clientAuthenticator {
+	return &clientAuthenticator{base: base, policies: policies, acmeEnabled: acmeEnabled}
+}
+
+// Policy finds the policy for serverName, preferring an exact match, then a wildcard for its
+// parent domain, then "*".
+func (cA *clientAuthenticator) Policy(serverName string) (clientAuthPolicy, bool) {
+	serverName = strings.ToLower(strings.TrimSuffix(serverName, "."))
+
+	candidates := []string{serverName}
+
+	if dot := strings.IndexByte(serverName, '.'); dot > 0 {
+		candidates = append(candidates, "*"+serverName[dot:])
+	}
+
+	candidates = append(candidates, "*")
+
+	for _, candidate := range candidates {
+		for _, policy := range cA.policies {
+			if policy.domain == candidate && candidate != "" {
+				return policy, true
+			}
+		}
+	}
+
+	return clientAuthPolicy{}, false
+}
+
+func (cA *clientAuthenticator) GetConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	// ACME TLS-ALPN-01 validation never presents a client certificate
+	if cA.acmeEnabled && isACMETLSALPNHello(hello) {
+		return nil, nil
+	}
+
+	policy, exists := cA.Policy(hello.ServerName)
+
+	if !exists {
+		return nil, nil
+	}
+
+	remoteAddr := ""
+
+	if hello.Conn != nil {
+		remoteAddr = hello.Conn.RemoteAddr().String()
+	}
+
+	config := cA.base.Clone()
+
+	// Verification happens in VerifyPeerCertificate rather than through RequireAndVerifyClientCert
+	// so a missing or rejected certificate can be logged with the reason
+	config.ClientAuth = tls.RequestClientCert
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		err := verifyClientCertificate(rawCerts, policy.roots)
+
+		if err != nil {
+			log.Printf("clientauth: event=rejected server_name=%q remote=%s ca=%s reason=%q\n", hello.ServerName, remoteAddr, policy.caFile, err)
+		}
+
+		return err
+	}
+
+	return config, nil
+}
+
+func verifyClientCertificate(rawCerts [][]byte, roots *x509.CertPool) error {
+	if len(rawCerts) == 0 {
+		return errors.New("no client certificate presented")
+	}
+
+	certificates := make([]*x509.Certificate, 0, len(rawCerts))
+
+	for _, rawCert := range rawCerts {
+		certificate, err := x509.ParseCertificate(rawCert)
+
+		if err != nil {
+			return fmt.Errorf("malformed client certificate: %s", err)
+		}
+
+		certificates = append(certificates, certificate)
+	}
+
+	intermediates := x509.NewCertPool()
+
+	for _, certificate := range certificates[1:] {
+		intermediates.AddCert(certificate)
+	}
+
+	_, err := certificates[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   time.Now(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+
+	if err != nil {
+		return fmt.Errorf("client certificate %q: %s", certificates[0].Subject.CommonName, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestCertificate signs template with parent's key, or self-signs it when parent is nil.
+func newTestCertificate(t *testing.T, template *x509.Certificate, parent *tls.Certificate) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	parentTemplate, parentKey := template, interface{}(key)
+
+	if parent != nil {
+		parentTemplate, parentKey = parent.Leaf, parent.PrivateKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parentTemplate, &key.PublicKey, parentKey)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// clientAuthHandshake runs a handshake against a listener using authenticator and returns the
+// server side error.
+func clientAuthHandshake(t *testing.T, authenticator *clientAuthenticator, clientConfig *tls.Config) error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer listener.Close()
+
+	serverConfig := authenticator.base.Clone()
+	serverConfig.GetConfigForClient = authenticator.GetConfigForClient
+
+	result := make(chan error, 1)
+
+	go func() {
+		conn, err := listener.Accept()
+
+		if err != nil {
+			result <- err
+			return
+		}
+
+		defer conn.Close()
+
+		result <- tls.Server(conn, serverConfig).Handshake()
+	}()
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), clientConfig)
+
+	if err == nil {
+		// TLS 1.3 clients finish before the server has checked their certificate
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+
+	return <-result
+}
+
+func TestClientAuthenticatorACMETLSALPN(t *testing.T) {
+	ca := newTestCertificate(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+
+	clientCertificate := newTestCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "origin pull"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+
+	serverCertificate := newTestCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "example.com"},
+		DNSNames:    []string{"example.com"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, nil)
+
+	roots := x509.NewCertPool()
+
+	roots.AddCert(ca.Leaf)
+
+	base := &tls.Config{
+		Certificates: []tls.Certificate{*serverCertificate},
+		NextProtos:   []string{"h2", "http/1.1", acmeTLSALPNProtocol},
+	}
+
+	policies := []clientAuthPolicy{{domain: "*", caFile: "ca.pem", roots: roots}}
+
+	for _, test := range []struct {
+		name        string
+		acmeEnabled bool
+		protocols   []string
+		certificate *tls.Certificate
+		accepted    bool
+	}{
+		{"validation handshake", true, []string{acmeTLSALPNProtocol}, nil, true},
+		{"acme-tls/1 next to h2", true, []string{acmeTLSALPNProtocol, "h2"}, nil, false},
+		{"h2 next to acme-tls/1", true, []string{"h2", acmeTLSALPNProtocol}, nil, false},
+		{"acme disabled", false, []string{acmeTLSALPNProtocol}, nil, false},
+		{"no certificate", true, []string{"h2"}, nil, false},
+		{"trusted certificate", true, []string{"h2"}, clientCertificate, true},
+		{"untrusted certificate", true, []string{"h2"}, serverCertificate, false},
+	} {
+		clientConfig := &tls.Config{
+			ServerName:         "example.com",
+			NextProtos:         test.protocols,
+			InsecureSkipVerify: true,
+		}
+
+		if test.certificate != nil {
+			clientConfig.Certificates = []tls.Certificate{*test.certificate}
+		}
+
+		err := clientAuthHandshake(t, newClientAuthenticator(base, policies, test.acmeEnabled), clientConfig)
+
+		if (err == nil) != test.accepted {
+			t.Errorf("%s: got %v, want accepted %t", test.name, err, test.accepted)
+		}
+	}
+}
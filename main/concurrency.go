@@ -0,0 +1,250 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// concurrencyPolicy caps the requests in flight to a route's upstream at MaxInFlight. Up to
+// MaxQueue more wait their turn in order, for at most QueueTimeout, 10 seconds by default, and
+// anything beyond that is shed with a 503. Scope "route", the default, counts the route's own
+// requests, while "upstream" counts every route sharing the forward host.
+type concurrencyPolicy struct {
+	MaxInFlight  int            `json:"maxInFlight"`
+	MaxQueue     int            `json:"maxQueue,omitempty"`
+	QueueTimeout configDuration `json:"queueTimeout,omitempty"`
+	Scope        string         `json:"scope,omitempty"`
+}
+
+func (cP *concurrencyPolicy) validate() error {
+	if cP.MaxInFlight <= 0 {
+		return errors.New("maxInFlight must be above 0")
+	}
+
+	if cP.MaxQueue < 0 || cP.QueueTimeout < 0 {
+		return errors.New("maxQueue and queueTimeout can't be negative")
+	}
+
+	if cP.Scope != "" && cP.Scope != "route" && cP.Scope != "upstream" {
+		return fmt.Errorf("unknown scope %q, expected route or upstream", cP.Scope)
+	}
+
+	return nil
+}
+
+func (cP *concurrencyPolicy) queueTimeout() time.Duration {
+	if cP.QueueTimeout > 0 {
+		return time.Duration(cP.QueueTimeout)
+	}
+
+	return 10 * time.Second
+}
+
+// concurrencyGate counts the requests in flight for one key and queues those waiting, each
+// waiter's channel being closed once a finished request hands it its slot.
+type concurrencyGate struct {
+	inFlight int
+	waiting  *list.List
+}
+
+type concurrencyGateStatus struct {
+	InFlight int `json:"inFlight"`
+	Queued   int `json:"queued"`
+}
+
+var (
+	errConcurrencyQueueFull    = errors.New("queue full")
+	errConcurrencyQueueTimeout = errors.New("queue timeout")
+)
+
+// concurrencyLimiter holds the gates of every route or upstream with a concurrency policy,
+// dropping them when idle. Gates outlive route config reloads so the requests in flight
+// across one still count.
+type concurrencyLimiter struct {
+	lock  *sync.Mutex
+	gates map[string]*concurrencyGate
+}
+
+func newConcurrencyLimiter() *concurrencyLimiter {
+	cL := &concurrencyLimiter{
+		lock:  &sync.Mutex{},
+		gates: make(map[string]*concurrencyGate),
+	}
+
+	concurrencyMetrics.Set("gates", expvar.Func(func() interface{} { return cL.Gates() }))
+
+	return cL
+}
+
+// Gates reports the requests in flight and queued for every busy key.
+func (cL *concurrencyLimiter) Gates() map[string]concurrencyGateStatus {
+	cL.lock.Lock()
+
+	defer cL.lock.Unlock()
+
+	gates := make(map[string]concurrencyGateStatus, len(cL.gates))
+
+	for key, gate := range cL.gates {
+		gates[key] = concurrencyGateStatus{InFlight: gate.inFlight, Queued: gate.waiting.Len()}
+	}
+
+	return gates
+}
+
+// acquire takes a slot for key, queueing for one when all maxInFlight are taken. It returns
+// the function giving the slot back, or why there was none.
+func (cL *concurrencyLimiter) acquire(ctx context.Context, key string, policy *concurrencyPolicy) (func(), error) {
+	cL.lock.Lock()
+
+	gate, exists := cL.gates[key]
+
+	if !exists {
+		gate = &concurrencyGate{waiting: list.New()}
+
+		cL.gates[key] = gate
+	}
+
+	release := func() { cL.release(key, gate) }
+
+	if gate.inFlight < policy.MaxInFlight && gate.waiting.Len() == 0 {
+		gate.inFlight++
+
+		cL.lock.Unlock()
+
+		return release, nil
+	}
+
+	if gate.waiting.Len() >= policy.MaxQueue {
+		cL.lock.Unlock()
+
+		return nil, errConcurrencyQueueFull
+	}
+
+	granted := make(chan struct{})
+
+	element := gate.waiting.PushBack(granted)
+
+	cL.lock.Unlock()
+
+	concurrencyMetrics.Add("queued", 1)
+
+	queuedAt := time.Now()
+
+	defer func() { concurrencyMetrics.Add("waitMicroseconds", time.Since(queuedAt).Microseconds()) }()
+
+	timer := time.NewTimer(policy.queueTimeout())
+
+	defer timer.Stop()
+
+	var err error
+
+	select {
+	case <-granted:
+		return release, nil
+	case <-timer.C:
+		err = errConcurrencyQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	cL.lock.Lock()
+
+	defer cL.lock.Unlock()
+
+	select {
+	case <-granted:
+		// Handed a slot just as it gave up, pass it on
+		cL.handOff(key, gate)
+	default:
+		gate.waiting.Remove(element)
+	}
+
+	return nil, err
+}
+
+func (cL *concurrencyLimiter) release(key string, gate *concurrencyGate) {
+	cL.lock.Lock()
+
+	defer cL.lock.Unlock()
+
+	cL.handOff(key, gate)
+}
+
+// handOff gives a finished request's slot to the first waiter, or frees it. Called with the
+// lock held.
+func (cL *concurrencyLimiter) handOff(key string, gate *concurrencyGate) {
+	if front := gate.waiting.Front(); front != nil {
+		gate.waiting.Remove(front)
+
+		close(front.Value.(chan struct{}))
+
+		return
+	}
+
+	gate.inFlight--
+
+	if gate.inFlight == 0 {
+		delete(cL.gates, key)
+	}
+}
+
+// Check holds the request until the policy lets it through, returning the function to call
+// once it is done, or answers it with a 503, or UNAVAILABLE for gRPC calls, when it is shed.
+// A nil function means the request was answered.
+func (cL *concurrencyLimiter) Check(c *gin.Context, request *http.Request, settings routeSettings, forwardHost string, policy *concurrencyPolicy) func() {
+	key := "route:" + settings.domain + settings.route
+
+	if policy.Scope == "upstream" {
+		key = "upstream:" + forwardHost
+	}
+
+	release, err := cL.acquire(request.Context(), key, policy)
+
+	if err == nil {
+		return release
+	}
+
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		concurrencyMetrics.Add("abandoned", 1)
+
+		if isGRPCRequest(request) && err == context.DeadlineExceeded {
+			writeGRPCError(c.Writer, request, grpcDeadlineExceeded, "deadline exceeded waiting for the upstream")
+		}
+
+		c.Abort()
+
+		return nil
+	}
+
+	concurrencyMetrics.Add("shed", 1)
+	concurrencyShedByProject.Add(metricsProjectName(settings.project), 1)
+
+	log.Printf("concurrency: event=shed key=%s project=%s client_ip=%s reason=%q\n", key, settings.project, requestClientIP(c), err)
+
+	if isGRPCRequest(request) {
+		writeGRPCError(c.Writer, request, grpcUnavailable, "upstream busy: "+err.Error())
+
+		c.Abort()
+
+		return nil
+	}
+
+	c.Header("Retry-After", "1")
+
+	c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+		"msg":  "upstream busy: " + err.Error(),
+		"err":  true,
+		"data": gin.H{},
+	})
+
+	return nil
+}
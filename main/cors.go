@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+var corsDefaultMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+
+type corsContextKey struct{}
+
+// corsPolicy answers CORS preflights for a route at the router and adds CORS headers to its
+// responses, replacing any the upstream sends. AllowedOrigins are exact origins, "*" or
+// patterns like "https://*.example.com". AllowedMethods default to the common ones and
+// AllowedHeaders may be "*". MaxAge is how many seconds browsers may cache a preflight.
+type corsPolicy struct {
+	AllowedOrigins   []string `json:"allowedOrigins"`
+	AllowedMethods   []string `json:"allowedMethods,omitempty"`
+	AllowedHeaders   []string `json:"allowedHeaders,omitempty"`
+	ExposedHeaders   []string `json:"exposedHeaders,omitempty"`
+	AllowCredentials bool     `json:"allowCredentials,omitempty"`
+	MaxAge           int      `json:"maxAge,omitempty"`
+}
+
+func (cP *corsPolicy) validate() error {
+	if len(cP.AllowedOrigins) == 0 {
+		return errors.New("allowedOrigins is empty")
+	}
+
+	for _, origin := range cP.AllowedOrigins {
+		if origin == "*" && cP.AllowCredentials {
+			// Would let any site make requests with the user's cookies
+			return errors.New("allowCredentials can't be used with the * origin")
+		}
+
+		if strings.Count(origin, "*") > 1 {
+			return errors.New("origin patterns may only have one *")
+		}
+	}
+
+	return nil
+}
+
+func (cP *corsPolicy) allowsOrigin(origin string) bool {
+	for _, allowed := range cP.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+
+		if star := strings.IndexByte(allowed, '*'); star != -1 {
+			prefix, suffix := strings.ToLower(allowed[:star]), strings.ToLower(allowed[star+1:])
+
+			lowered := strings.ToLower(origin)
+
+			if len(lowered) > len(prefix)+len(suffix) && strings.HasPrefix(lowered, prefix) && strings.HasSuffix(lowered, suffix) {
+				// The wildcard stands in for subdomains or a port, never for a path, port separator,
+				// userinfo or anything else that would move the origin onto another host
+				if isCORSWildcard(lowered[len(prefix) : len(lowered)-len(suffix)]) {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// isCORSWildcard reports whether the part of an origin matched by a * is made of hostname
+// characters only.
+func isCORSWildcard(value string) bool {
+	for _, c := range value {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '.') {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (cP *corsPolicy) methods() []string {
+	if len(cP.AllowedMethods) != 0 {
+		return cP.AllowedMethods
+	}
+
+	return corsDefaultMethods
+}
+
+func (cP *corsPolicy) allowsMethod(method string) bool {
+	for _, allowed := range cP.methods() {
+		if strings.EqualFold(allowed, method) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (cP *corsPolicy) allowsHeaders(requested string) bool {
+	for _, header := range strings.Split(requested, ",") {
+		if header = strings.TrimSpace(header); header == "" {
+			continue
+		}
+
+		allowed := false
+
+		for _, allowedHeader := range cP.AllowedHeaders {
+			if allowedHeader == "*" || strings.EqualFold(allowedHeader, header) {
+				allowed = true
+
+				break
+			}
+		}
+
+		if !allowed {
+			return false
+		}
+	}
+
+	return true
+}
+
+// allowOrigin is the Access-Control-Allow-Origin value for an allowed origin.
+func (cP *corsPolicy) allowOrigin(origin string) string {
+	for _, allowed := range cP.AllowedOrigins {
+		if allowed == "*" {
+			return "*"
+		}
+	}
+
+	return origin
+}
+
+// Handle answers preflights itself, reporting that it did, and adds the CORS headers for
+// allowed origins to other responses.
+func (cP *corsPolicy) Handle(c *gin.Context) bool {
+	origin := c.Request.Header.Get("Origin")
+
+	c.Writer.Header().Add("Vary", "Origin")
+
+	if c.Request.Method == http.MethodOptions && c.Request.Header.Get("Access-Control-Request-Method") != "" {
+		cP.preflight(c, origin)
+
+		return true
+	}
+
+	// The router's headers replace the upstream's
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), corsContextKey{}, true))
+
+	if origin == "" || !cP.allowsOrigin(origin) {
+		return false
+	}
+
+	c.Header("Access-Control-Allow-Origin", cP.allowOrigin(origin))
+
+	if cP.AllowCredentials {
+		c.Header("Access-Control-Allow-Credentials", "true")
+	}
+
+	if len(cP.ExposedHeaders) != 0 {
+		c.Header("Access-Control-Expose-Headers", strings.Join(cP.ExposedHeaders, ", "))
+	}
+
+	return false
+}
+
+func (cP *corsPolicy) preflight(c *gin.Context, origin string) {
+	c.Writer.Header().Add("Vary", "Access-Control-Request-Method")
+	c.Writer.Header().Add("Vary", "Access-Control-Request-Headers")
+
+	requestedHeaders := c.Request.Header.Get("Access-Control-Request-Headers")
+
+	if origin == "" || !cP.allowsOrigin(origin) || !cP.allowsMethod(c.Request.Header.Get("Access-Control-Request-Method")) || !cP.allowsHeaders(requestedHeaders) {
+		c.AbortWithStatus(http.StatusForbidden)
+
+		return
+	}
+
+	c.Header("Access-Control-Allow-Origin", cP.allowOrigin(origin))
+	c.Header("Access-Control-Allow-Methods", strings.Join(cP.methods(), ", "))
+
+	if requestedHeaders != "" {
+		c.Header("Access-Control-Allow-Headers", requestedHeaders)
+	}
+
+	if cP.AllowCredentials {
+		c.Header("Access-Control-Allow-Credentials", "true")
+	}
+
+	if cP.MaxAge > 0 {
+		c.Header("Access-Control-Max-Age", strconv.Itoa(cP.MaxAge))
+	}
+
+	c.AbortWithStatus(http.StatusNoContent)
+}
+
+// corsModifyResponse drops the upstream's CORS headers on routes whose CORS the router handles.
+func corsModifyResponse(resp *http.Response) error {
+	if resp.Request == nil || resp.Request.Context().Value(corsContextKey{}) == nil {
+		return nil
+	}
+
+	for header := range resp.Header {
+		if strings.HasPrefix(header, "Access-Control-") {
+			resp.Header.Del(header)
+		}
+	}
+
+	return nil
+}
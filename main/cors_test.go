@@ -0,0 +1,62 @@
+package main
+
+import "testing"
+
+func TestCORSPolicyAllowsOrigin(t *testing.T) {
+	for _, test := range []struct {
+		allowed []string
+		origin  string
+		want    bool
+	}{
+		{[]string{"*"}, "https://anything.example", true},
+		{[]string{"https://example.com"}, "https://example.com", true},
+		{[]string{"https://example.com"}, "HTTPS://EXAMPLE.COM", true},
+		{[]string{"https://example.com"}, "http://example.com", false},
+		{[]string{"https://example.com"}, "https://example.com:8443", false},
+		{[]string{"https://*.example.com"}, "https://app.example.com", true},
+		{[]string{"https://*.example.com"}, "https://a.b.example.com", true},
+		{[]string{"https://*.example.com"}, "https://App.Example.com", true},
+		{[]string{"https://*.example.com"}, "https://example.com", false},
+		{[]string{"https://*.example.com"}, "https://.example.com", false},
+		{[]string{"https://*.example.com"}, "https://evilexample.com", false},
+		{[]string{"https://*.example.com"}, "http://app.example.com", false},
+		{[]string{"https://*.example.com"}, "https://app.example.com.evil.com", false},
+		{[]string{"https://*.example.com"}, "https://evil.com/.example.com", false},
+		{[]string{"https://*.example.com"}, "https://evil.com:443/.example.com", false},
+		{[]string{"https://*.example.com"}, "https://evil.com#.example.com", false},
+		{[]string{"https://*.example.com"}, "https://evil.com?.example.com", false},
+		{[]string{"https://*.example.com"}, "https://user@evil.com\\.example.com", false},
+		{[]string{"https://*.example.com"}, "https://evil.com%2f.example.com", false},
+		{[]string{"https://*.example.com:8443"}, "https://app.example.com:8443", true},
+		{[]string{"https://*.example.com:8443"}, "https://app.example.com:9443", false},
+		{[]string{"https://*.example.com:8443"}, "https://evil.com:1.example.com:8443", false},
+		{[]string{"http://localhost:*"}, "http://localhost:3000", true},
+		{[]string{"http://localhost:*"}, "http://localhost:3000/path", false},
+		{[]string{"http://localhost:*"}, "http://localhost:@evil.com", false},
+		{[]string{"http://localhost:*"}, "http://localhost:3000:evil.com", false},
+		{[]string{"https://example.com", "https://*.example.org"}, "https://app.example.org", true},
+	} {
+		policy := &corsPolicy{AllowedOrigins: test.allowed}
+
+		if got := policy.allowsOrigin(test.origin); got != test.want {
+			t.Errorf("%q allowing %q: got %t, want %t", test.allowed, test.origin, got, test.want)
+		}
+	}
+}
+
+func TestCORSPolicyValidate(t *testing.T) {
+	for _, test := range []struct {
+		policy corsPolicy
+		valid  bool
+	}{
+		{corsPolicy{AllowedOrigins: []string{"https://*.example.com"}, AllowCredentials: true}, true},
+		{corsPolicy{AllowedOrigins: []string{"*"}}, true},
+		{corsPolicy{}, false},
+		{corsPolicy{AllowedOrigins: []string{"*"}, AllowCredentials: true}, false},
+		{corsPolicy{AllowedOrigins: []string{"https://*.*.example.com"}}, false},
+	} {
+		if err := test.policy.validate(); (err == nil) != test.valid {
+			t.Errorf("%+v: got %v, want valid %t", test.policy, err, test.valid)
+		}
+	}
+}
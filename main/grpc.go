@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gRPC status codes the router reports itself, see
+// https://github.com/grpc/grpc/blob/master/doc/statuscodes.md
+const (
+	grpcCancelled         = 1
+	grpcUnknown           = 2
+	grpcDeadlineExceeded  = 4
+	grpcPermissionDenied  = 7
+	grpcResourceExhausted = 8
+	grpcUnimplemented     = 12
+	grpcInternal          = 13
+	grpcUnavailable       = 14
+	grpcUnauthenticated   = 16
+)
+
+func isGRPCRequest(r *http.Request) bool {
+	contentType := r.Header.Get("Content-Type")
+
+	return contentType == "application/grpc" || strings.HasPrefix(contentType, "application/grpc+") || strings.HasPrefix(contentType, "application/grpc;")
+}
+
+// grpcTimeout parses the grpc-timeout header, an integer of at most 8 digits followed by
+// one of the units H, M, S, m, u or n.
+func grpcTimeout(header http.Header) (time.Duration, bool) {
+	value := header.Get("Grpc-Timeout")
+
+	if len(value) < 2 || len(value) > 9 {
+		return 0, false
+	}
+
+	amount, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+
+	if err != nil || amount < 0 {
+		return 0, false
+	}
+
+	units := map[byte]time.Duration{
+		'H': time.Hour,
+		'M': time.Minute,
+		'S': time.Second,
+		'm': time.Millisecond,
+		'u': time.Microsecond,
+		'n': time.Nanosecond,
+	}
+
+	unit, exists := units[value[len(value)-1]]
+
+	if !exists {
+		return 0, false
+	}
+
+	return time.Duration(amount) * unit, true
+}
+
+// withGRPCDeadline bounds a gRPC request's context by its grpc-timeout so an upstream that
+// ignores the deadline can't hold the call open past it.
+func withGRPCDeadline(r *http.Request) (*http.Request, context.CancelFunc) {
+	if !isGRPCRequest(r) {
+		return r, func() {}
+	}
+
+	timeout, exists := grpcTimeout(r.Header)
+
+	if !exists {
+		return r, func() {}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+
+	return r.WithContext(ctx), cancel
+}
+
+// writeGRPCError answers a gRPC call with a trailers-only response carrying code and message.
+func writeGRPCError(w http.ResponseWriter, r *http.Request, code int, message string) {
+	w.Header().Set("Content-Type", grpcWebErrorContentType(r))
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", grpcEncodeMessage(message))
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// grpcEncodeMessage percent encodes grpc-message as the gRPC HTTP/2 spec requires.
+func grpcEncodeMessage(message string) string {
+	var encoded strings.Builder
+
+	for i := 0; i < len(message); i++ {
+		if c := message[i]; c >= ' ' && c <= '~' && c != '%' {
+			encoded.WriteByte(c)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", c)
+		}
+	}
+
+	return encoded.String()
+}
+
+// grpcErrorCode maps an error reaching an upstream to the status a gRPC client should see.
+func grpcErrorCode(err error) int {
+	var netErr net.Error
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return grpcDeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		return grpcCancelled
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return grpcDeadlineExceeded
+	}
+
+	// Refused and reset connections, failed TLS handshakes and the like
+	return grpcUnavailable
+}
+
+// grpcHTTPStatusCode maps an upstream HTTP status without a grpc-status, say from a load
+// balancer in front of the service, following the gRPC HTTP to gRPC status mapping.
+func grpcHTTPStatusCode(status int) int {
+	switch status {
+	case http.StatusBadRequest:
+		return grpcInternal
+	case http.StatusUnauthorized:
+		return grpcUnauthenticated
+	case http.StatusForbidden:
+		return grpcPermissionDenied
+	case http.StatusNotFound:
+		return grpcUnimplemented
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return grpcUnavailable
+	}
+
+	return grpcUnknown
+}
+
+// proxyErrorHandler reports upstream failures as gRPC statuses to gRPC clients and as
+// 502s to everyone else, like the reverse proxy's own handler.
+func proxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	log.Printf("http: proxy error: %v", err)
+
+	if isGRPCRequest(r) {
+		writeGRPCError(w, r, grpcErrorCode(err), err.Error())
+
+		return
+	}
+
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+// grpcModifyResponse turns non gRPC error responses to gRPC requests into gRPC statuses.
+func grpcModifyResponse(resp *http.Response) error {
+	if resp.Request == nil || !isGRPCRequest(resp.Request) || resp.Header.Get("Grpc-Status") != "" {
+		return nil
+	}
+
+	if resp.StatusCode == http.StatusOK && strings.HasPrefix(resp.Header.Get("Content-Type"), "application/grpc") {
+		return nil
+	}
+
+	code := grpcHTTPStatusCode(resp.StatusCode)
+
+	message := fmt.Sprintf("upstream responded with HTTP status %d", resp.StatusCode)
+
+	resp.Body.Close()
+
+	resp.StatusCode = http.StatusOK
+	resp.Status = http.StatusText(http.StatusOK)
+	resp.ContentLength = 0
+	resp.Body = http.NoBody
+	resp.Trailer = nil
+	resp.Header = http.Header{
+		"Content-Type": {"application/grpc"},
+		"Grpc-Status":  {strconv.Itoa(code)},
+		"Grpc-Message": {grpcEncodeMessage(message)},
+	}
+
+	return nil
+}
+
+// cleartextProtocols serves HTTP/1.1 alongside h2c with prior knowledge, which is how gRPC
+// clients talk HTTP/2 without TLS.
+func cleartextProtocols() *http.Protocols {
+	protocols := &http.Protocols{}
+
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+
+	return protocols
+}
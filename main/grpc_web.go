@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// grpcWebTrailerFlag marks the gRPC-Web frame carrying the trailers at the end of a response.
+const grpcWebTrailerFlag = 0x80
+
+// Headers gRPC-Web clients send, allowed in CORS preflights on top of grpcWebPolicy.AllowedHeaders.
+var grpcWebDefaultHeaders = []string{"authorization", "content-type", "grpc-timeout", "x-grpc-web", "x-user-agent"}
+
+type grpcWebContextKey struct{}
+
+// grpcWebPolicy translates gRPC-Web calls from browsers on a route into native gRPC calls, the
+// route's upstream protocol must be h2 or h2c. AllowedOrigins lists the origins allowed to
+// make calls across origins, "*" allowing any, and MaxAge is how many seconds browsers may cache
+// a preflight.
+type grpcWebPolicy struct {
+	AllowedOrigins []string `json:"allowedOrigins,omitempty"`
+	AllowedHeaders []string `json:"allowedHeaders,omitempty"`
+	ExposedHeaders []string `json:"exposedHeaders,omitempty"`
+	MaxAge         int      `json:"maxAge,omitempty"`
+}
+
+func (gWP *grpcWebPolicy) validate() error {
+	if len(gWP.AllowedOrigins) == 0 {
+		return errors.New("allowedOrigins is empty")
+	}
+
+	return nil
+}
+
+func isGRPCWebRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc-web")
+}
+
+func isGRPCWebTextContentType(contentType string) bool {
+	return strings.HasPrefix(contentType, "application/grpc-web-text")
+}
+
+// Handle answers CORS preflights itself, reporting that it did, and otherwise turns gRPC-Web
+// calls into gRPC calls for the reverse proxy, leaving other requests alone.
+func (gWP *grpcWebPolicy) Handle(c *gin.Context) bool {
+	origin := c.Request.Header.Get("Origin")
+
+	if c.Request.Method == http.MethodOptions && c.Request.Header.Get("Access-Control-Request-Method") != "" {
+		gWP.preflight(c, origin)
+
+		return true
+	}
+
+	if !isGRPCWebRequest(c.Request) {
+		return false
+	}
+
+	if origin != "" && gWP.allowsOrigin(origin) {
+		c.Header("Access-Control-Allow-Origin", origin)
+		c.Header("Access-Control-Expose-Headers", strings.Join(append([]string{"grpc-status", "grpc-message"}, gWP.ExposedHeaders...), ", "))
+		c.Header("Vary", "Origin")
+	}
+
+	contentType := c.Request.Header.Get("Content-Type")
+
+	request := c.Request.Clone(context.WithValue(c.Request.Context(), grpcWebContextKey{}, contentType))
+
+	request.Header.Set("Content-Type", grpcContentType(contentType))
+	request.Header.Set("Te", "trailers")
+	request.Header.Del("Content-Length")
+	request.ContentLength = -1
+
+	if isGRPCWebTextContentType(contentType) {
+		request.Body = &grpcWebTextDecoder{body: c.Request.Body}
+	}
+
+	c.Request = request
+
+	return false
+}
+
+func (gWP *grpcWebPolicy) allowsOrigin(origin string) bool {
+	for _, allowedOrigin := range gWP.AllowedOrigins {
+		if allowedOrigin == "*" || strings.EqualFold(allowedOrigin, origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (gWP *grpcWebPolicy) preflight(c *gin.Context, origin string) {
+	if origin == "" || !gWP.allowsOrigin(origin) {
+		c.AbortWithStatus(http.StatusForbidden)
+
+		return
+	}
+
+	allowedHeaders := make(map[string]bool)
+
+	for _, header := range append(grpcWebDefaultHeaders, gWP.AllowedHeaders...) {
+		allowedHeaders[strings.ToLower(header)] = true
+	}
+
+	headers := make([]string, 0, len(allowedHeaders))
+
+	for header := range allowedHeaders {
+		headers = append(headers, header)
+	}
+
+	sort.Strings(headers)
+
+	c.Header("Access-Control-Allow-Origin", origin)
+	c.Header("Access-Control-Allow-Methods", "POST, OPTIONS")
+	c.Header("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+	c.Header("Vary", "Origin")
+
+	if gWP.MaxAge > 0 {
+		c.Header("Access-Control-Max-Age", strconv.Itoa(gWP.MaxAge))
+	}
+
+	c.AbortWithStatus(http.StatusNoContent)
+}
+
+// grpcContentType maps a gRPC-Web content type to the gRPC one, keeping the message format.
+func grpcContentType(grpcWebContentType string) string {
+	for _, prefix := range []string{"application/grpc-web-text", "application/grpc-web"} {
+		if strings.HasPrefix(grpcWebContentType, prefix) {
+			return "application/grpc" + strings.TrimPrefix(grpcWebContentType, prefix)
+		}
+	}
+
+	return grpcWebContentType
+}
+
+// grpcWebContentType maps a gRPC response content type back to the flavor of gRPC-Web the
+// client called with.
+func grpcWebContentType(grpcContentType, requestContentType string) string {
+	flavor := "application/grpc-web"
+
+	if isGRPCWebTextContentType(requestContentType) {
+		flavor = "application/grpc-web-text"
+	}
+
+	if !strings.HasPrefix(grpcContentType, "application/grpc") {
+		return flavor
+	}
+
+	return flavor + strings.TrimPrefix(grpcContentType, "application/grpc")
+}
+
+// grpcWebModifyResponse turns the gRPC response to a translated call into a gRPC-Web one,
+// moving the trailers into the body as the final frame.
+func grpcWebModifyResponse(resp *http.Response) error {
+	if resp.Request == nil {
+		return nil
+	}
+
+	requestContentType, isGRPCWeb := resp.Request.Context().Value(grpcWebContextKey{}).(string)
+
+	if !isGRPCWeb {
+		return nil
+	}
+
+	resp.Header.Set("Content-Type", grpcWebContentType(resp.Header.Get("Content-Type"), requestContentType))
+	resp.Header.Del("Content-Length")
+	resp.Header.Del("Trailer")
+
+	resp.ContentLength = -1
+
+	// The transport fills in resp.Trailer once the body is read, the body writes them out
+	// itself and clears them so the reverse proxy doesn't send them as HTTP trailers too
+	resp.Trailer = nil
+
+	resp.Body = &grpcWebResponseBody{
+		resp: resp,
+		body: resp.Body,
+		text: isGRPCWebTextContentType(requestContentType),
+	}
+
+	return nil
+}
+
+// grpcWebResponseBody passes a gRPC response body through, base64 encoding it for text clients,
+// and ends it with a frame holding the trailers.
+type grpcWebResponseBody struct {
+	resp *http.Response
+	body io.ReadCloser
+	text bool
+
+	buffer  []byte
+	pending []byte
+	done    bool
+}
+
+func (gWRB *grpcWebResponseBody) Read(p []byte) (int, error) {
+	for len(gWRB.pending) == 0 {
+		if gWRB.done {
+			return 0, io.EOF
+		}
+
+		if gWRB.buffer == nil {
+			gWRB.buffer = make([]byte, 32*1024)
+		}
+
+		n, err := gWRB.body.Read(gWRB.buffer)
+
+		if n > 0 {
+			gWRB.pending = gWRB.encode(gWRB.buffer[:n])
+		}
+
+		if err == io.EOF {
+			gWRB.pending = append(gWRB.pending, gWRB.encode(gWRB.trailerFrame())...)
+			gWRB.done = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, gWRB.pending)
+
+	gWRB.pending = gWRB.pending[n:]
+
+	return n, nil
+}
+
+func (gWRB *grpcWebResponseBody) Close() error {
+	return gWRB.body.Close()
+}
+
+// encode base64 encodes each chunk on its own for text clients, padding included, which
+// gRPC-Web clients decode chunk by chunk.
+func (gWRB *grpcWebResponseBody) encode(data []byte) []byte {
+	if !gWRB.text || len(data) == 0 {
+		return append([]byte(nil), data...)
+	}
+
+	encoded := make([]byte, base64.StdEncoding.EncodedLen(len(data)))
+
+	base64.StdEncoding.Encode(encoded, data)
+
+	return encoded
+}
+
+func (gWRB *grpcWebResponseBody) trailerFrame() []byte {
+	trailer := gWRB.resp.Trailer
+
+	gWRB.resp.Trailer = nil
+
+	if len(trailer) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(trailer))
+
+	for key := range trailer {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	var payload bytes.Buffer
+
+	for _, key := range keys {
+		for _, value := range trailer[key] {
+			payload.WriteString(strings.ToLower(key) + ": " + value + "\r\n")
+		}
+	}
+
+	frame := make([]byte, 5, 5+payload.Len())
+
+	frame[0] = grpcWebTrailerFlag
+
+	binary.BigEndian.PutUint32(frame[1:], uint32(payload.Len()))
+
+	return append(frame, payload.Bytes()...)
+}
+
+// grpcWebTextDecoder base64 decodes a gRPC-Web text request body four characters at a time,
+// so bodies made of separately padded chunks decode too.
+type grpcWebTextDecoder struct {
+	body io.ReadCloser
+
+	encoded []byte
+	decoded []byte
+	err     error
+}
+
+func (gWTD *grpcWebTextDecoder) Read(p []byte) (int, error) {
+	for len(gWTD.decoded) == 0 {
+		if gWTD.err != nil {
+			return 0, gWTD.err
+		}
+
+		buffer := make([]byte, 4*1024)
+
+		n, err := gWTD.body.Read(buffer)
+
+		for _, c := range buffer[:n] {
+			if c != '\r' && c != '\n' && c != ' ' {
+				gWTD.encoded = append(gWTD.encoded, c)
+			}
+		}
+
+		complete := len(gWTD.encoded) / 4 * 4
+
+		for i := 0; i < complete; i += 4 {
+			quantum := make([]byte, 3)
+
+			decodedLength, decodeErr := base64.StdEncoding.Decode(quantum, gWTD.encoded[i:i+4])
+
+			if decodeErr != nil {
+				gWTD.err = decodeErr
+
+				break
+			}
+
+			gWTD.decoded = append(gWTD.decoded, quantum[:decodedLength]...)
+		}
+
+		gWTD.encoded = gWTD.encoded[complete:]
+
+		if err == io.EOF && len(gWTD.encoded) != 0 {
+			err = io.ErrUnexpectedEOF
+		}
+
+		if gWTD.err == nil {
+			gWTD.err = err
+		}
+	}
+
+	n := copy(p, gWTD.decoded)
+
+	gWTD.decoded = gWTD.decoded[n:]
+
+	return n, nil
+}
+
+func (gWTD *grpcWebTextDecoder) Close() error {
+	return gWTD.body.Close()
+}
+
+// grpcWebErrorContentType is the content type to answer a failed call with, gRPC-Web calls
+// getting their own flavor back.
+func grpcWebErrorContentType(r *http.Request) string {
+	if requestContentType, isGRPCWeb := r.Context().Value(grpcWebContextKey{}).(string); isGRPCWeb {
+		return grpcWebContentType("application/grpc", requestContentType)
+	}
+
+	return "application/grpc"
+}
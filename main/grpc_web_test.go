@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestGRPCWebTextDecoder(t *testing.T) {
+	frame := []byte{0x00, 0x00, 0x00, 0x00, 0x05, 'h', 'e', 'l', 'l', 'o'}
+
+	encode := base64.StdEncoding.EncodeToString
+
+	for _, test := range []struct {
+		name    string
+		body    string
+		want    []byte
+		wantErr error
+	}{
+		{"one chunk", encode(frame), frame, nil},
+		{"separately padded chunks", encode(frame[:4]) + encode(frame[4:]), frame, nil},
+		{"line breaks", encode(frame[:6]) + "\r\n" + encode(frame[6:]) + "\n", frame, nil},
+		{"empty", "", nil, nil},
+		{"truncated", encode(frame)[:7], frame[:3], io.ErrUnexpectedEOF},
+		{"invalid", "AAAA!!!!", []byte{0, 0, 0}, base64.CorruptInputError(0)},
+		{"padding mid quantum", "AA=A", nil, base64.CorruptInputError(2)},
+	} {
+		for _, oneByte := range []bool{false, true} {
+			var body io.Reader = strings.NewReader(test.body)
+
+			if oneByte {
+				// Quanta split across reads
+				body = iotest.OneByteReader(body)
+			}
+
+			decoder := &grpcWebTextDecoder{body: ioutil.NopCloser(body)}
+
+			got, err := ioutil.ReadAll(decoder)
+
+			if err != test.wantErr {
+				t.Errorf("%s (one byte reads %t): got error %v, want %v", test.name, oneByte, err, test.wantErr)
+			}
+
+			if !bytes.Equal(got, test.want) {
+				t.Errorf("%s (one byte reads %t): got %x, want %x", test.name, oneByte, got, test.want)
+			}
+		}
+	}
+}
+
+func TestGRPCWebResponseTrailerFrame(t *testing.T) {
+	message := []byte{0x00, 0x00, 0x00, 0x00, 0x02, 'o', 'k'}
+
+	trailerFrame := func(payload string) string {
+		return string([]byte{grpcWebTrailerFlag, 0, 0, 0, byte(len(payload))}) + payload
+	}
+
+	for _, test := range []struct {
+		name    string
+		text    bool
+		trailer http.Header
+		want    string
+	}{
+		{
+			"binary",
+			false,
+			http.Header{"Grpc-Status": {"0"}, "Grpc-Message": {"done"}},
+			string(message) + trailerFrame("grpc-message: done\r\ngrpc-status: 0\r\n"),
+		},
+		{
+			"text",
+			true,
+			http.Header{"Grpc-Status": {"0"}},
+			base64.StdEncoding.EncodeToString(message) + base64.StdEncoding.EncodeToString([]byte(trailerFrame("grpc-status: 0\r\n"))),
+		},
+		{
+			"repeated trailer",
+			false,
+			http.Header{"Grpc-Status": {"0"}, "X-Tag": {"a", "b"}},
+			string(message) + trailerFrame("grpc-status: 0\r\nx-tag: a\r\nx-tag: b\r\n"),
+		},
+		{"no trailers", false, nil, string(message)},
+	} {
+		resp := &http.Response{Header: http.Header{}, Trailer: http.Header{}}
+
+		// The transport only fills in the trailers once the upstream body has been read
+		resp.Body = &trailingBody{Reader: bytes.NewReader(message), resp: resp, trailer: test.trailer}
+
+		body := &grpcWebResponseBody{resp: resp, body: resp.Body, text: test.text}
+
+		got, err := ioutil.ReadAll(body)
+
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		if string(got) != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+
+		if len(resp.Trailer) != 0 {
+			t.Errorf("%s: trailers %v left for the reverse proxy to send", test.name, resp.Trailer)
+		}
+	}
+}
+
+// trailingBody sets resp's trailers when it reaches EOF, like a transport's response body.
+type trailingBody struct {
+	*bytes.Reader
+
+	resp    *http.Response
+	trailer http.Header
+}
+
+func (tB *trailingBody) Read(p []byte) (int, error) {
+	n, err := tB.Reader.Read(p)
+
+	if err == io.EOF {
+		for key, values := range tB.trailer {
+			tB.resp.Trailer[key] = values
+		}
+	}
+
+	return n, err
+}
+
+func (tB *trailingBody) Close() error {
+	return nil
+}
+
+func TestParseRouteConfigGRPCWeb(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		config string
+		valid  bool
+	}{
+		{"h2c upstream", `{"routes": [{"match": {"project": "api"}, "upstream": {"protocol": "h2c"}, "grpcWeb": {"allowedOrigins": ["*"]}}]}`, true},
+		{"h2 upstream on the domain", `{"routes": [
+			{"match": {"domain": "example.com"}, "upstream": {"protocol": "h2"}},
+			{"match": {"domain": "example.com", "project": "api"}, "grpcWeb": {"allowedOrigins": ["https://app.example.com"]}}
+		]}`, true},
+		{"no allowed origins", `{"routes": [{"match": {"project": "api"}, "upstream": {"protocol": "h2c"}, "grpcWeb": {}}]}`, false},
+		{"no upstream section", `{"routes": [{"match": {"project": "api"}, "grpcWeb": {"allowedOrigins": ["*"]}}]}`, false},
+		{"negotiated upstream", `{"routes": [{"match": {"project": "api"}, "upstream": {}, "grpcWeb": {"allowedOrigins": ["*"]}}]}`, false},
+		{"http1 upstream", `{"routes": [{"match": {"project": "api"}, "upstream": {"protocol": "http1"}, "grpcWeb": {"allowedOrigins": ["*"]}}]}`, false},
+		{"http1 upstream on one route", `{"routes": [
+			{"match": {"project": "api"}, "upstream": {"protocol": "h2c"}, "grpcWeb": {"allowedOrigins": ["*"]}},
+			{"match": {"project": "api", "route": "/legacy"}, "upstream": {"protocol": "http1"}}
+		]}`, false},
+		{"http1 upstream on another project", `{"routes": [
+			{"match": {"project": "api"}, "upstream": {"protocol": "h2c"}, "grpcWeb": {"allowedOrigins": ["*"]}},
+			{"match": {"project": "site"}, "upstream": {"protocol": "http1"}}
+		]}`, true},
+		{"http1 upstream on an overlapping domain", `{"routes": [
+			{"match": {"project": "api"}, "upstream": {"protocol": "h2c"}, "grpcWeb": {"allowedOrigins": ["*"]}},
+			{"match": {"domain": "example.com"}, "upstream": {"protocol": "http1"}}
+		]}`, true},
+		{"http1 upstream overriding on a domain", `{"routes": [
+			{"match": {"project": "api"}, "grpcWeb": {"allowedOrigins": ["*"]}},
+			{"upstream": {"protocol": "h2c"}},
+			{"match": {"domain": "example.com", "project": "api"}, "upstream": {"protocol": "http1"}}
+		]}`, false},
+	} {
+		if _, err := parseRouteConfig([]byte(test.config)); (err == nil) != test.valid {
+			t.Errorf("%s: got %v, want valid %t", test.name, err, test.valid)
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const requestIDKey = "requestID"
+
+type headerRulesContextKey struct{}
+
+// headerRulesPolicy changes the headers of the request sent to a route's upstream and of the
+// upstream's response. Like securityHeaders it is layered, the rules of every matching rule
+// applying from the least specific to the most.
+type headerRulesPolicy struct {
+	Request  *headerRuleSet `json:"request,omitempty"`
+	Response *headerRuleSet `json:"response,omitempty"`
+}
+
+func (hRP *headerRulesPolicy) build() error {
+	if hRP.Request != nil {
+		if err := hRP.Request.build(true); err != nil {
+			return fmt.Errorf("request: %s", err)
+		}
+	}
+
+	if hRP.Response != nil {
+		if err := hRP.Response.build(false); err != nil {
+			return fmt.Errorf("response: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// headerRuleSet removes the headers in Remove, then replaces those in Set and appends those in
+// Add. Values are templates where ${clientIP}, ${domain}, ${project}, ${route}, ${requestID},
+// ${host}, ${method}, ${path}, ${scheme}, ${header.Name} for a request header and ${claim.name}
+// for a claim of the route's JWT are replaced by their values for the request.
+type headerRuleSet struct {
+	Add    map[string]string `json:"add,omitempty"`
+	Set    map[string]string `json:"set,omitempty"`
+	Remove []string          `json:"remove,omitempty"`
+
+	add []headerRule
+	set []headerRule
+}
+
+type headerRule struct {
+	name     string
+	template headerTemplate
+}
+
+func (hRS *headerRuleSet) build(request bool) error {
+	for _, name := range hRS.Remove {
+		if err := validateHeaderRuleName(name, request); err != nil {
+			return fmt.Errorf("remove: %s", err)
+		}
+	}
+
+	var err error
+
+	if hRS.set, err = buildHeaderRules(hRS.Set, request); err != nil {
+		return fmt.Errorf("set: %s", err)
+	}
+
+	if hRS.add, err = buildHeaderRules(hRS.Add, request); err != nil {
+		return fmt.Errorf("add: %s", err)
+	}
+
+	return nil
+}
+
+func buildHeaderRules(values map[string]string, request bool) ([]headerRule, error) {
+	rules := make([]headerRule, 0, len(values))
+
+	for name, value := range values {
+		if err := validateHeaderRuleName(name, request); err != nil {
+			return nil, err
+		}
+
+		template, err := parseHeaderTemplate(value)
+
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+
+		rules = append(rules, headerRule{name: http.CanonicalHeaderKey(name), template: template})
+	}
+
+	// Map order is random, keep what the upstream and clients see stable
+	sort.Slice(rules, func(i, j int) bool { return rules[i].name < rules[j].name })
+
+	return rules, nil
+}
+
+func validateHeaderRuleName(name string, request bool) error {
+	if name == "" || strings.ContainsAny(name, " \t\r\n:") {
+		return fmt.Errorf("invalid header name %q", name)
+	}
+
+	if request && strings.EqualFold(name, "Host") {
+		// Go sends the request's Host field, not its header
+		return errors.New("the Host header can't be changed")
+	}
+
+	return nil
+}
+
+func (hRS *headerRuleSet) apply(header http.Header, variables headerVariables) {
+	for _, name := range hRS.Remove {
+		header.Del(name)
+	}
+
+	for _, rule := range hRS.set {
+		header.Set(rule.name, rule.template.render(variables))
+	}
+
+	for _, rule := range hRS.add {
+		header.Add(rule.name, rule.template.render(variables))
+	}
+}
+
+// headerTemplate is a header value split into literal text and ${variable} references, one
+// part each.
+type headerTemplate []headerTemplatePart
+
+type headerTemplatePart struct {
+	literal  string
+	variable string
+}
+
+var headerTemplateVariables = map[string]bool{
+	"clientIP":  true,
+	"domain":    true,
+	"project":   true,
+	"route":     true,
+	"requestID": true,
+	"host":      true,
+	"method":    true,
+	"path":      true,
+	"scheme":    true,
+}
+
+func parseHeaderTemplate(value string) (headerTemplate, error) {
+	if strings.IndexFunc(value, isHeaderControlCharacter) != -1 {
+		return nil, errors.New("value has a control character")
+	}
+
+	var template headerTemplate
+
+	for value != "" {
+		start := strings.Index(value, "${")
+
+		if start == -1 {
+			template = append(template, headerTemplatePart{literal: value})
+
+			break
+		}
+
+		if start > 0 {
+			template = append(template, headerTemplatePart{literal: value[:start]})
+		}
+
+		end := strings.IndexByte(value[start:], '}')
+
+		if end == -1 {
+			return nil, fmt.Errorf("unclosed ${ in %q", value)
+		}
+
+		variable := value[start+2 : start+end]
+
+		if !headerTemplateVariables[variable] && !strings.HasPrefix(variable, "header.") && !strings.HasPrefix(variable, "claim.") {
+			return nil, fmt.Errorf("unknown variable ${%s}", variable)
+		}
+
+		template = append(template, headerTemplatePart{variable: variable})
+
+		value = value[start+end+1:]
+	}
+
+	return template, nil
+}
+
+func (hT headerTemplate) render(variables headerVariables) string {
+	var rendered strings.Builder
+
+	for _, part := range hT {
+		if part.variable == "" {
+			rendered.WriteString(part.literal)
+		} else {
+			// Claims and headers can hold line breaks, which would make the header invalid
+			rendered.WriteString(strings.Map(sanitizeHeaderCharacter, variables.value(part.variable)))
+		}
+	}
+
+	return rendered.String()
+}
+
+// isHeaderControlCharacter reports whether r can't be sent in a header value. Tabs can.
+func isHeaderControlCharacter(r rune) bool {
+	return (r < ' ' && r != '\t') || r == 0x7F
+}
+
+func sanitizeHeaderCharacter(r rune) rune {
+	if isHeaderControlCharacter(r) {
+		return ' '
+	}
+
+	return r
+}
+
+// headerVariables are the values templates can use, taken from the client's request before any
+// rule changes it, so request and response rules see the same ones.
+type headerVariables struct {
+	values  map[string]string
+	headers http.Header
+	claims  map[string]interface{}
+}
+
+func newHeaderVariables(c *gin.Context, settings routeSettings) headerVariables {
+	scheme := "http"
+
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+
+	variables := headerVariables{
+		values: map[string]string{
+			"clientIP":  requestClientIP(c),
+			"domain":    settings.domain,
+			"project":   settings.project,
+			"route":     settings.route,
+			"requestID": requestID(c),
+			"host":      c.Request.Host,
+			"method":    c.Request.Method,
+			"path":      c.Request.URL.Path,
+			"scheme":    scheme,
+		},
+		headers: c.Request.Header.Clone(),
+	}
+
+	if claims, exists := c.Get(jwtClaimsKey); exists {
+		variables.claims, _ = claims.(map[string]interface{})
+	}
+
+	return variables
+}
+
+func (hV headerVariables) value(variable string) string {
+	if name := strings.TrimPrefix(variable, "header."); name != variable {
+		return hV.headers.Get(name)
+	}
+
+	if name := strings.TrimPrefix(variable, "claim."); name != variable {
+		if claim, exists := hV.claims[name]; exists {
+			return jwtClaimString(claim)
+		}
+
+		return ""
+	}
+
+	return hV.values[variable]
+}
+
+// requestID is the request's X-Request-Id, or a new random one when it has none, kept so every
+// rule sees the same one.
+func requestID(c *gin.Context) string {
+	if id := c.GetString(requestIDKey); id != "" {
+		return id
+	}
+
+	id := c.Request.Header.Get("X-Request-Id")
+
+	if id == "" || len(id) > 128 {
+		random := make([]byte, 16)
+
+		rand.Read(random)
+
+		id = hex.EncodeToString(random)
+	}
+
+	c.Set(requestIDKey, id)
+
+	return id
+}
+
+// headerRulesState carries what the response rules need from the request.
+type headerRulesState struct {
+	rules     []*routeRule
+	variables headerVariables
+}
+
+// applyHeaderRules applies the request rules of the matching rules, least specific first, and
+// leaves their response rules for headerRulesModifyResponse.
+func applyHeaderRules(c *gin.Context, settings routeSettings, rules []*routeRule) {
+	variables := newHeaderVariables(c, settings)
+
+	for _, rule := range rules {
+		if rule.Headers.Request != nil {
+			rule.Headers.Request.apply(c.Request.Header, variables)
+		}
+	}
+
+	state := &headerRulesState{rules: rules, variables: variables}
+
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), headerRulesContextKey{}, state))
+}
+
+// headerRulesModifyResponse applies the response rules left by applyHeaderRules to the upstream's
+// response.
+func headerRulesModifyResponse(resp *http.Response) error {
+	if resp.Request == nil {
+		return nil
+	}
+
+	state, _ := resp.Request.Context().Value(headerRulesContextKey{}).(*headerRulesState)
+
+	if state == nil {
+		return nil
+	}
+
+	for _, rule := range state.rules {
+		if rule.Headers.Response != nil {
+			rule.Headers.Response.apply(resp.Header, state.variables)
+		}
+	}
+
+	return nil
+}
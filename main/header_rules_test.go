@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseHeaderTemplate(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		want  headerTemplate
+		valid bool
+	}{
+		{"", nil, true},
+		{"static", headerTemplate{{literal: "static"}}, true},
+		{"${requestID}", headerTemplate{{variable: "requestID"}}, true},
+		{
+			"${scheme}://${host}${path}",
+			headerTemplate{{variable: "scheme"}, {literal: "://"}, {variable: "host"}, {variable: "path"}},
+			true,
+		},
+		{
+			"user=${claim.sub}; ua=${header.User-Agent}",
+			headerTemplate{{literal: "user="}, {variable: "claim.sub"}, {literal: "; ua="}, {variable: "header.User-Agent"}},
+			true,
+		},
+		{"tab\tseparated", headerTemplate{{literal: "tab\tseparated"}}, true},
+		{"${unknown}", nil, false},
+		{"${}", nil, false},
+		{"${host", nil, false},
+		{"a\r\nX-Injected: 1", nil, false},
+		{"a\nb", nil, false},
+		{"nul\x00", nil, false},
+		{"del\x7F", nil, false},
+	} {
+		got, err := parseHeaderTemplate(test.value)
+
+		if (err == nil) != test.valid {
+			t.Errorf("%q: got %v, want valid %t", test.value, err, test.valid)
+
+			continue
+		}
+
+		if test.valid && !equalHeaderTemplates(got, test.want) {
+			t.Errorf("%q: got %+v, want %+v", test.value, got, test.want)
+		}
+	}
+}
+
+func equalHeaderTemplates(a, b headerTemplate) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestHeaderTemplateRender(t *testing.T) {
+	variables := headerVariables{
+		values:  map[string]string{"project": "blog", "path": "/posts"},
+		headers: http.Header{"User-Agent": {"curl/8.0"}, "X-Note": {"a\r\nX-Injected: 1"}},
+		claims: map[string]interface{}{
+			"sub":    "alice",
+			"groups": []interface{}{"eng", "ops"},
+			"name":   "Alice\nSmith\x00",
+			"level":  json.Number("3"),
+		},
+	}
+
+	for _, test := range []struct {
+		value string
+		want  string
+	}{
+		{"${project}${path}", "blog/posts"},
+		{"${header.User-Agent}", "curl/8.0"},
+		{"${header.X-Missing}", ""},
+		{"${claim.sub}:${claim.level}", "alice:3"},
+		{"${claim.groups}", "eng,ops"},
+		{"${claim.missing}", ""},
+		// Control characters from the request can't end the header or start another one
+		{"${header.X-Note}", "a  X-Injected: 1"},
+		{"name=${claim.name}", "name=Alice Smith "},
+	} {
+		template, err := parseHeaderTemplate(test.value)
+
+		if err != nil {
+			t.Fatalf("%q: %s", test.value, err)
+		}
+
+		if got := template.render(variables); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestHeaderRuleSetApply(t *testing.T) {
+	ruleSet := &headerRuleSet{
+		Remove: []string{"X-Tag", "Server"},
+		Set:    map[string]string{"X-Tag": "set", "X-Project": "${project}"},
+		Add:    map[string]string{"x-tag": "added", "Server": "router"},
+	}
+
+	if err := ruleSet.build(false); err != nil {
+		t.Fatal(err)
+	}
+
+	header := http.Header{"X-Tag": {"upstream", "upstream2"}, "Server": {"upstream"}, "X-Project": {"old"}, "X-Kept": {"kept"}}
+
+	ruleSet.apply(header, headerVariables{values: map[string]string{"project": "blog"}})
+
+	// Removed first, then set, then added to
+	for key, want := range map[string][]string{
+		"X-Tag":     {"set", "added"},
+		"Server":    {"router"},
+		"X-Project": {"blog"},
+		"X-Kept":    {"kept"},
+	} {
+		if got := header.Values(key); strings.Join(got, "|") != strings.Join(want, "|") {
+			t.Errorf("%s: got %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestHeaderRuleSetBuild(t *testing.T) {
+	for _, test := range []struct {
+		ruleSet headerRuleSet
+		request bool
+		valid   bool
+	}{
+		{headerRuleSet{Set: map[string]string{"X-Project": "${project}"}}, true, true},
+		{headerRuleSet{Set: map[string]string{"Host": "example.com"}}, true, false},
+		{headerRuleSet{Set: map[string]string{"Host": "example.com"}}, false, true},
+		{headerRuleSet{Remove: []string{"X Bad"}}, false, false},
+		{headerRuleSet{Add: map[string]string{"X-Bad:": "value"}}, false, false},
+		{headerRuleSet{Add: map[string]string{"X-Value": "${unknown}"}}, false, false},
+	} {
+		if err := test.ruleSet.build(test.request); (err == nil) != test.valid {
+			t.Errorf("%+v (request %t): got %v, want valid %t", test.ruleSet, test.request, err, test.valid)
+		}
+	}
+}
+
+func TestApplyHeaderRules(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var rules []*routeRule
+
+	// Least specific first, as applyHeaderRules gets them
+	for _, config := range []string{
+		`{"request": {"set": {"X-Layer": "domain", "X-Domain": "${domain}"}}, "response": {"remove": ["Server"], "add": {"X-Layer": "domain"}}}`,
+		`{"request": {"remove": ["X-Domain"], "set": {"X-Layer": "project"}, "add": {"X-Layer": "${claim.sub}"}}, "response": {"set": {"X-Layer": "project"}}}`,
+	} {
+		rule := &routeRule{Headers: &headerRulesPolicy{}}
+
+		if err := json.Unmarshal([]byte(config), rule.Headers); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := rule.Headers.build(); err != nil {
+			t.Fatal(err)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+
+	c.Request = httptest.NewRequest(http.MethodGet, "http://example.com/posts", nil)
+
+	c.Request.Header.Set("X-Layer", "client")
+
+	c.Set(jwtClaimsKey, map[string]interface{}{"sub": "alice\r\n"})
+
+	applyHeaderRules(c, routeSettings{domain: "example.com", project: "blog", route: "/posts"}, rules)
+
+	for key, want := range map[string][]string{
+		"X-Layer":  {"project", "alice  "},
+		"X-Domain": nil,
+	} {
+		if got := c.Request.Header.Values(key); strings.Join(got, "|") != strings.Join(want, "|") {
+			t.Errorf("request %s: got %q, want %q", key, got, want)
+		}
+	}
+
+	resp := &http.Response{Header: http.Header{"Server": {"upstream"}, "X-Layer": {"upstream"}}, Request: c.Request}
+
+	if err := headerRulesModifyResponse(resp); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, want := range map[string][]string{
+		"X-Layer": {"project"},
+		"Server":  nil,
+	} {
+		if got := resp.Header.Values(key); strings.Join(got, "|") != strings.Join(want, "|") {
+			t.Errorf("response %s: got %q, want %q", key, got, want)
+		}
+	}
+}
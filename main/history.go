@@ -0,0 +1,130 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/the-rileyj/uyghurs"
+)
+
+// routingChange describes where a routing update came from so it can be recorded in the history.
+type routingChange struct {
+	Source          string
+	UyghursRevision int64
+	Commit          *uyghurs.GithubPush
+}
+
+// routingHistoryEntry records one routing table that went live. The projects snapshot
+// is shared with the routes manager, which never mutates a projects map once built.
+type routingHistoryEntry struct {
+	Revision        int64               `json:"revision"`
+	Source          string              `json:"source"`
+	Project         string              `json:"project"`
+	Timestamp       time.Time           `json:"timestamp"`
+	UyghursRevision int64               `json:"uyghursRevision,omitempty"`
+	Commit          *uyghurs.GithubPush `json:"commit,omitempty"`
+
+	projectsMap map[string]*uyghurs.ProjectMetadata
+}
+
+// routingHistory keeps the most recent routing tables, oldest first, dropping the oldest
+// entry once size is reached.
+type routingHistory struct {
+	size    int
+	entries []*routingHistoryEntry
+}
+
+func newRoutingHistory(size int) *routingHistory {
+	if size < 1 {
+		size = 1
+	}
+
+	return &routingHistory{size: size}
+}
+
+func (rH *routingHistory) Add(entry *routingHistoryEntry) {
+	rH.entries = append(rH.entries, entry)
+
+	if len(rH.entries) > rH.size {
+		rH.entries = append([]*routingHistoryEntry(nil), rH.entries[len(rH.entries)-rH.size:]...)
+	}
+}
+
+func (rH *routingHistory) Get(revision int64) (*routingHistoryEntry, bool) {
+	for _, entry := range rH.entries {
+		if entry.Revision == revision {
+			return entry, true
+		}
+	}
+
+	return nil, false
+}
+
+func (rH *routingHistory) Entries() []routingHistoryEntry {
+	entries := make([]routingHistoryEntry, len(rH.entries))
+
+	for i, entry := range rH.entries {
+		entries[i] = *entry
+	}
+
+	return entries
+}
+
+type routeTarget struct {
+	Project     string `json:"project"`
+	ForwardHost string `json:"forwardHost"`
+}
+
+type routeDiff struct {
+	Route  string       `json:"route"`
+	Change string       `json:"change"`
+	From   *routeTarget `json:"from,omitempty"`
+	To     *routeTarget `json:"to,omitempty"`
+}
+
+// flattenRoutes maps every domain and route pair of a projects snapshot to where it is sent.
+func flattenRoutes(projectsMap map[string]*uyghurs.ProjectMetadata, defaultDomain string) map[string]routeTarget {
+	routes := make(map[string]routeTarget)
+
+	for projectName, projectMetadata := range projectsMap {
+		for _, routeInfo := range projectMetadata.ProjectRoutes {
+			routes[routeKey(routeInfo, defaultDomain)] = routeTarget{Project: projectName, ForwardHost: routeInfo.ForwardHost}
+		}
+	}
+
+	return routes
+}
+
+// diffRoutes lists the routes added, removed or pointed somewhere else going from one
+// projects snapshot to another, sorted by route.
+func diffRoutes(from, to map[string]*uyghurs.ProjectMetadata, defaultDomain string) []routeDiff {
+	fromRoutes := flattenRoutes(from, defaultDomain)
+	toRoutes := flattenRoutes(to, defaultDomain)
+
+	diffs := make([]routeDiff, 0)
+
+	for route, fromTarget := range fromRoutes {
+		fromTarget := fromTarget
+
+		toTarget, exists := toRoutes[route]
+
+		switch {
+		case !exists:
+			diffs = append(diffs, routeDiff{Route: route, Change: "removed", From: &fromTarget})
+		case toTarget != fromTarget:
+			diffs = append(diffs, routeDiff{Route: route, Change: "changed", From: &fromTarget, To: &toTarget})
+		}
+	}
+
+	for route, toTarget := range toRoutes {
+		toTarget := toTarget
+
+		if _, exists := fromRoutes[route]; !exists {
+			diffs = append(diffs, routeDiff{Route: route, Change: "added", To: &toTarget})
+		}
+	}
+
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Route < diffs[j].Route })
+
+	return diffs
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// httpExemption lets requests for a domain, optionally only under a route prefix, be
+// proxied over plain HTTP instead of redirected. An empty domain matches every host.
+type httpExemption struct {
+	domain string
+	route  string
+}
+
+// parseHTTPExemptions parses a comma separated list of "domain", "domain/route" and
+// "/route" entries.
+func parseHTTPExemptions(value string) []httpExemption {
+	var exemptions []httpExemption
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+
+		if entry == "" {
+			continue
+		}
+
+		exemption := httpExemption{domain: entry, route: "/"}
+
+		if slash := strings.IndexByte(entry, '/'); slash != -1 {
+			exemption.domain, exemption.route = entry[:slash], entry[slash:]
+		}
+
+		exemption.domain = strings.ToLower(exemption.domain)
+
+		exemptions = append(exemptions, exemption)
+	}
+
+	return exemptions
+}
+
+// httpRedirector serves the plain HTTP listener, redirecting everything to HTTPS except
+// exempted domains and routes, which are handed to the regular routing handler.
+type httpRedirector struct {
+	status     int
+	exemptions []httpExemption
+	next       http.Handler
+}
+
+func newHTTPRedirector(status int, exemptions []httpExemption, next http.Handler) (*httpRedirector, error) {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return nil, fmt.Errorf("%d is not a redirect status", status)
+	}
+
+	return &httpRedirector{status: status, exemptions: exemptions, next: next}, nil
+}
+
+func (hR *httpRedirector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := strings.ToLower(r.Host)
+
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+
+	for _, exemption := range hR.exemptions {
+		if (exemption.domain == "" || exemption.domain == host) && strings.HasPrefix(r.URL.Path, exemption.route) {
+			hR.next.ServeHTTP(w, r)
+
+			return
+		}
+	}
+
+	if host == "" {
+		http.Error(w, "missing host", http.StatusBadRequest)
+
+		return
+	}
+
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), hR.status)
+}
+
+// hstsMiddleware sets Strict-Transport-Security on responses served over TLS, as the least
+// specific layer of the security headers, so a securityHeaders rule's strictTransportSecurity
+// replaces it and an upstream's own header wins over it unless the rule enforces the router's.
+func hstsMiddleware(maxAge time.Duration, includeSubdomains, preload bool) gin.HandlerFunc {
+	value := fmt.Sprintf("max-age=%d", int64(maxAge.Seconds()))
+
+	if includeSubdomains {
+		value += "; includeSubDomains"
+	}
+
+	if preload {
+		value += "; preload"
+	}
+
+	policy := &securityHeadersPolicy{StrictTransportSecurity: value}
+
+	return func(c *gin.Context) {
+		policy.Apply(c)
+
+		c.Next()
+	}
+}
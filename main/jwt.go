@@ -0,0 +1,700 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const jwtClaimsKey = "jwtClaims"
+
+// jwtPolicy requires a JWT, a bearer token or the Cookie named, signed by a key from JWKSFile
+// or JWKSURL, with one of Algorithms, any asymmetric one by default. Tokens must not have
+// expired, give or take Leeway, 30 seconds by default, and must come from Issuer and be for one
+// of Audiences when those are set. RequiredClaims maps claims to the value they must have, or
+// contain when they are lists or space separated scopes, null only requiring they be there.
+// ClaimHeaders copies claims into upstream request headers, which clients can't set themselves.
+type jwtPolicy struct {
+	JWKSFile       string                 `json:"jwksFile,omitempty"`
+	JWKSURL        string                 `json:"jwksURL,omitempty"`
+	JWKSRefresh    configDuration         `json:"jwksRefresh,omitempty"`
+	Algorithms     []string               `json:"algorithms,omitempty"`
+	Issuer         string                 `json:"issuer,omitempty"`
+	Audiences      []string               `json:"audiences,omitempty"`
+	Leeway         configDuration         `json:"leeway,omitempty"`
+	RequiredClaims map[string]interface{} `json:"requiredClaims,omitempty"`
+	ClaimHeaders   map[string]string      `json:"claimHeaders,omitempty"`
+	Cookie         string                 `json:"cookie,omitempty"`
+
+	keys *jwks
+}
+
+var jwtAlgorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"PS256": crypto.SHA256, "PS384": crypto.SHA384, "PS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+	"EdDSA": 0,
+}
+
+// build loads the policy's JWKS file, or sets up fetching its JWKS URL, returning the files it
+// read.
+func (jP *jwtPolicy) build() ([]string, error) {
+	if (jP.JWKSFile == "") == (jP.JWKSURL == "") {
+		return nil, errors.New("set one of jwksFile and jwksURL")
+	}
+
+	for _, algorithm := range jP.Algorithms {
+		if _, known := jwtAlgorithms[algorithm]; !known {
+			return nil, fmt.Errorf("unsupported algorithm %q", algorithm)
+		}
+	}
+
+	if jP.JWKSFile != "" {
+		data, err := ioutil.ReadFile(jP.JWKSFile)
+
+		if err != nil {
+			return []string{jP.JWKSFile}, err
+		}
+
+		keys, err := parseJWKS(data)
+
+		if err != nil {
+			return []string{jP.JWKSFile}, fmt.Errorf("%s: %s", jP.JWKSFile, err)
+		}
+
+		jP.keys = &jwks{lock: &sync.RWMutex{}, keys: keys}
+
+		return []string{jP.JWKSFile}, nil
+	}
+
+	if parsed, err := url.Parse(jP.JWKSURL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return nil, fmt.Errorf("jwksURL %q is not an http or https URL", jP.JWKSURL)
+	}
+
+	refresh := time.Duration(jP.JWKSRefresh)
+
+	if refresh <= 0 {
+		refresh = 10 * time.Minute
+	}
+
+	jP.keys = &jwks{url: jP.JWKSURL, refresh: refresh, lock: &sync.RWMutex{}}
+
+	return nil, nil
+}
+
+func (jP *jwtPolicy) token(r *http.Request) string {
+	if authorization := r.Header.Get("Authorization"); strings.HasPrefix(authorization, "Bearer ") {
+		return strings.TrimPrefix(authorization, "Bearer ")
+	}
+
+	if jP.Cookie != "" {
+		if cookie, err := r.Cookie(jP.Cookie); err == nil {
+			return cookie.Value
+		}
+	}
+
+	return ""
+}
+
+// Check lets requests with a valid token through, with their claims in the gin context and
+// the configured claim headers set, reporting whether it answered the request itself instead.
+func (jP *jwtPolicy) Check(c *gin.Context, settings routeSettings) bool {
+	for _, header := range jP.ClaimHeaders {
+		c.Request.Header.Del(header)
+	}
+
+	token := jP.token(c.Request)
+
+	if token == "" {
+		return jP.reject(c, settings, http.StatusUnauthorized, "invalid_request", errors.New("missing token"))
+	}
+
+	claims, err := jP.verify(token, time.Now())
+
+	if err != nil {
+		return jP.reject(c, settings, http.StatusUnauthorized, "invalid_token", err)
+	}
+
+	if err := jP.checkRequiredClaims(claims); err != nil {
+		return jP.reject(c, settings, http.StatusForbidden, "insufficient_scope", err)
+	}
+
+	for claim, header := range jP.ClaimHeaders {
+		if value, exists := claims[claim]; exists {
+			c.Request.Header.Set(header, jwtClaimString(value))
+		}
+	}
+
+	c.Set(jwtClaimsKey, claims)
+
+	return false
+}
+
+func (jP *jwtPolicy) reject(c *gin.Context, settings routeSettings, status int, code string, err error) bool {
+	jwtMetrics.Add(code, 1)
+
+	log.Printf("jwt: event=rejected domain=%s project=%s route=%s client_ip=%s code=%s err=%q\n", settings.domain, settings.project, settings.route, requestClientIP(c), code, err)
+
+	if isGRPCRequest(c.Request) {
+		grpcCode := grpcUnauthenticated
+
+		if status == http.StatusForbidden {
+			grpcCode = grpcPermissionDenied
+		}
+
+		writeGRPCError(c.Writer, c.Request, grpcCode, err.Error())
+
+		c.Abort()
+
+		return true
+	}
+
+	c.Header("WWW-Authenticate", fmt.Sprintf("Bearer error=%q, error_description=%q", code, err.Error()))
+
+	c.AbortWithStatusJSON(status, gin.H{
+		"msg":  err.Error(),
+		"err":  true,
+		"data": gin.H{},
+	})
+
+	return true
+}
+
+// verify checks the token's signature and registered claims, returning its claims.
+func (jP *jwtPolicy) verify(token string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed header: %s", err)
+	}
+
+	if !jP.allowsAlgorithm(header.Algorithm) {
+		return nil, fmt.Errorf("algorithm %q not allowed", header.Algorithm)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+
+	if err != nil {
+		return nil, errors.New("malformed signature")
+	}
+
+	keys, err := jP.keys.Keys(header.KeyID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	verified := false
+
+	for _, key := range keys {
+		if (header.KeyID == "" || key.id == header.KeyID) && verifyJWTSignature(header.Algorithm, key.key, parts[0]+"."+parts[1], signature) {
+			verified = true
+
+			break
+		}
+	}
+
+	if !verified {
+		return nil, errors.New("bad signature or unknown key")
+	}
+
+	var claims map[string]interface{}
+
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed claims: %s", err)
+	}
+
+	leeway := time.Duration(jP.Leeway)
+
+	if leeway <= 0 {
+		leeway = 30 * time.Second
+	}
+
+	expiry, ok := jwtNumericDate(claims["exp"])
+
+	if !ok {
+		return nil, errors.New("missing exp")
+	}
+
+	if now.After(expiry.Add(leeway)) {
+		return nil, errors.New("token expired")
+	}
+
+	if notBefore, ok := jwtNumericDate(claims["nbf"]); ok && now.Add(leeway).Before(notBefore) {
+		return nil, errors.New("token not valid yet")
+	}
+
+	if jP.Issuer != "" && claims["iss"] != jP.Issuer {
+		return nil, fmt.Errorf("unexpected issuer %v", claims["iss"])
+	}
+
+	if len(jP.Audiences) != 0 && !jwtClaimContainsAny("aud", claims["aud"], jP.Audiences) {
+		return nil, fmt.Errorf("unexpected audience %v", claims["aud"])
+	}
+
+	return claims, nil
+}
+
+func (jP *jwtPolicy) allowsAlgorithm(algorithm string) bool {
+	if _, known := jwtAlgorithms[algorithm]; !known {
+		return false
+	}
+
+	if len(jP.Algorithms) == 0 {
+		return true
+	}
+
+	for _, allowed := range jP.Algorithms {
+		if allowed == algorithm {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (jP *jwtPolicy) checkRequiredClaims(claims map[string]interface{}) error {
+	names := make([]string, 0, len(jP.RequiredClaims))
+
+	for name := range jP.RequiredClaims {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		value, exists := claims[name]
+
+		if !exists {
+			return fmt.Errorf("missing claim %s", name)
+		}
+
+		var wanted []string
+
+		switch required := jP.RequiredClaims[name].(type) {
+		case nil:
+			continue
+		case []interface{}:
+			for _, option := range required {
+				wanted = append(wanted, jwtClaimString(option))
+			}
+		default:
+			wanted = []string{jwtClaimString(required)}
+		}
+
+		if !jwtClaimContainsAny(name, value, wanted) {
+			return fmt.Errorf("claim %s doesn't have a required value", name)
+		}
+	}
+
+	return nil
+}
+
+// jwtClaimContainsAny reports whether the claim is, or for lists contains, one of wanted. Only
+// scope and scp are space separated lists when they are strings, any other string has to match
+// whole so that e.g. an aud of "other-api my-api" isn't taken for my-api.
+func jwtClaimContainsAny(name string, claim interface{}, wanted []string) bool {
+	var values []string
+
+	switch typed := claim.(type) {
+	case string:
+		values = []string{typed}
+
+		if name == "scope" || name == "scp" {
+			values = strings.Fields(typed)
+		}
+	case []interface{}:
+		for _, value := range typed {
+			values = append(values, jwtClaimString(value))
+		}
+	case nil:
+		return false
+	default:
+		values = []string{jwtClaimString(typed)}
+	}
+
+	for _, value := range values {
+		for _, want := range wanted {
+			if value == want {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// jwtClaimString renders a claim for a header, lists joined by commas and objects as JSON.
+func jwtClaimString(claim interface{}) string {
+	switch typed := claim.(type) {
+	case string:
+		return typed
+	case json.Number:
+		return typed.String()
+	case []interface{}:
+		values := make([]string, len(typed))
+
+		for i, value := range typed {
+			values[i] = jwtClaimString(value)
+		}
+
+		return strings.Join(values, ",")
+	}
+
+	encoded, _ := json.Marshal(claim)
+
+	return string(encoded)
+}
+
+func jwtNumericDate(claim interface{}) (time.Time, bool) {
+	number, ok := claim.(json.Number)
+
+	if !ok {
+		return time.Time{}, false
+	}
+
+	seconds, err := number.Float64()
+
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return time.Unix(0, int64(seconds*float64(time.Second))), true
+}
+
+func decodeJWTPart(part string, into interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+
+	decoder.UseNumber()
+
+	return decoder.Decode(into)
+}
+
+func verifyJWTSignature(algorithm string, key crypto.PublicKey, signed string, signature []byte) bool {
+	hash := jwtAlgorithms[algorithm]
+
+	if algorithm == "EdDSA" {
+		edKey, ok := key.(ed25519.PublicKey)
+
+		return ok && ed25519.Verify(edKey, []byte(signed), signature)
+	}
+
+	digester := hash.New()
+
+	digester.Write([]byte(signed))
+
+	digest := digester.Sum(nil)
+
+	switch algorithm[:2] {
+	case "RS":
+		rsaKey, ok := key.(*rsa.PublicKey)
+
+		return ok && rsa.VerifyPKCS1v15(rsaKey, hash, digest, signature) == nil
+	case "PS":
+		rsaKey, ok := key.(*rsa.PublicKey)
+
+		return ok && rsa.VerifyPSS(rsaKey, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+	case "ES":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+
+		if !ok {
+			return false
+		}
+
+		// The key's curve has to be the one the algorithm names
+		size := (ecKey.Curve.Params().BitSize + 7) / 8
+
+		if len(signature) != 2*size || map[string]int{"ES256": 256, "ES384": 384, "ES512": 521}[algorithm] != ecKey.Curve.Params().BitSize {
+			return false
+		}
+
+		r, s := new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:])
+
+		return ecdsa.Verify(ecKey, digest, r, s)
+	}
+
+	return false
+}
+
+type jwk struct {
+	id  string
+	key crypto.PublicKey
+}
+
+// jwks holds the keys tokens are verified with, fetching them from url every refresh when it
+// is set, and early when a token names a key it doesn't know, at most every 30 seconds. Only
+// one request fetches at a time, the others keep verifying with the keys already fetched.
+type jwks struct {
+	url     string
+	refresh time.Duration
+
+	lock        *sync.RWMutex
+	keys        []jwk
+	fetchedAt   time.Time
+	attemptedAt time.Time
+	fetching    chan struct{}
+}
+
+func (j *jwks) Keys(keyID string) ([]jwk, error) {
+	j.lock.RLock()
+
+	keys, fetchedAt, attemptedAt, fetching := j.keys, j.fetchedAt, j.attemptedAt, j.fetching
+
+	j.lock.RUnlock()
+
+	if j.url == "" {
+		return keys, nil
+	}
+
+	// Without keys to verify with meanwhile, wait for the fetch under way
+	if fetching != nil && keys == nil {
+		<-fetching
+
+		j.lock.RLock()
+
+		keys = j.keys
+
+		j.lock.RUnlock()
+
+		return availableJWKs(keys)
+	}
+
+	stale := time.Since(fetchedAt) > j.refresh
+
+	if !stale && keyID != "" {
+		stale = true
+
+		for _, key := range keys {
+			if key.id == keyID {
+				stale = false
+			}
+		}
+	}
+
+	if fetching != nil || !stale || time.Since(attemptedAt) < 30*time.Second {
+		return availableJWKs(keys)
+	}
+
+	j.lock.Lock()
+
+	// Another request may have started fetching while this one waited for the lock
+	if j.attemptedAt != attemptedAt {
+		j.lock.Unlock()
+
+		return j.Keys(keyID)
+	}
+
+	fetching = make(chan struct{})
+
+	j.attemptedAt, j.fetching = time.Now(), fetching
+
+	j.lock.Unlock()
+
+	fetched, err := j.fetch()
+
+	j.lock.Lock()
+
+	defer j.lock.Unlock()
+
+	j.fetching = nil
+
+	close(fetching)
+
+	if err != nil {
+		jwtMetrics.Add("jwksErrors", 1)
+
+		log.Printf("jwt: event=jwks_fetch_failed url=%s err=%q\n", j.url, err)
+
+		// Keep verifying with the keys we have
+		return availableJWKs(j.keys)
+	}
+
+	j.keys, j.fetchedAt = fetched, time.Now()
+
+	return j.keys, nil
+}
+
+func availableJWKs(keys []jwk) ([]jwk, error) {
+	if keys == nil {
+		return nil, errors.New("no keys available")
+	}
+
+	return keys, nil
+}
+
+func (j *jwks) fetch() ([]jwk, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	resp, err := client.Get(j.url)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	data, err := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, 1024*1024))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return parseJWKS(data)
+}
+
+// parseJWKS reads the RSA, EC and Ed25519 signing keys from a JSON Web Key Set.
+func parseJWKS(data []byte) ([]jwk, error) {
+	var set struct {
+		Keys []struct {
+			KeyType string `json:"kty"`
+			KeyID   string `json:"kid"`
+			Use     string `json:"use"`
+			Curve   string `json:"crv"`
+			N       string `json:"n"`
+			E       string `json:"e"`
+			X       string `json:"x"`
+			Y       string `json:"y"`
+		} `json:"keys"`
+	}
+
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	var keys []jwk
+
+	for i, key := range set.Keys {
+		if key.Use == "enc" {
+			continue
+		}
+
+		var publicKey crypto.PublicKey
+
+		var err error
+
+		switch key.KeyType {
+		case "RSA":
+			publicKey, err = parseRSAJWK(key.N, key.E)
+		case "EC":
+			publicKey, err = parseECJWK(key.Curve, key.X, key.Y)
+		case "OKP":
+			if key.Curve != "Ed25519" {
+				err = fmt.Errorf("unsupported curve %q", key.Curve)
+
+				break
+			}
+
+			var x []byte
+
+			if x, err = base64.RawURLEncoding.DecodeString(key.X); err == nil && len(x) != ed25519.PublicKeySize {
+				err = errors.New("bad Ed25519 key size")
+			}
+
+			publicKey = ed25519.PublicKey(x)
+		default:
+			// Symmetric and unknown keys can't verify the asymmetric algorithms allowed
+			continue
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("keys[%d]: %s", i, err)
+		}
+
+		keys = append(keys, jwk{id: key.KeyID, key: publicKey})
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no signing keys")
+	}
+
+	return keys, nil
+}
+
+func parseRSAJWK(n, e string) (*rsa.PublicKey, error) {
+	modulus, err := base64.RawURLEncoding.DecodeString(n)
+
+	if err != nil {
+		return nil, err
+	}
+
+	exponent, err := base64.RawURLEncoding.DecodeString(e)
+
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey := &rsa.PublicKey{N: new(big.Int).SetBytes(modulus), E: int(new(big.Int).SetBytes(exponent).Int64())}
+
+	if publicKey.N.BitLen() < 2048 {
+		return nil, errors.New("RSA keys must be at least 2048 bits")
+	}
+
+	return publicKey, nil
+}
+
+func parseECJWK(curveName, x, y string) (*ecdsa.PublicKey, error) {
+	curve, known := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}[curveName]
+
+	if !known {
+		return nil, fmt.Errorf("unsupported curve %q", curveName)
+	}
+
+	xBytes, err := base64.RawURLEncoding.DecodeString(x)
+
+	if err != nil {
+		return nil, err
+	}
+
+	yBytes, err := base64.RawURLEncoding.DecodeString(y)
+
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(xBytes), Y: new(big.Int).SetBytes(yBytes)}
+
+	if !curve.IsOnCurve(publicKey.X, publicKey.Y) {
+		return nil, errors.New("point is not on the curve")
+	}
+
+	return publicKey, nil
+}
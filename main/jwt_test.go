@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestJWTClaimContainsAny(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		claims string
+		claim  string
+		wanted []string
+		want   bool
+	}{
+		{"exact aud", `{"aud": "my-api"}`, "aud", []string{"my-api"}, true},
+		{"space separated aud", `{"aud": "other-api my-api"}`, "aud", []string{"my-api"}, false},
+		{"aud array", `{"aud": ["other-api", "my-api"]}`, "aud", []string{"my-api"}, true},
+		{"aud array with a space separated value", `{"aud": ["other-api my-api"]}`, "aud", []string{"my-api"}, false},
+		{"role with a space", `{"role": "x admin"}`, "role", []string{"admin"}, false},
+		{"whole role with a space", `{"role": "x admin"}`, "role", []string{"x admin"}, true},
+		{"scope", `{"scope": "api:read api:write"}`, "scope", []string{"api:write"}, true},
+		{"scp", `{"scp": "api:read api:write"}`, "scp", []string{"api:read"}, true},
+		{"scope missing a value", `{"scope": "api:read"}`, "scope", []string{"api:write"}, false},
+		{"number", `{"level": 3}`, "level", []string{"3"}, true},
+		{"missing", `{}`, "aud", []string{"my-api"}, false},
+	} {
+		var claims map[string]interface{}
+
+		if err := json.Unmarshal([]byte(test.claims), &claims); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := jwtClaimContainsAny(test.claim, claims[test.claim], test.wanted); got != test.want {
+			t.Errorf("%s: got %t, want %t", test.name, got, test.want)
+		}
+	}
+}
+
+func TestJWTPolicyCheckRequiredClaims(t *testing.T) {
+	policy := &jwtPolicy{RequiredClaims: map[string]interface{}{
+		"role":  []interface{}{"admin", "owner"},
+		"scope": "api:read",
+	}}
+
+	for _, test := range []struct {
+		claims string
+		valid  bool
+	}{
+		{`{"role": "admin", "scope": "openid api:read"}`, true},
+		{`{"role": ["viewer", "owner"], "scope": "api:read"}`, true},
+		{`{"role": "x admin", "scope": "api:read"}`, false},
+		{`{"role": "admin", "scope": "api:readonly"}`, false},
+		{`{"scope": "api:read"}`, false},
+	} {
+		var claims map[string]interface{}
+
+		if err := json.Unmarshal([]byte(test.claims), &claims); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := policy.checkRequiredClaims(claims); (err == nil) != test.valid {
+			t.Errorf("%s: got %v, want valid %t", test.claims, err, test.valid)
+		}
+	}
+}
+
+// newGatedServer answers with body once release is called, announcing each request on entered.
+func newGatedServer(t *testing.T, body func() interface{}) (server *httptest.Server, entered chan struct{}, release func(), requests *int32) {
+	gate := make(chan struct{})
+
+	entered, release, requests = make(chan struct{}, 16), func() {}, new(int32)
+
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+
+		entered <- struct{}{}
+
+		<-gate
+
+		json.NewEncoder(w).Encode(body())
+	}))
+
+	t.Cleanup(server.Close)
+
+	once := &sync.Once{}
+
+	release = func() { once.Do(func() { close(gate) }) }
+
+	// Runs before server.Close, which would wait on the gated handlers
+	t.Cleanup(release)
+
+	return server, entered, release, requests
+}
+
+// returnsWithin reports whether call returns within a second.
+func returnsWithin(call func()) bool {
+	done := make(chan struct{})
+
+	go func() {
+		call()
+
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(time.Second):
+		return false
+	}
+}
+
+func TestJWKSFetchesOutsideTheLock(t *testing.T) {
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, entered, release, requests := newGatedServer(t, func() interface{} {
+		return map[string]interface{}{"keys": []map[string]string{
+			{"kty": "OKP", "crv": "Ed25519", "kid": "k1", "x": base64.RawURLEncoding.EncodeToString(publicKey)},
+		}}
+	})
+
+	j := &jwks{url: server.URL, refresh: time.Hour, lock: &sync.RWMutex{}}
+
+	// With no keys yet, concurrent requests share the first fetch
+	results := make(chan error, 4)
+
+	for i := 0; i < cap(results); i++ {
+		go func() {
+			_, err := j.Keys("k1")
+
+			results <- err
+		}()
+	}
+
+	<-entered
+
+	if !returnsWithin(func() { j.lock.Lock(); j.lock.Unlock() }) {
+		t.Error("lock held while fetching")
+	}
+
+	release()
+
+	for i := 0; i < cap(results); i++ {
+		if err := <-results; err != nil {
+			t.Errorf("first fetch: %s", err)
+		}
+	}
+
+	if got := atomic.LoadInt32(requests); got != 1 {
+		t.Errorf("first fetch made %d requests, want 1", got)
+	}
+
+	// While a refresh is under way, the cached keys keep being served
+	server, entered, release, requests = newGatedServer(t, func() interface{} {
+		return map[string]interface{}{"keys": []map[string]string{
+			{"kty": "OKP", "crv": "Ed25519", "kid": "k2", "x": base64.RawURLEncoding.EncodeToString(publicKey)},
+		}}
+	})
+
+	j.url = server.URL
+
+	j.lock.Lock()
+
+	j.fetchedAt, j.attemptedAt = time.Now().Add(-2*time.Hour), time.Time{}
+
+	j.lock.Unlock()
+
+	refreshed := make(chan []jwk, 1)
+
+	go func() {
+		keys, _ := j.Keys("")
+
+		refreshed <- keys
+	}()
+
+	<-entered
+
+	for _, keyID := range []string{"", "k1", "k2"} {
+		var keys []jwk
+
+		var err error
+
+		if !returnsWithin(func() { keys, err = j.Keys(keyID) }) {
+			t.Errorf("Keys(%q) waited for the refresh", keyID)
+		} else if err != nil || len(keys) != 1 || keys[0].id != "k1" {
+			t.Errorf("Keys(%q) during the refresh: got %v, %v, want the cached k1", keyID, keys, err)
+		}
+	}
+
+	release()
+
+	if keys := <-refreshed; len(keys) != 1 || keys[0].id != "k2" {
+		t.Errorf("refresh: got %v, want k2", keys)
+	}
+
+	if got := atomic.LoadInt32(requests); got != 1 {
+		t.Errorf("refresh made %d requests, want 1", got)
+	}
+}
@@ -2,248 +2,78 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"os"
-	"regexp"
+	"path/filepath"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/gobwas/ws"
-	"github.com/gobwas/ws/wsutil"
 	"github.com/joho/godotenv"
-	"github.com/the-rileyj/uyghurs"
 )
 
-type domainRoutesManager struct {
-	routesMap    map[string]*extendedRouteInfo
-	domainRegexp *regexp.Regexp
-}
-
-type routesManager struct {
-	defaultDomain   string
-	domainRoutesMap map[string]*domainRoutesManager
-	projectsMap     map[string]*uyghurs.ProjectMetadata
-	lock            *sync.Mutex
-}
-
-type extendedRouteInfo struct {
-	uyghurs.RouteInfo
-	ReverseProxyHandler gin.HandlerFunc
-}
-
-func newRoutesManager(defaultDomain, defaultHost string) *routesManager {
-	rM := &routesManager{
-		defaultDomain:   defaultDomain,
-		domainRoutesMap: make(map[string]*domainRoutesManager),
-		projectsMap:     make(map[string]*uyghurs.ProjectMetadata),
-		lock:            &sync.Mutex{},
-	}
-
-	defaultHostURL, err := url.Parse(defaultHost)
-
-	if err != nil {
-		panic(err)
-	}
-
-	defaultDomainReverseProxy := httputil.NewSingleHostReverseProxy(defaultHostURL)
-
-	rM.domainRoutesMap[defaultDomain] = &domainRoutesManager{
-		routesMap: map[string]*extendedRouteInfo{
-			"/": {
-				RouteInfo: uyghurs.RouteInfo{
-					Domain:      defaultDomain,
-					ForwardHost: defaultHost,
-					Route:       "/",
-				},
-				ReverseProxyHandler: func(c *gin.Context) { defaultDomainReverseProxy.ServeHTTP(c.Writer, c.Request) },
-			},
-		},
-		domainRegexp: nil,
-	}
-
-	return rM
-}
-
-func (rM *routesManager) GetDefaultRouteInfo() *extendedRouteInfo {
-	domainRoutesManager, exists := rM.domainRoutesMap[rM.defaultDomain]
-
-	if !exists {
-		log.Fatal("NO DEFAULT ROUTE FOR DEFAULT DOMAIN")
-	}
-
-	routeInfo, exists := domainRoutesManager.routesMap["/"]
-
-	if !exists {
-		log.Fatal("NO DEFAULT ROUTE for '/'")
-	}
-
-	return routeInfo
-}
-
-func (rM *routesManager) GetRouteInfo(domain, route string) (*extendedRouteInfo, bool) {
-	rM.lock.Lock()
-
-	defer rM.lock.Unlock()
-
-	if domain == rM.defaultDomain {
-		domainRoutesManager, exists := rM.domainRoutesMap[domain]
-
-		if !exists {
-			return nil, false
-		}
-
-		var foundRouteInfo *extendedRouteInfo
-		exists = false
-
-		for routePrefix, routeInfo := range domainRoutesManager.routesMap {
-			if strings.HasPrefix(route, routePrefix) {
-				if foundRouteInfo != nil {
-					if len(foundRouteInfo.Route) < len(routePrefix) {
-						foundRouteInfo = routeInfo
-					}
-				} else {
-					foundRouteInfo = routeInfo
-					exists = true
-				}
-			}
-		}
-
-		return foundRouteInfo, exists
-	}
-
-	for _, domainRoutesManager := range rM.domainRoutesMap {
-		if domainRoutesManager.domainRegexp != nil && domainRoutesManager.domainRegexp.MatchString(domain) {
-			var foundRouteInfo *extendedRouteInfo
-			exists := false
-
-			for routePrefix, routeInfo := range domainRoutesManager.routesMap {
-				if strings.HasPrefix(route, routePrefix) {
-					if foundRouteInfo != nil {
-						if len(foundRouteInfo.Route) < len(routePrefix) {
-							foundRouteInfo = routeInfo
-						}
-					} else {
-						foundRouteInfo = routeInfo
-						exists = true
-					}
-				}
-			}
-
-			if !exists {
-				// Fallback to default route for domain
-				foundRouteInfo, exists = domainRoutesManager.routesMap["/"]
-			}
-
-			return foundRouteInfo, exists
-		}
-	}
-
-	return nil, false
-}
-
-func (rM *routesManager) UpdateProjectRoutes(projectMetadata *uyghurs.ProjectMetadata) {
-	rM.lock.Lock()
-
-	defer rM.lock.Unlock()
-
-	currentProjectMetadata, exists := rM.projectsMap[projectMetadata.ProjectName]
-
-	seenRoutes := make(map[string]bool)
-
-	if exists {
-		for _, routeInfo := range currentProjectMetadata.ProjectRoutes {
-			domain := routeInfo.Domain
-
-			if domain == "" {
-				domain = rM.defaultDomain
-			}
-
-			if seenRoutes[domain+routeInfo.Route] {
-				continue
-			}
+func main() {
+	development := flag.Bool("d", false, "development flag")
 
-			seenRoutes[domain+routeInfo.Route] = true
+	defaultDomain := flag.String("dd", "therileyjohnson.com", "the most frequently used domain, roughly the default")
+	defaultHost := flag.String("dh", "http://rj-site", "the default host to forward requests to")
 
-			domainRoutesManager, domainRoutesManagerExists := rM.domainRoutesMap[domain]
+	envFile := flag.Bool("env", false, "use env file for config")
 
-			if domainRoutesManagerExists {
-				delete(domainRoutesManager.routesMap, routeInfo.Route)
+	certificatesDir := flag.String("certs", "./secrets", "directory of certificate and key pairs to serve by SNI")
+	defaultCertificate := flag.String("default-cert", "cloudflare", "name of the certificate pair served when no certificate matches the SNI")
+	certificatesReload := flag.Duration("certs-reload", 30*time.Second, "how often to check the certificate directory for changes")
 
-				if len(domainRoutesManager.routesMap) == 0 {
-					delete(rM.domainRoutesMap, domain)
-				}
-			}
-		}
-	}
+	acmeEnabled := flag.Bool("acme", false, "issue certificates for routed domains through ACME when none in the certificate directory match")
+	acmeDirectory := flag.String("acme-directory", "https://acme-v02.api.letsencrypt.org/directory", "ACME directory URL, e.g. https://localhost:14000/dir for a local Pebble server")
+	acmeEmail := flag.String("acme-email", "", "contact email for the ACME account")
+	acmeCA := flag.String("acme-ca", "", "PEM bundle of extra roots to trust for the ACME server, e.g. Pebble's minica root")
+	acmeChallenges := flag.String("acme-challenges", "tls-alpn-01", "comma separated ACME challenge types to try in order, http-01 needs -http listening on port 80")
+	acmeRenewBefore := flag.Duration("acme-renew-before", 30*24*time.Hour, "how long before expiry ACME certificates are renewed")
 
-	delete(rM.projectsMap, projectMetadata.ProjectName)
+	httpAddr := flag.String("http", "", "address for a plain HTTP listener that answers ACME HTTP-01 challenges and redirects to HTTPS, e.g. :80, empty disables it")
+	httpRedirectCode := flag.Int("http-redirect-code", http.StatusPermanentRedirect, "status used to redirect plain HTTP requests to HTTPS, one of 301, 302, 307 or 308")
+	httpExempt := flag.String("http-exempt", "", "comma separated domains, domain/route prefixes or /route prefixes proxied over plain HTTP instead of redirected")
 
-	for _, routeInfo := range projectMetadata.ProjectRoutes {
-		var domainRoutesMan *domainRoutesManager
-		exists := true
+	hstsMaxAge := flag.Duration("hsts-max-age", 0, "Strict-Transport-Security max-age sent on HTTPS responses, 0 disables the header")
+	hstsSubdomains := flag.Bool("hsts-subdomains", false, "add includeSubDomains to the Strict-Transport-Security header")
+	hstsPreload := flag.Bool("hsts-preload", false, "add preload to the Strict-Transport-Security header")
 
-		if routeInfo.Domain == "" {
-			domainRoutesMan, exists = rM.domainRoutesMap[rM.defaultDomain]
+	clientAuth := flag.String("client-auth", "", "comma separated domain=ca-bundle.pem pairs requiring TLS clients for that SNI domain to present a certificate from the bundle, e.g. *=origin-pull-ca.pem for Cloudflare authenticated origin pulls; *.example.com wildcards and * are allowed")
 
-			if !exists {
-				log.Println("Failed to update routing information, NO DEFAULT ROUTE INFO EXISTS")
+	trustedProxiesFile := flag.String("trusted-proxies", "", "file of CIDR ranges, one per line, whose CF-Connecting-IP and X-Forwarded-For headers are believed, e.g. Cloudflare's published ranges; empty takes the client IP to be the address that connected")
+	trustedProxiesOnly := flag.Bool("trusted-proxies-only", false, "reject requests that don't come from a -trusted-proxies range")
+	trustedProxiesReload := flag.Duration("trusted-proxies-reload", time.Minute, "how often to check the -trusted-proxies file for changes")
 
-				return
-			}
-		} else {
-			domainRoutesMan, exists = rM.domainRoutesMap[routeInfo.Domain]
-		}
+	proxyProtocolFrom := flag.String("proxy-protocol-from", "", "comma separated addresses and CIDR ranges, such as a TCP load balancer's, whose connections to the HTTPS and HTTP listeners must start with a PROXY protocol v1 or v2 header")
 
-		if !exists {
-			domainRegexp, err := regexp.Compile(routeInfo.Domain)
+	routeConfigFile := flag.String("route-config", "", "JSON file of router side route settings, such as upstream TLS, reloaded when it changes")
+	routeConfigReload := flag.Duration("route-config-reload", 10*time.Second, "how often to check the -route-config file and the files it references for changes")
 
-			if err != nil {
-				domainRegexp = nil
-			}
+	websocketDrainTimeout := flag.Duration("ws-drain-timeout", 5*time.Second, "how long websocket connections being closed get to finish the closing handshake")
+	rateLimitKeys := flag.Int("rate-limit-keys", 100000, "most rate limit buckets, one per client or key, to keep in memory across all routes")
 
-			domainRoutesMan = &domainRoutesManager{
-				routesMap:    make(map[string]*extendedRouteInfo),
-				domainRegexp: domainRegexp,
-			}
-		}
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "how long to wait for requests and websockets to finish on SIGINT or SIGTERM")
 
-		newRouteHostURL, err := url.Parse(routeInfo.ForwardHost)
+	historySize := flag.Int("history", 50, "number of applied routing tables to keep for diffs and rollbacks")
 
-		if err != nil {
-			log.Printf("Failed to add new route %s: %s\n", fmt.Sprintf(routeInfo.Domain+routeInfo.Route), err)
+	backoffInitial := flag.Duration("backoff-initial", time.Second, "delay before the first uyghurs reconnection attempt")
+	backoffMax := flag.Duration("backoff-max", time.Minute, "upper bound on the delay between uyghurs reconnection attempts")
+	backoffMultiplier := flag.Float64("backoff-multiplier", 2, "factor the uyghurs reconnection delay grows by after each failed attempt")
+	backoffJitter := flag.Float64("backoff-jitter", 0.2, "fraction (0-1) of the uyghurs reconnection delay to randomize")
 
-			continue
-		}
+	failbackInterval := flag.Duration("failback-interval", 30*time.Second, "how often to probe higher priority uyghurs hosts while connected to a fallback, 0 disables failback")
 
-		newRouteReverseProxy := httputil.NewSingleHostReverseProxy(newRouteHostURL)
-
-		domainRoutesMan.routesMap[routeInfo.Route] = &extendedRouteInfo{
-			RouteInfo:           *routeInfo,
-			ReverseProxyHandler: func(c *gin.Context) { newRouteReverseProxy.ServeHTTP(c.Writer, c.Request) },
-		}
-
-		rM.domainRoutesMap[routeInfo.Domain] = domainRoutesMan
-	}
-
-	rM.projectsMap[projectMetadata.ProjectName] = projectMetadata
-}
-
-func main() {
-	development := flag.Bool("d", false, "development flag")
-
-	defaultDomain := flag.String("dd", "therileyjohnson.com", "the most frequently used domain, roughly the default")
-	defaultHost := flag.String("dh", "http://rj-site", "the default host to forward requests to")
-
-	envFile := flag.Bool("env", false, "use env file for config")
+	heartbeatInterval := flag.Duration("heartbeat-interval", 15*time.Second, "how often to ping uyghurs, 0 disables heartbeats")
+	heartbeatTimeout := flag.Duration("heartbeat-timeout", 45*time.Second, "how long uyghurs may stay silent or leave pings unanswered before reconnecting, 0 never reconnects for either")
+	heartbeatApplication := flag.Bool("heartbeat-app", true, "also send uyghurs ping requests and reconnect when they go unanswered")
 
 	flag.Parse()
 
@@ -277,77 +107,112 @@ func main() {
 	uyghursConnectionSecret := envVars["UYGHURS_CONNECTION_SECRET"]
 	uyghursConnectionScheme := envVars["UYGHURS_CONNECTION_SCHEME"]
 
-	routesManager := newRoutesManager(*defaultDomain, *defaultHost)
+	// Optional, endpoints that change routing are disabled without it
+	routerAdminSecret := strings.Trim(os.Getenv("ROUTER_ADMIN_SECRET"), "\r\n")
 
-	go func() {
-		uyghursURL := url.URL{Scheme: uyghursConnectionScheme, Host: uyghursConnectionHost, Path: fmt.Sprintf("/router/%s", uyghursConnectionSecret)}
+	routeConfig, err := newRouteConfigStore(*routeConfigFile)
 
-		connectIndefinitely := func() net.Conn {
-			var (
-				conn    net.Conn
-				connErr error
-			)
+	if err != nil {
+		log.Fatalf("Error loading route config: %s", err)
+	}
 
-			dialCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	go routeConfig.Watch(*routeConfigReload, nil)
 
-			for conn, _, _, connErr = ws.DefaultDialer.Dial(dialCtx, uyghursURL.String()); connErr != nil; {
-				time.Sleep(time.Second)
+	websockets := newWebsocketTracker(*websocketDrainTimeout)
 
-				cancel()
+	rateLimits := newRateLimiter(*rateLimitKeys)
 
-				dialCtx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	go rateLimits.Sweep(time.Minute)
 
-				conn, _, _, connErr = ws.DefaultDialer.Dial(dialCtx, uyghursURL.String())
-			}
+	routesManager := newRoutesManager(*defaultDomain, *defaultHost, *historySize, routeConfig, websockets, rateLimits, newConcurrencyLimiter())
 
-			cancel()
+	// UYGHURS_CONNECTION_HOST holds one or more comma separated hosts, highest priority first
+	var uyghursURLs []url.URL
 
-			return conn
+	for _, uyghursHost := range strings.Split(uyghursConnectionHost, ",") {
+		if uyghursHost = strings.TrimSpace(uyghursHost); uyghursHost != "" {
+			uyghursURLs = append(uyghursURLs, url.URL{Scheme: uyghursConnectionScheme, Host: uyghursHost, Path: fmt.Sprintf("/router/%s", uyghursConnectionSecret)})
 		}
+	}
 
-		uyghursConnection := connectIndefinitely()
-
-		log.Println("Initial connection to uyghurs")
-
-		var projectsMetadataMessage []*uyghurs.ProjectMetadata
-
-		for {
-			messageBytes, _, err := wsutil.ReadServerData(uyghursConnection)
+	if len(uyghursURLs) == 0 {
+		log.Fatal(`environmental variable "UYGHURS_CONNECTION_HOST" has no hosts`)
+	}
 
-			if err != nil {
-				if uyghursConnection != nil {
-					uyghursConnection.Close()
-				}
+	uyghursBackoff := backoffPolicy{
+		Initial:    *backoffInitial,
+		Max:        *backoffMax,
+		Multiplier: *backoffMultiplier,
+		Jitter:     *backoffJitter,
+	}
 
-				uyghursConnection = connectIndefinitely()
+	uyghursHeartbeat := heartbeatPolicy{
+		Interval:    *heartbeatInterval,
+		Timeout:     *heartbeatTimeout,
+		Application: *heartbeatApplication,
+	}
 
-				log.Println("Reconnected to uyghurs server!")
+	controlPlaneClient := newUyghursClient(uyghursURLs, *failbackInterval, uyghursBackoff, uyghursHeartbeat, func(source string, update *routingUpdate) []routingUpdateResult {
+		log.Printf("Applying routing update from %s (revision %d)", source, update.Revision)
 
-				continue
-			}
-
-			err = json.Unmarshal(messageBytes, &projectsMetadataMessage)
+		results := make([]routingUpdateResult, 0, len(update.Projects))
 
-			if err != nil {
-				log.Println("read error:", err)
+		for _, projectMetadata := range update.Projects {
+			if projectMetadata == nil {
+				results = append(results, newRoutingUpdateResult("", false, validateProjectMetadata(nil, nil, "")))
 
 				continue
 			}
 
-			for _, projectMetadata := range projectsMetadataMessage {
-				log.Printf("Updating %s...", projectMetadata.ProjectName)
+			log.Printf("Updating %s...", projectMetadata.ProjectName)
 
-				for _, projectRoute := range projectMetadata.ProjectRoutes {
+			for _, projectRoute := range projectMetadata.ProjectRoutes {
+				if projectRoute != nil {
 					log.Printf("\"%s%s\" -> \"%s%s\" \n", projectRoute.Domain, projectRoute.Route, projectRoute.ForwardHost, projectRoute.Route)
 				}
+			}
+
+			applied, err := routesManager.UpdateProjectRoutes(projectMetadata, routingChange{Source: source, UyghursRevision: update.Revision, Commit: update.GithubData})
 
-				routesManager.UpdateProjectRoutes(projectMetadata)
+			if err != nil {
+				log.Printf("Rejected routing update for %s: %s\n", projectMetadata.ProjectName, err)
+			} else if !applied {
+				log.Printf("Deferred routing update for %s, routing is pinned\n", projectMetadata.ProjectName)
 			}
+
+			results = append(results, newRoutingUpdateResult(projectMetadata.ProjectName, applied, err))
 		}
-	}()
+
+		return results
+	})
+
+	publishUyghursStatus(controlPlaneClient)
+
+	go controlPlaneClient.Run(context.Background())
 
 	r := gin.Default()
 
+	if *trustedProxiesFile != "" {
+		proxies, err := newTrustedProxies(*trustedProxiesFile)
+
+		if err != nil {
+			log.Fatalf("Error loading trusted proxies: %s", err)
+		}
+
+		go proxies.Watch(*trustedProxiesReload, nil)
+
+		// The middleware rewrites RemoteAddr to the client IP, so gin shouldn't second guess it
+		r.ForwardedByClientIP = false
+
+		r.Use(proxies.Middleware(*trustedProxiesOnly))
+	} else if *trustedProxiesOnly {
+		log.Fatal("-trusted-proxies-only needs a -trusted-proxies file")
+	}
+
+	if !*development && *hstsMaxAge > 0 {
+		r.Use(hstsMiddleware(*hstsMaxAge, *hstsSubdomains, *hstsPreload))
+	}
+
 	r.GET("/routing", func(c *gin.Context) {
 		routesManager.lock.Lock()
 		defer routesManager.lock.Unlock()
@@ -383,6 +248,35 @@ func main() {
 		c.Writer.Write(simplifiedRoutingMapJSONBytes)
 	})
 
+	// Everything under /routing other than the routes themselves is for the admin only
+	admin := adminAuth(routerAdminSecret)
+
+	r.GET("/routing/status", admin, func(c *gin.Context) {
+		revision, pinnedRevision := routesManager.Revisions()
+
+		c.JSON(http.StatusOK, gin.H{
+			"msg": "",
+			"err": false,
+			"data": gin.H{
+				"uyghurs":     controlPlaneClient.Status(),
+				"routing":     gin.H{"revision": revision, "pinnedRevision": pinnedRevision},
+				"routeConfig": routeConfig.Status(),
+			},
+		})
+	})
+
+	registerRoutingHistoryRoutes(r, routesManager, routerAdminSecret)
+
+	r.GET("/routing/metrics", admin, metricsHandler())
+
+	r.GET("/routing/websockets", admin, func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"msg":  "",
+			"err":  false,
+			"data": gin.H{"connections": websockets.Connections()},
+		})
+	})
+
 	r.NoRoute(func(c *gin.Context) {
 		path := c.Request.URL.Path
 
@@ -398,8 +292,178 @@ func main() {
 	})
 
 	if *development {
-		r.Run(":9900")
-	} else {
-		r.RunTLS(":443", "./secrets/cloudflare.crt", "./secrets/cloudflare.secret")
+		developmentServer := &http.Server{
+			Addr:      ":9900",
+			Handler:   r,
+			Protocols: cleartextProtocols(),
+		}
+
+		stopped := shutdownOnSignal(websockets, *shutdownTimeout, developmentServer)
+
+		if err := developmentServer.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+
+		<-stopped
+
+		return
+	}
+
+	if *acmeEnabled {
+		if err := os.MkdirAll(*certificatesDir, 0700); err != nil {
+			log.Fatalf("Error creating certificate directory: %s", err)
+		}
+	}
+
+	certStore, err := newCertificateStore(*certificatesDir, *defaultCertificate)
+
+	if err != nil {
+		log.Fatalf("Error loading certificates: %s", err)
+	}
+
+	if len(certStore.Certificates()) == 0 && !*acmeEnabled {
+		log.Fatalf("No certificate and key pairs found in %s", *certificatesDir)
+	}
+
+	publishCertificateExpiry(certStore)
+
+	go certStore.Watch(*certificatesReload, nil)
+
+	tlsConfig := &tls.Config{
+		GetCertificate: certStore.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+
+	var acmeIssuer *acmeManager
+
+	if *acmeEnabled {
+		acmeHTTPClient, err := newACMEHTTPClient(*acmeCA)
+
+		if err != nil {
+			log.Fatalf("Error loading ACME CA bundle: %s", err)
+		}
+
+		acmeAccountKey, err := loadOrCreateECKey(filepath.Join(*certificatesDir, "acme_account.key"))
+
+		if err != nil {
+			log.Fatalf("Error loading ACME account key: %s", err)
+		}
+
+		var acmeContact []string
+
+		if *acmeEmail != "" {
+			acmeContact = []string{"mailto:" + *acmeEmail}
+		}
+
+		acmeIssuer = newACMEManager(
+			newACMEClient(*acmeDirectory, acmeContact, acmeAccountKey, acmeHTTPClient),
+			certStore,
+			routesManager.IsRoutedHost,
+			strings.Split(*acmeChallenges, ","),
+			*acmeRenewBefore,
+		)
+
+		go acmeIssuer.RenewLoop(12*time.Hour, nil)
+
+		tlsConfig.GetCertificate = acmeIssuer.GetCertificate
+		tlsConfig.NextProtos = append(tlsConfig.NextProtos, acmeTLSALPNProtocol)
+	}
+
+	clientAuthPolicies, err := parseClientAuthPolicies(*clientAuth)
+
+	if err != nil {
+		log.Fatalf("Error loading client certificate authorities: %s", err)
 	}
+
+	if len(clientAuthPolicies) != 0 {
+		tlsConfig.GetConfigForClient = newClientAuthenticator(tlsConfig.Clone(), clientAuthPolicies, acmeIssuer != nil).GetConfigForClient
+	}
+
+	proxyProtocolSources, err := parseProxyProtocolSources(*proxyProtocolFrom)
+
+	if err != nil {
+		log.Fatalf("Error parsing -proxy-protocol-from: %s", err)
+	}
+
+	r.GET("/routing/certificates", admin, func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"msg":  "",
+			"err":  false,
+			"data": gin.H{"certificates": certStore.Certificates()},
+		})
+	})
+
+	server := &http.Server{
+		Addr:      ":443",
+		Handler:   r,
+		TLSConfig: tlsConfig,
+	}
+
+	servers := []*http.Server{server}
+
+	if *httpAddr != "" {
+		httpRedirector, err := newHTTPRedirector(*httpRedirectCode, parseHTTPExemptions(*httpExempt), r)
+
+		if err != nil {
+			log.Fatalf("Error configuring the HTTP listener: %s", err)
+		}
+
+		var httpHandler http.Handler = httpRedirector
+
+		if acmeIssuer != nil {
+			httpHandler = acmeIssuer.HTTPChallengeHandler(httpHandler)
+		}
+
+		httpServer := &http.Server{
+			Addr:      *httpAddr,
+			Handler:   httpHandler,
+			Protocols: cleartextProtocols(),
+		}
+
+		servers = append(servers, httpServer)
+
+		httpListener, err := net.Listen("tcp", httpServer.Addr)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if len(proxyProtocolSources) != 0 {
+			httpListener = newProxyProtocolListener(httpListener, proxyProtocolSources, 10*time.Second)
+		}
+
+		go func() {
+			if err := httpServer.Serve(httpListener); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	stopped := shutdownOnSignal(websockets, *shutdownTimeout, servers...)
+
+	var listener net.Listener
+
+	listener, err = net.Listen("tcp", server.Addr)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Comes first so the passthrough splicing below sees clients' addresses too
+	if len(proxyProtocolSources) != 0 {
+		listener = newProxyProtocolListener(listener, proxyProtocolSources, 10*time.Second)
+	}
+
+	// Passthrough routes live in the route config, so without one there is nothing to splice
+	if *routeConfigFile != "" {
+		listener = newSNIListener(listener, func(serverName string) (*passthroughRoute, bool) {
+			return routeConfig.Config().PassthroughRoute(serverName)
+		}, 10*time.Second)
+	}
+
+	if err := server.ServeTLS(listener, "", ""); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+
+	<-stopped
 }
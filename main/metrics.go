@@ -0,0 +1,100 @@
+package main
+
+import (
+	"expvar"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Counters are published through expvar and served as JSON from /routing/metrics.
+var (
+	uyghursMetrics = expvar.NewMap("uyghurs")
+	acmeMetrics    = expvar.NewMap("acme")
+
+	websocketMetrics       = expvar.NewMap("websocket")
+	websocketOpenByProject = new(expvar.Map).Init()
+	websocketOpenByRoute   = new(expvar.Map).Init()
+
+	passthroughMetrics = expvar.NewMap("passthrough")
+
+	accessMetrics         = expvar.NewMap("access")
+	accessDeniedByProject = new(expvar.Map).Init()
+
+	rateLimitMetrics          = expvar.NewMap("rateLimit")
+	rateLimitLimitedByProject = new(expvar.Map).Init()
+
+	concurrencyMetrics       = expvar.NewMap("concurrency")
+	concurrencyShedByProject = new(expvar.Map).Init()
+
+	authMetrics = expvar.NewMap("auth")
+	jwtMetrics  = expvar.NewMap("jwt")
+	oidcMetrics = expvar.NewMap("oidc")
+)
+
+func init() {
+	websocketMetrics.Set("openByProject", websocketOpenByProject)
+	websocketMetrics.Set("openByRoute", websocketOpenByRoute)
+
+	accessMetrics.Set("deniedByProject", accessDeniedByProject)
+
+	rateLimitMetrics.Set("limitedByProject", rateLimitLimitedByProject)
+
+	concurrencyMetrics.Set("shedByProject", concurrencyShedByProject)
+}
+
+// metricsProjectName labels the default route, which belongs to no project.
+func metricsProjectName(projectName string) string {
+	if projectName == "" {
+		return "-"
+	}
+
+	return projectName
+}
+
+// publishUyghursStatus exposes the client's live connection state next to its counters.
+func publishUyghursStatus(uC *uyghursClient) {
+	uyghursMetrics.Set("status", expvar.Func(func() interface{} {
+		status := uC.Status()
+
+		connected := 0
+
+		if status.State == stateConnected.String() {
+			connected = 1
+		}
+
+		return map[string]interface{}{
+			"connected":         connected,
+			"lastMessageUnix":   unixOrZero(status.LastMessageAt),
+			"consecutiveErrors": status.FailedAttempts,
+		}
+	}))
+}
+
+// publishCertificateExpiry reports how long each stored certificate has left.
+func publishCertificateExpiry(cS *certificateStore) {
+	expvar.Publish("certificates", expvar.Func(func() interface{} {
+		expiries := make(map[string]interface{})
+
+		for _, certificate := range cS.Certificates() {
+			expiries[certificate.Name] = map[string]interface{}{
+				"notAfterUnix":  certificate.NotAfter.Unix(),
+				"daysRemaining": int(time.Until(certificate.NotAfter).Hours() / 24),
+			}
+		}
+
+		return expiries
+	}))
+}
+
+func metricsHandler() gin.HandlerFunc {
+	return gin.WrapH(expvar.Handler())
+}
+
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return t.Unix()
+}
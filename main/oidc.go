@@ -0,0 +1,684 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// oidcPolicy puts a route behind single sign-on with an OpenID Connect provider, using the
+// authorization code flow with PKCE. Logged in users get a session cookie, encrypted with a key
+// derived from SessionKeyFile and scoped to CookieDomain when set, so one login covers every
+// subdomain. AllowedUsers, matched against the email and subject, and AllowedGroups, matched
+// against GroupsClaim, narrow down who gets in, anyone who logs in does when both are empty.
+// Emails only count when email_verified is true, as users may be able to set any email at the
+// provider. The user's email, subject and groups reach the upstream in X-Auth-Email,
+// X-Auth-Subject and X-Auth-Groups. Each route's callback and logout live under the route, at
+// route+/_oidc/callback and route+/_oidc/logout, so they reach the route's handler whatever its
+// prefix.
+type oidcPolicy struct {
+	Issuer           string         `json:"issuer"`
+	ClientID         string         `json:"clientID"`
+	ClientSecretFile string         `json:"clientSecretFile"`
+	RedirectURL      string         `json:"redirectURL,omitempty"`
+	Scopes           []string       `json:"scopes,omitempty"`
+	SessionKeyFile   string         `json:"sessionKeyFile"`
+	SessionTTL       configDuration `json:"sessionTTL,omitempty"`
+	CookieName       string         `json:"cookieName,omitempty"`
+	CookieDomain     string         `json:"cookieDomain,omitempty"`
+	AllowedUsers     []string       `json:"allowedUsers,omitempty"`
+	AllowedGroups    []string       `json:"allowedGroups,omitempty"`
+	GroupsClaim      string         `json:"groupsClaim,omitempty"`
+
+	clientSecret string
+	redirectPath string
+	sessionAEAD  cipher.AEAD
+	provider     *oidcProvider
+}
+
+const (
+	oidcCallbackPath = "/_oidc/callback"
+	oidcLogoutPath   = "/_oidc/logout"
+)
+
+var oidcIdentityHeaders = []string{"X-Auth-Email", "X-Auth-Subject", "X-Auth-Groups"}
+
+// oidcSession is what the session cookie holds, Email only being set for verified emails. Its
+// JSON name changed when that started, so sessions from before carry no email.
+type oidcSession struct {
+	Subject string   `json:"sub"`
+	Email   string   `json:"verifiedEmail,omitempty"`
+	Groups  []string `json:"groups,omitempty"`
+	Expires int64    `json:"exp"`
+}
+
+// oidcLoginState is what the router remembers, in a cookie of its own, between sending a user
+// to the provider and the provider sending them back.
+type oidcLoginState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	ReturnTo string `json:"returnTo"`
+	Expires  int64  `json:"exp"`
+}
+
+// build reads the policy's secrets, returning the files it read. The provider is only asked
+// for its configuration once the route is first used.
+func (oP *oidcPolicy) build() ([]string, error) {
+	if oP.Issuer == "" || oP.ClientID == "" || oP.ClientSecretFile == "" || oP.SessionKeyFile == "" {
+		return nil, errors.New("issuer, clientID, clientSecretFile and sessionKeyFile are required")
+	}
+
+	files := []string{oP.ClientSecretFile, oP.SessionKeyFile}
+
+	clientSecret, err := ioutil.ReadFile(oP.ClientSecretFile)
+
+	if err != nil {
+		return files, err
+	}
+
+	oP.clientSecret = strings.TrimSpace(string(clientSecret))
+
+	sessionKey, err := ioutil.ReadFile(oP.SessionKeyFile)
+
+	if err != nil {
+		return files, err
+	}
+
+	if len(bytes.TrimSpace(sessionKey)) < 32 {
+		return files, fmt.Errorf("%s must hold at least 32 bytes of secret", oP.SessionKeyFile)
+	}
+
+	key := sha256.Sum256(bytes.TrimSpace(sessionKey))
+
+	block, err := aes.NewCipher(key[:])
+
+	if err != nil {
+		return files, err
+	}
+
+	if oP.sessionAEAD, err = cipher.NewGCM(block); err != nil {
+		return files, err
+	}
+
+	if oP.RedirectURL != "" {
+		parsed, err := url.Parse(oP.RedirectURL)
+
+		if err != nil || !parsed.IsAbs() || !strings.HasSuffix(parsed.Path, oidcCallbackPath) {
+			return files, fmt.Errorf("redirectURL must be an absolute URL ending in %s", oidcCallbackPath)
+		}
+
+		oP.redirectPath = parsed.Path
+	}
+
+	oP.provider = &oidcProvider{issuer: strings.TrimSuffix(oP.Issuer, "/"), clientID: oP.ClientID, lock: &sync.Mutex{}}
+
+	return files, nil
+}
+
+func (oP *oidcPolicy) cookieName() string {
+	if oP.CookieName != "" {
+		return oP.CookieName
+	}
+
+	return "_router_session"
+}
+
+func (oP *oidcPolicy) sessionTTL() time.Duration {
+	if oP.SessionTTL > 0 {
+		return time.Duration(oP.SessionTTL)
+	}
+
+	return 12 * time.Hour
+}
+
+// Check lets requests with an allowed session through with the identity headers set, and
+// handles logins, callbacks and logouts, reporting whether it answered the request itself.
+func (oP *oidcPolicy) Check(c *gin.Context, settings routeSettings) bool {
+	for _, header := range oidcIdentityHeaders {
+		c.Request.Header.Del(header)
+	}
+
+	switch c.Request.URL.Path {
+	case oP.callbackPath(settings):
+		oP.callback(c, settings)
+
+		return true
+	case oidcRoutePath(settings.route, oidcLogoutPath):
+		oP.logout(c, settings)
+
+		return true
+	}
+
+	var session oidcSession
+
+	if cookie, err := c.Request.Cookie(oP.cookieName()); err != nil || oP.open(oP.cookieName(), cookie.Value, &session) != nil || time.Now().Unix() > session.Expires {
+		oP.login(c, settings)
+
+		return true
+	}
+
+	if !oP.allows(session) {
+		oidcMetrics.Add("forbidden", 1)
+
+		log.Printf("oidc: event=forbidden domain=%s project=%s route=%s subject=%s email=%s\n", settings.domain, settings.project, settings.route, session.Subject, session.Email)
+
+		oidcAbort(c, http.StatusForbidden, grpcPermissionDenied, "your account is not allowed to access this route")
+
+		return true
+	}
+
+	c.Request.Header.Set("X-Auth-Email", session.Email)
+	c.Request.Header.Set("X-Auth-Subject", session.Subject)
+	c.Request.Header.Set("X-Auth-Groups", strings.Join(session.Groups, ","))
+
+	return false
+}
+
+func (oP *oidcPolicy) allows(session oidcSession) bool {
+	if len(oP.AllowedUsers) == 0 && len(oP.AllowedGroups) == 0 {
+		return true
+	}
+
+	for _, user := range oP.AllowedUsers {
+		if (session.Email != "" && strings.EqualFold(user, session.Email)) || (session.Subject != "" && user == session.Subject) {
+			return true
+		}
+	}
+
+	for _, allowedGroup := range oP.AllowedGroups {
+		for _, group := range session.Groups {
+			if group == allowedGroup {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// login sends browsers to the provider, anything that can't follow a login page is told it
+// needs to log in.
+func (oP *oidcPolicy) login(c *gin.Context, settings routeSettings) {
+	request := c.Request
+
+	if (request.Method != http.MethodGet && request.Method != http.MethodHead) || isGRPCRequest(request) || request.Header.Get("X-Requested-With") != "" {
+		oidcAbort(c, http.StatusUnauthorized, grpcUnauthenticated, "login required")
+
+		return
+	}
+
+	discovery, err := oP.provider.Discovery()
+
+	if err != nil {
+		oP.providerError(c, settings, err)
+
+		return
+	}
+
+	loginState := oidcLoginState{
+		State:    oidcRandom(),
+		Nonce:    oidcRandom(),
+		Verifier: oidcRandom() + oidcRandom(),
+		ReturnTo: requestOrigin(request) + request.URL.RequestURI(),
+		Expires:  time.Now().Add(10 * time.Minute).Unix(),
+	}
+
+	sealed, err := oP.seal(oP.cookieName()+"_state", loginState)
+
+	if err != nil {
+		oP.providerError(c, settings, err)
+
+		return
+	}
+
+	oP.setCookie(c, oP.cookieName()+"_state", sealed, 10*time.Minute)
+
+	challenge := sha256.Sum256([]byte(loginState.Verifier))
+
+	scopes := oP.Scopes
+
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "email", "profile"}
+	}
+
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {oP.ClientID},
+		"redirect_uri":          {oP.redirectURL(request, settings)},
+		"scope":                 {strings.Join(scopes, " ")},
+		"state":                 {loginState.State},
+		"nonce":                 {loginState.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	oidcMetrics.Add("loginsStarted", 1)
+
+	c.Redirect(http.StatusFound, oidcAppendQuery(discovery.AuthorizationEndpoint, query))
+
+	c.Abort()
+}
+
+// callback finishes a login, trading the code for an ID token and turning it into a session.
+func (oP *oidcPolicy) callback(c *gin.Context, settings routeSettings) {
+	request := c.Request
+
+	var loginState oidcLoginState
+
+	cookie, err := request.Cookie(oP.cookieName() + "_state")
+
+	if err != nil || oP.open(oP.cookieName()+"_state", cookie.Value, &loginState) != nil || time.Now().Unix() > loginState.Expires {
+		oP.loginFailed(c, settings, errors.New("login expired or started elsewhere"))
+
+		return
+	}
+
+	oP.setCookie(c, oP.cookieName()+"_state", "", -1)
+
+	if providerError := request.URL.Query().Get("error"); providerError != "" {
+		oP.loginFailed(c, settings, fmt.Errorf("provider said %s: %s", providerError, request.URL.Query().Get("error_description")))
+
+		return
+	}
+
+	if request.URL.Query().Get("state") != loginState.State {
+		oP.loginFailed(c, settings, errors.New("state mismatch"))
+
+		return
+	}
+
+	claims, err := oP.provider.Exchange(request.URL.Query().Get("code"), oP.redirectURL(request, settings), loginState.Verifier, oP.clientSecret)
+
+	if err != nil {
+		oP.loginFailed(c, settings, err)
+
+		return
+	}
+
+	if claims["nonce"] != loginState.Nonce {
+		oP.loginFailed(c, settings, errors.New("nonce mismatch"))
+
+		return
+	}
+
+	session := oidcSession{
+		Expires: time.Now().Add(oP.sessionTTL()).Unix(),
+	}
+
+	session.Subject, _ = claims["sub"].(string)
+
+	if claims["email_verified"] == true {
+		session.Email, _ = claims["email"].(string)
+	}
+
+	groupsClaim := oP.GroupsClaim
+
+	if groupsClaim == "" {
+		groupsClaim = "groups"
+	}
+
+	switch groups := claims[groupsClaim].(type) {
+	case []interface{}:
+		for _, group := range groups {
+			session.Groups = append(session.Groups, jwtClaimString(group))
+		}
+	case string:
+		session.Groups = strings.Fields(groups)
+	}
+
+	sealed, err := oP.seal(oP.cookieName(), session)
+
+	if err != nil {
+		oP.loginFailed(c, settings, err)
+
+		return
+	}
+
+	oP.setCookie(c, oP.cookieName(), sealed, oP.sessionTTL())
+
+	oidcMetrics.Add("loginsCompleted", 1)
+
+	log.Printf("oidc: event=login domain=%s project=%s route=%s subject=%s email=%s client_ip=%s\n", settings.domain, settings.project, settings.route, session.Subject, session.Email, requestClientIP(c))
+
+	c.Redirect(http.StatusFound, loginState.ReturnTo)
+
+	c.Abort()
+}
+
+// logout ends the session and sends the user back to the route, by way of the provider's own
+// logout when it has one.
+func (oP *oidcPolicy) logout(c *gin.Context, settings routeSettings) {
+	oP.setCookie(c, oP.cookieName(), "", -1)
+
+	destination := oidcRoutePath(settings.route, "/")
+
+	if discovery, err := oP.provider.Discovery(); err == nil && discovery.EndSessionEndpoint != "" {
+		destination = oidcAppendQuery(discovery.EndSessionEndpoint, url.Values{
+			"client_id":                {oP.ClientID},
+			"post_logout_redirect_uri": {requestOrigin(c.Request) + destination},
+		})
+	}
+
+	c.Redirect(http.StatusFound, destination)
+
+	c.Abort()
+}
+
+func (oP *oidcPolicy) loginFailed(c *gin.Context, settings routeSettings, err error) {
+	oidcMetrics.Add("loginsFailed", 1)
+
+	log.Printf("oidc: event=login_failed domain=%s project=%s route=%s client_ip=%s err=%q\n", settings.domain, settings.project, settings.route, requestClientIP(c), err)
+
+	oidcAbort(c, http.StatusUnauthorized, grpcUnauthenticated, "login failed, try again")
+}
+
+func (oP *oidcPolicy) providerError(c *gin.Context, settings routeSettings, err error) {
+	oidcMetrics.Add("providerErrors", 1)
+
+	log.Printf("oidc: event=provider_failed domain=%s project=%s route=%s issuer=%s err=%q\n", settings.domain, settings.project, settings.route, oP.Issuer, err)
+
+	oidcAbort(c, http.StatusServiceUnavailable, grpcUnavailable, "login provider unavailable")
+}
+
+func oidcAbort(c *gin.Context, status, grpcCode int, message string) {
+	if isGRPCRequest(c.Request) {
+		writeGRPCError(c.Writer, c.Request, grpcCode, message)
+
+		c.Abort()
+
+		return
+	}
+
+	c.AbortWithStatusJSON(status, gin.H{
+		"msg":  message,
+		"err":  true,
+		"data": gin.H{},
+	})
+}
+
+// callbackPath is where the provider sends users back to for the route, the path of RedirectURL
+// when it is set.
+func (oP *oidcPolicy) callbackPath(settings routeSettings) string {
+	if oP.redirectPath != "" {
+		return oP.redirectPath
+	}
+
+	return oidcRoutePath(settings.route, oidcCallbackPath)
+}
+
+func (oP *oidcPolicy) redirectURL(r *http.Request, settings routeSettings) string {
+	if oP.RedirectURL != "" {
+		return oP.RedirectURL
+	}
+
+	return requestOrigin(r) + oP.callbackPath(settings)
+}
+
+// oidcRoutePath puts path under the route's prefix, which it matches like any other request to
+// the route.
+func oidcRoutePath(route, path string) string {
+	return strings.TrimSuffix(route, "/") + path
+}
+
+// setCookie sets a cookie lasting maxAge, or deletes it when maxAge is negative.
+func (oP *oidcPolicy) setCookie(c *gin.Context, name, value string, maxAge time.Duration) {
+	maxAgeSeconds := int(maxAge.Seconds())
+
+	if maxAge < 0 {
+		maxAgeSeconds = -1
+	}
+
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Domain:   oP.CookieDomain,
+		MaxAge:   maxAgeSeconds,
+		Secure:   c.Request.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// seal encrypts value for a cookie, binding it to the cookie's name.
+func (oP *oidcPolicy) seal(name string, value interface{}) (string, error) {
+	plaintext, err := json.Marshal(value)
+
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, oP.sessionAEAD.NonceSize())
+
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(oP.sessionAEAD.Seal(nonce, nonce, plaintext, []byte(name))), nil
+}
+
+func (oP *oidcPolicy) open(name, sealed string, into interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(sealed)
+
+	if err != nil || len(data) < oP.sessionAEAD.NonceSize() {
+		return errors.New("malformed cookie")
+	}
+
+	nonceSize := oP.sessionAEAD.NonceSize()
+
+	plaintext, err := oP.sessionAEAD.Open(nil, data[:nonceSize], data[nonceSize:], []byte(name))
+
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(plaintext, into)
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+}
+
+// oidcProvider fetches the provider's configuration when first needed, retrying at most every
+// 30 seconds, and verifies its ID tokens. Requests arriving while one fetches wait for its
+// result instead of fetching too.
+type oidcProvider struct {
+	issuer   string
+	clientID string
+
+	lock        *sync.Mutex
+	discovery   *oidcDiscovery
+	idTokens    *jwtPolicy
+	attemptedAt time.Time
+	fetching    chan struct{}
+}
+
+func (oP *oidcProvider) Discovery() (*oidcDiscovery, error) {
+	oP.lock.Lock()
+
+	discovery, fetching := oP.discovery, oP.fetching
+
+	if discovery != nil || fetching != nil || time.Since(oP.attemptedAt) < 30*time.Second {
+		oP.lock.Unlock()
+
+		if discovery != nil {
+			return discovery, nil
+		}
+
+		if fetching != nil {
+			<-fetching
+
+			return oP.Discovery()
+		}
+
+		return nil, errors.New("provider configuration unavailable")
+	}
+
+	fetching = make(chan struct{})
+
+	oP.attemptedAt, oP.fetching = time.Now(), fetching
+
+	oP.lock.Unlock()
+
+	discovery, idTokens, err := oP.discover()
+
+	oP.lock.Lock()
+
+	defer oP.lock.Unlock()
+
+	oP.fetching = nil
+
+	close(fetching)
+
+	if err != nil {
+		return nil, err
+	}
+
+	oP.discovery, oP.idTokens = discovery, idTokens
+
+	return discovery, nil
+}
+
+// discover fetches the provider's configuration and sets up verifying its ID tokens.
+func (oP *oidcProvider) discover() (*oidcDiscovery, *jwtPolicy, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	resp, err := client.Get(oP.issuer + "/.well-known/openid-configuration")
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("discovery status %d", resp.StatusCode)
+	}
+
+	discovery := &oidcDiscovery{}
+
+	if err := json.NewDecoder(http.MaxBytesReader(nil, resp.Body, 1024*1024)).Decode(discovery); err != nil {
+		return nil, nil, err
+	}
+
+	if strings.TrimSuffix(discovery.Issuer, "/") != oP.issuer {
+		return nil, nil, fmt.Errorf("discovery is for issuer %q", discovery.Issuer)
+	}
+
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, nil, errors.New("discovery is missing endpoints")
+	}
+
+	idTokens := &jwtPolicy{JWKSURL: discovery.JWKSURI, Issuer: discovery.Issuer, Audiences: []string{oP.clientID}}
+
+	if _, err := idTokens.build(); err != nil {
+		return nil, nil, err
+	}
+
+	return discovery, idTokens, nil
+}
+
+// Exchange trades an authorization code for an ID token, returning its verified claims.
+func (oP *oidcProvider) Exchange(code, redirectURL, verifier, clientSecret string) (map[string]interface{}, error) {
+	discovery, err := oP.Discovery()
+
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURL},
+		"code_verifier": {verifier},
+	}
+
+	request, err := http.NewRequest(http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+
+	if err != nil {
+		return nil, err
+	}
+
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	request.SetBasicAuth(url.QueryEscape(oP.clientID), url.QueryEscape(clientSecret))
+
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	resp, err := client.Do(request)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	var tokens struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+
+	if err := json.NewDecoder(http.MaxBytesReader(nil, resp.Body, 1024*1024)).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("token endpoint status %d: %s", resp.StatusCode, err)
+	}
+
+	if resp.StatusCode != http.StatusOK || tokens.IDToken == "" {
+		return nil, fmt.Errorf("token endpoint status %d: %s %s", resp.StatusCode, tokens.Error, tokens.ErrorDescription)
+	}
+
+	oP.lock.Lock()
+
+	idTokens := oP.idTokens
+
+	oP.lock.Unlock()
+
+	return idTokens.verify(tokens.IDToken, time.Now())
+}
+
+// requestOrigin is the scheme and host the client used for r.
+func requestOrigin(r *http.Request) string {
+	if r.TLS != nil {
+		return "https://" + r.Host
+	}
+
+	return "http://" + r.Host
+}
+
+func oidcAppendQuery(endpoint string, query url.Values) string {
+	separator := "?"
+
+	if strings.Contains(endpoint, "?") {
+		separator = "&"
+	}
+
+	return endpoint + separator + query.Encode()
+}
+
+func oidcRandom() string {
+	random := make([]byte, 24)
+
+	rand.Read(random)
+
+	return base64.RawURLEncoding.EncodeToString(random)
+}
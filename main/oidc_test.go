@@ -0,0 +1,583 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// mockOIDCProvider is an OpenID Connect provider that logs every user straight in, checking the
+// code exchange the way a real one would.
+type mockOIDCProvider struct {
+	server *httptest.Server
+	key    ed25519.PrivateKey
+
+	lock           *sync.Mutex
+	authorizations map[string]url.Values
+	tokenRequests  int
+	claims         map[string]interface{}
+	nonce          string
+}
+
+func newMockOIDCProvider(t *testing.T) *mockOIDCProvider {
+	publicKey, key, err := ed25519.GenerateKey(rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mP := &mockOIDCProvider{
+		key:            key,
+		lock:           &sync.Mutex{},
+		authorizations: make(map[string]url.Values),
+		claims: map[string]interface{}{
+			"sub":            "u1",
+			"email":          "alice@example.com",
+			"email_verified": true,
+			"groups":         []string{"eng"},
+		},
+	}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 mP.server.URL,
+			"authorization_endpoint": mP.server.URL + "/auth",
+			"token_endpoint":         mP.server.URL + "/token",
+			"jwks_uri":               mP.server.URL + "/jwks",
+			"end_session_endpoint":   mP.server.URL + "/logout",
+		})
+	})
+
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{
+			{"kty": "OKP", "crv": "Ed25519", "kid": "mock", "x": base64.RawURLEncoding.EncodeToString(publicKey)},
+		}})
+	})
+
+	mux.HandleFunc("/auth", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		code := oidcRandom()
+
+		mP.lock.Lock()
+
+		mP.authorizations[code] = query
+
+		mP.lock.Unlock()
+
+		http.Redirect(w, r, oidcAppendQuery(query.Get("redirect_uri"), url.Values{"code": {code}, "state": {query.Get("state")}}), http.StatusFound)
+	})
+
+	mux.HandleFunc("/token", mP.token)
+
+	mux.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("logged out of the provider"))
+	})
+
+	mP.server = httptest.NewServer(mux)
+
+	t.Cleanup(mP.server.Close)
+
+	return mP
+}
+
+// token answers code exchanges that carry the PKCE verifier and redirect URI of the code's
+// authorization request and the client's credentials, spending the code.
+func (mP *mockOIDCProvider) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	mP.lock.Lock()
+
+	defer mP.lock.Unlock()
+
+	mP.tokenRequests++
+
+	authorization, exists := mP.authorizations[r.Form.Get("code")]
+
+	challenge := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+
+	clientID, clientSecret, _ := r.BasicAuth()
+
+	switch {
+	case !exists, r.Form.Get("grant_type") != "authorization_code", r.Form.Get("redirect_uri") != authorization.Get("redirect_uri"):
+		w.WriteHeader(http.StatusBadRequest)
+
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+
+		return
+	case authorization.Get("code_challenge_method") != "S256", base64.RawURLEncoding.EncodeToString(challenge[:]) != authorization.Get("code_challenge"):
+		w.WriteHeader(http.StatusBadRequest)
+
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant", "error_description": "PKCE verification failed"})
+
+		return
+	case clientID != authorization.Get("client_id") || clientSecret != "s3cret":
+		w.WriteHeader(http.StatusUnauthorized)
+
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+
+		return
+	}
+
+	delete(mP.authorizations, r.Form.Get("code"))
+
+	claims := map[string]interface{}{
+		"iss":   mP.server.URL,
+		"aud":   clientID,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Minute).Unix(),
+		"nonce": authorization.Get("nonce"),
+	}
+
+	if mP.nonce != "" {
+		claims["nonce"] = mP.nonce
+	}
+
+	for name, value := range mP.claims {
+		claims[name] = value
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": "EdDSA", "kid": "mock"})
+
+	payload, _ := json.Marshal(claims)
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	signature := ed25519.Sign(mP.key, []byte(signingInput))
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"id_token":     signingInput + "." + base64.RawURLEncoding.EncodeToString(signature),
+		"access_token": "unused",
+		"token_type":   "Bearer",
+	})
+}
+
+// authorizationFor is the authorization request that code was issued for, until it is spent.
+func (mP *mockOIDCProvider) authorizationFor(code string) url.Values {
+	mP.lock.Lock()
+
+	defer mP.lock.Unlock()
+
+	return mP.authorizations[code]
+}
+
+func newTestOIDCPolicy(t *testing.T, issuer string) *oidcPolicy {
+	directory := t.TempDir()
+
+	secretFile, keyFile := filepath.Join(directory, "client-secret"), filepath.Join(directory, "session-key")
+
+	if err := ioutil.WriteFile(secretFile, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(keyFile, []byte("0123456789abcdef0123456789abcdef-session\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return &oidcPolicy{Issuer: issuer, ClientID: "router", ClientSecretFile: secretFile, SessionKeyFile: keyFile}
+}
+
+// newOIDCTestRouter serves policy on the /admin route, other paths standing in for the rest of
+// the domain's routes.
+func newOIDCTestRouter(t *testing.T, policy *oidcPolicy) *httptest.Server {
+	if _, err := policy.build(); err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+
+	router.NoRoute(func(c *gin.Context) {
+		// Prefix matching, like routesManager.GetRouteInfo
+		if !strings.HasPrefix(c.Request.URL.Path, "/admin") {
+			c.String(http.StatusNotFound, "another route")
+
+			return
+		}
+
+		if policy.Check(c, routeSettings{domain: "example.com", project: "admin", route: "/admin"}) {
+			return
+		}
+
+		c.String(http.StatusOK, "email=%s subject=%s groups=%s", c.Request.Header.Get("X-Auth-Email"), c.Request.Header.Get("X-Auth-Subject"), c.Request.Header.Get("X-Auth-Groups"))
+	})
+
+	server := httptest.NewServer(router)
+
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func newOIDCTestClient(t *testing.T, followRedirects bool) *http.Client {
+	jar, err := cookiejar.New(nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{Jar: jar, Timeout: 5 * time.Second}
+
+	if !followRedirects {
+		client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	}
+
+	return client
+}
+
+func oidcTestGet(t *testing.T, client *http.Client, target string, header http.Header) (*http.Response, string) {
+	t.Helper()
+
+	request, err := http.NewRequest(http.MethodGet, target, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, values := range header {
+		request.Header[name] = values
+	}
+
+	resp, err := client.Do(request)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp, string(body)
+}
+
+func TestOIDCProviderDiscovery(t *testing.T) {
+	mP := newMockOIDCProvider(t)
+
+	policy := newTestOIDCPolicy(t, mP.server.URL+"/")
+
+	if _, err := policy.build(); err != nil {
+		t.Fatal(err)
+	}
+
+	discovery, err := policy.provider.Discovery()
+
+	if err != nil {
+		t.Fatalf("discovery: %s", err)
+	}
+
+	if discovery.AuthorizationEndpoint != mP.server.URL+"/auth" || discovery.TokenEndpoint != mP.server.URL+"/token" || discovery.EndSessionEndpoint != mP.server.URL+"/logout" {
+		t.Fatalf("unexpected endpoints %+v", discovery)
+	}
+
+	var requests int
+
+	impostor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 mP.server.URL,
+			"authorization_endpoint": mP.server.URL + "/auth",
+			"token_endpoint":         mP.server.URL + "/token",
+			"jwks_uri":               mP.server.URL + "/jwks",
+		})
+	}))
+
+	defer impostor.Close()
+
+	policy = newTestOIDCPolicy(t, impostor.URL)
+
+	if _, err := policy.build(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := policy.provider.Discovery(); err == nil || !strings.Contains(err.Error(), "discovery is for issuer") {
+		t.Fatalf("discovery for another issuer returned %v", err)
+	}
+
+	if _, err := policy.provider.Discovery(); err == nil || requests != 1 {
+		t.Fatalf("failed discovery retried right away, %d requests, err %v", requests, err)
+	}
+}
+
+func TestOIDCProviderDiscoveryFetchesOutsideTheLock(t *testing.T) {
+	var issuer string
+
+	server, entered, release, requests := newGatedServer(t, func() interface{} {
+		return map[string]string{
+			"issuer":                 issuer,
+			"authorization_endpoint": issuer + "/auth",
+			"token_endpoint":         issuer + "/token",
+			"jwks_uri":               issuer + "/jwks",
+		}
+	})
+
+	issuer = server.URL
+
+	policy := newTestOIDCPolicy(t, issuer)
+
+	if _, err := policy.build(); err != nil {
+		t.Fatal(err)
+	}
+
+	results := make(chan error, 4)
+
+	for i := 0; i < cap(results); i++ {
+		go func() {
+			_, err := policy.provider.Discovery()
+
+			results <- err
+		}()
+	}
+
+	<-entered
+
+	if !returnsWithin(func() { policy.provider.lock.Lock(); policy.provider.lock.Unlock() }) {
+		t.Error("lock held while fetching")
+	}
+
+	release()
+
+	for i := 0; i < cap(results); i++ {
+		if err := <-results; err != nil {
+			t.Errorf("discovery: %s", err)
+		}
+	}
+
+	if got := atomic.LoadInt32(requests); got != 1 {
+		t.Errorf("made %d discovery requests, want 1", got)
+	}
+}
+
+func TestOIDCLoginWithPKCE(t *testing.T) {
+	mP := newMockOIDCProvider(t)
+
+	policy := newTestOIDCPolicy(t, mP.server.URL)
+
+	router := newOIDCTestRouter(t, policy)
+
+	client := newOIDCTestClient(t, false)
+
+	resp, _ := oidcTestGet(t, client, router.URL+"/admin/dash?x=1", nil)
+
+	if resp.StatusCode != http.StatusFound || !strings.HasPrefix(resp.Header.Get("Location"), mP.server.URL+"/auth?") {
+		t.Fatalf("got %d to %q, want a redirect to the provider", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	resp, _ = oidcTestGet(t, client, resp.Header.Get("Location"), nil)
+
+	callback, err := url.Parse(resp.Header.Get("Location"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authorization := mP.authorizationFor(callback.Query().Get("code"))
+
+	for name, want := range map[string]string{
+		"redirect_uri":          router.URL + "/admin/_oidc/callback",
+		"client_id":             "router",
+		"response_type":         "code",
+		"scope":                 "openid email profile",
+		"code_challenge_method": "S256",
+	} {
+		if got := authorization.Get(name); got != want {
+			t.Errorf("authorization request %s: got %q, want %q", name, got, want)
+		}
+	}
+
+	if callback.Path != "/admin/_oidc/callback" {
+		t.Fatalf("callback at %s, want it under the route", callback.Path)
+	}
+
+	// A code is no use without the verifier
+	if _, err := policy.provider.Exchange(callback.Query().Get("code"), authorization.Get("redirect_uri"), "wrong-verifier", "s3cret"); err == nil || !strings.Contains(err.Error(), "PKCE") {
+		t.Fatalf("exchange with the wrong verifier returned %v", err)
+	}
+
+	resp, _ = oidcTestGet(t, client, callback.String(), nil)
+
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != router.URL+"/admin/dash?x=1" {
+		t.Fatalf("callback got %d to %q, want a redirect back to the page", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	resp, body := oidcTestGet(t, client, router.URL+"/admin/dash?x=1", http.Header{"X-Auth-Email": {"mallory@example.com"}})
+
+	if want := "email=alice@example.com subject=u1 groups=eng"; resp.StatusCode != http.StatusOK || body != want {
+		t.Fatalf("logged in request got %d %q, want %q", resp.StatusCode, body, want)
+	}
+
+	// The code is spent
+	if _, err := policy.provider.Exchange(callback.Query().Get("code"), authorization.Get("redirect_uri"), "", "s3cret"); err == nil {
+		t.Fatal("exchanged the same code twice")
+	}
+}
+
+func TestOIDCNonceMismatch(t *testing.T) {
+	mP := newMockOIDCProvider(t)
+
+	mP.nonce = "replayed-nonce"
+
+	policy := newTestOIDCPolicy(t, mP.server.URL)
+
+	router := newOIDCTestRouter(t, policy)
+
+	client := newOIDCTestClient(t, true)
+
+	resp, body := oidcTestGet(t, client, router.URL+"/admin/", nil)
+
+	if resp.StatusCode != http.StatusUnauthorized || !strings.Contains(body, "login failed") {
+		t.Fatalf("got %d %q, want the login to fail", resp.StatusCode, body)
+	}
+
+	routerURL, _ := url.Parse(router.URL)
+
+	for _, cookie := range client.Jar.Cookies(routerURL) {
+		if cookie.Name == policy.cookieName() {
+			t.Fatal("got a session for an ID token with the wrong nonce")
+		}
+	}
+}
+
+func TestOIDCExpiredStateCookie(t *testing.T) {
+	mP := newMockOIDCProvider(t)
+
+	policy := newTestOIDCPolicy(t, mP.server.URL)
+
+	router := newOIDCTestRouter(t, policy)
+
+	sealed, err := policy.seal(policy.cookieName()+"_state", oidcLoginState{
+		State:    "state",
+		Nonce:    "nonce",
+		Verifier: "verifier",
+		ReturnTo: router.URL + "/admin/",
+		Expires:  time.Now().Add(-time.Minute).Unix(),
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := newOIDCTestClient(t, false)
+
+	for name, cookie := range map[string]string{
+		"expired": fmt.Sprintf("%s_state=%s", policy.cookieName(), sealed),
+		"missing": "",
+		"forged":  policy.cookieName() + "_state=" + base64.RawURLEncoding.EncodeToString(make([]byte, 64)),
+	} {
+		resp, _ := oidcTestGet(t, client, router.URL+"/admin/_oidc/callback?code=code&state=state", http.Header{"Cookie": {cookie}})
+
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s state cookie: got %d, want 401", name, resp.StatusCode)
+		}
+	}
+
+	if mP.tokenRequests != 0 {
+		t.Fatalf("exchanged %d codes without a valid login state", mP.tokenRequests)
+	}
+}
+
+func TestOIDCAllowedUsersAndGroups(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		allowedUsers  []string
+		allowedGroups []string
+		groupsClaim   string
+		claims        map[string]interface{}
+		status        int
+		body          string
+	}{
+		{name: "anyone", status: http.StatusOK},
+		{name: "allowed email", allowedUsers: []string{"Alice@Example.com"}, status: http.StatusOK},
+		{name: "allowed subject", allowedUsers: []string{"u1"}, status: http.StatusOK},
+		{name: "other user", allowedUsers: []string{"bob@example.com"}, status: http.StatusForbidden},
+		{name: "allowed group", allowedGroups: []string{"ops", "eng"}, status: http.StatusOK},
+		{name: "other group", allowedGroups: []string{"ops"}, status: http.StatusForbidden},
+		{name: "user or group", allowedUsers: []string{"bob@example.com"}, allowedGroups: []string{"eng"}, status: http.StatusOK},
+		{name: "custom groups claim", allowedGroups: []string{"ops"}, groupsClaim: "roles", claims: map[string]interface{}{"roles": "ops admin"}, status: http.StatusOK},
+		{name: "no groups", allowedGroups: []string{"eng"}, claims: map[string]interface{}{"groups": nil}, status: http.StatusForbidden},
+		{name: "unverified email", allowedUsers: []string{"alice@example.com"}, claims: map[string]interface{}{"email_verified": false}, status: http.StatusForbidden},
+		{name: "email verified as a string", allowedUsers: []string{"alice@example.com"}, claims: map[string]interface{}{"email_verified": "true"}, status: http.StatusForbidden},
+		{name: "email without email_verified", allowedUsers: []string{"alice@example.com"}, claims: map[string]interface{}{"email_verified": nil}, status: http.StatusForbidden},
+		{name: "unverified email, allowed subject", allowedUsers: []string{"u1"}, claims: map[string]interface{}{"email_verified": false}, status: http.StatusOK, body: "email= subject=u1 groups=eng"},
+		{name: "no email, empty allowed user", allowedUsers: []string{""}, claims: map[string]interface{}{"email": nil}, status: http.StatusForbidden},
+	} {
+		mP := newMockOIDCProvider(t)
+
+		for name, value := range test.claims {
+			mP.claims[name] = value
+		}
+
+		policy := newTestOIDCPolicy(t, mP.server.URL)
+
+		policy.AllowedUsers, policy.AllowedGroups, policy.GroupsClaim = test.allowedUsers, test.allowedGroups, test.groupsClaim
+
+		router := newOIDCTestRouter(t, policy)
+
+		resp, body := oidcTestGet(t, newOIDCTestClient(t, true), router.URL+"/admin/", nil)
+
+		if resp.StatusCode != test.status {
+			t.Errorf("%s: got %d %q, want %d", test.name, resp.StatusCode, body, test.status)
+		} else if test.body != "" && body != test.body {
+			t.Errorf("%s: got %q, want %q", test.name, body, test.body)
+		}
+	}
+}
+
+func TestOIDCLogout(t *testing.T) {
+	mP := newMockOIDCProvider(t)
+
+	policy := newTestOIDCPolicy(t, mP.server.URL)
+
+	router := newOIDCTestRouter(t, policy)
+
+	client := newOIDCTestClient(t, true)
+
+	if resp, body := oidcTestGet(t, client, router.URL+"/admin/", nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("login got %d %q", resp.StatusCode, body)
+	}
+
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+
+	// The logout of the root route is another route's path
+	if resp, _ := oidcTestGet(t, client, router.URL+"/_oidc/logout", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("/_oidc/logout got %d, want it left to the route it falls under", resp.StatusCode)
+	}
+
+	resp, _ := oidcTestGet(t, client, router.URL+"/admin/_oidc/logout", nil)
+
+	want := oidcAppendQuery(mP.server.URL+"/logout", url.Values{"client_id": {"router"}, "post_logout_redirect_uri": {router.URL + "/admin/"}})
+
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != want {
+		t.Fatalf("logout got %d to %q, want a redirect to %q", resp.StatusCode, resp.Header.Get("Location"), want)
+	}
+
+	resp, _ = oidcTestGet(t, client, router.URL+"/admin/", nil)
+
+	if resp.StatusCode != http.StatusFound || !strings.HasPrefix(resp.Header.Get("Location"), mP.server.URL+"/auth?") {
+		t.Fatalf("after logging out got %d to %q, want a new login", resp.StatusCode, resp.Header.Get("Location"))
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errClientHelloRead = errors.New("client hello read")
+
+// passthroughRoute splices TLS connections for ServerName, an exact name or a "*.example.com"
+// wildcard, straight to Upstream, a host:port that terminates TLS itself. ProxyProtocol, 1 or 2,
+// sends the upstream a PROXY protocol header first so it still learns the client's address.
+type passthroughRoute struct {
+	ServerName    string `json:"serverName"`
+	Upstream      string `json:"upstream"`
+	ProxyProtocol int    `json:"proxyProtocol,omitempty"`
+}
+
+func (pR *passthroughRoute) validate() error {
+	if pR.ServerName == "" {
+		return errors.New("serverName is missing")
+	}
+
+	if _, _, err := net.SplitHostPort(pR.Upstream); err != nil {
+		return fmt.Errorf("upstream %q is not a host:port: %s", pR.Upstream, err)
+	}
+
+	return validateProxyProtocolVersion(pR.ProxyProtocol)
+}
+
+// PassthroughRoute finds the passthrough route for serverName, preferring an exact match to a
+// wildcard.
+func (rC *routeConfig) PassthroughRoute(serverName string) (*passthroughRoute, bool) {
+	if rC == nil || serverName == "" {
+		return nil, false
+	}
+
+	serverName = strings.ToLower(strings.TrimSuffix(serverName, "."))
+
+	wildcard := ""
+
+	if dot := strings.IndexByte(serverName, '.'); dot > 0 {
+		wildcard = "*" + serverName[dot:]
+	}
+
+	var found *passthroughRoute
+
+	for _, route := range rC.Passthrough {
+		if strings.EqualFold(route.ServerName, serverName) {
+			return route, true
+		}
+
+		if found == nil && wildcard != "" && strings.EqualFold(route.ServerName, wildcard) {
+			found = route
+		}
+	}
+
+	return found, found != nil
+}
+
+// sniListener reads the ClientHello of every connection it accepts. Connections for server
+// names with an upstream are spliced to it without being decrypted, everything else is
+// handed on, ClientHello included, to the TLS server accepting from the listener.
+type sniListener struct {
+	net.Listener
+
+	passthrough  func(serverName string) (*passthroughRoute, bool)
+	helloTimeout time.Duration
+	dialTimeout  time.Duration
+
+	conns     chan net.Conn
+	errs      chan error
+	done      chan struct{}
+	closeOnce *sync.Once
+}
+
+func newSNIListener(listener net.Listener, passthrough func(serverName string) (*passthroughRoute, bool), helloTimeout time.Duration) *sniListener {
+	sL := &sniListener{
+		Listener:     listener,
+		passthrough:  passthrough,
+		helloTimeout: helloTimeout,
+		dialTimeout:  10 * time.Second,
+		conns:        make(chan net.Conn),
+		errs:         make(chan error, 1),
+		done:         make(chan struct{}),
+		closeOnce:    &sync.Once{},
+	}
+
+	go sL.acceptLoop()
+
+	return sL
+}
+
+func (sL *sniListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-sL.conns:
+		return conn, nil
+	case err := <-sL.errs:
+		return nil, err
+	case <-sL.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (sL *sniListener) Close() error {
+	sL.closeOnce.Do(func() { close(sL.done) })
+
+	return sL.Listener.Close()
+}
+
+func (sL *sniListener) acceptLoop() {
+	for {
+		conn, err := sL.Listener.Accept()
+
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				time.Sleep(5 * time.Millisecond)
+
+				continue
+			}
+
+			select {
+			case sL.errs <- err:
+			case <-sL.done:
+			}
+
+			return
+		}
+
+		go sL.route(conn)
+	}
+}
+
+// route reads the connection's ClientHello and splices or hands the connection on. Reading
+// happens off the accept loop so a slow client can't hold up everyone else.
+func (sL *sniListener) route(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(sL.helloTimeout))
+
+	serverName, hello, err := readServerName(conn)
+
+	conn.SetReadDeadline(time.Time{})
+
+	replayed := &replayConn{Conn: conn, reader: io.MultiReader(bytes.NewReader(hello), conn)}
+
+	if err == nil {
+		if route, exists := sL.passthrough(serverName); exists {
+			splicePassthrough(replayed, serverName, route, sL.dialTimeout)
+
+			return
+		}
+	}
+
+	// Not a ClientHello we could read, the TLS server reports whatever is wrong with it
+	select {
+	case sL.conns <- replayed:
+	case <-sL.done:
+		conn.Close()
+	}
+}
+
+// readServerName reads a ClientHello off conn, returning its server name and the bytes read.
+// A TLS server does the parsing and is stopped once it has the ClientHello, before it writes
+// anything back.
+func readServerName(conn net.Conn) (string, []byte, error) {
+	var hello bytes.Buffer
+
+	serverName := ""
+
+	err := tls.Server(readOnlyConn{reader: io.TeeReader(conn, &hello)}, &tls.Config{
+		GetConfigForClient: func(clientHello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = clientHello.ServerName
+
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+
+	if err != nil && !errors.Is(err, errClientHelloRead) {
+		return "", hello.Bytes(), err
+	}
+
+	return serverName, hello.Bytes(), nil
+}
+
+// splicePassthrough copies bytes both ways between conn and the route's upstream until both
+// sides are done.
+func splicePassthrough(conn net.Conn, serverName string, route *passthroughRoute, dialTimeout time.Duration) {
+	defer conn.Close()
+
+	upstreamConn, err := net.DialTimeout("tcp", route.Upstream, dialTimeout)
+
+	if err != nil {
+		passthroughMetrics.Add("failed", 1)
+
+		log.Printf("passthrough: event=dial_failed server_name=%s upstream=%s remote=%s err=%q\n", serverName, route.Upstream, conn.RemoteAddr(), err)
+
+		return
+	}
+
+	defer upstreamConn.Close()
+
+	if route.ProxyProtocol != 0 {
+		if err := writeProxyProtocolHeader(upstreamConn, route.ProxyProtocol, conn.RemoteAddr(), conn.LocalAddr()); err != nil {
+			passthroughMetrics.Add("failed", 1)
+
+			log.Printf("passthrough: event=proxy_protocol_failed server_name=%s upstream=%s remote=%s err=%q\n", serverName, route.Upstream, conn.RemoteAddr(), err)
+
+			return
+		}
+	}
+
+	passthroughMetrics.Add("open", 1)
+	passthroughMetrics.Add("opened", 1)
+
+	defer passthroughMetrics.Add("open", -1)
+
+	var wg sync.WaitGroup
+
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+
+		written, _ := io.Copy(upstreamConn, conn)
+
+		passthroughMetrics.Add("bytesFromClient", written)
+
+		closeWrite(upstreamConn)
+	}()
+
+	go func() {
+		defer wg.Done()
+
+		written, _ := io.Copy(conn, upstreamConn)
+
+		passthroughMetrics.Add("bytesToClient", written)
+
+		closeWrite(conn)
+	}()
+
+	wg.Wait()
+}
+
+// closeWrite half closes conn so the other side sees EOF while still being able to answer.
+func closeWrite(conn net.Conn) {
+	if replayed, ok := conn.(*replayConn); ok {
+		conn = replayed.Conn
+	}
+
+	if halfCloser, ok := conn.(interface{ CloseWrite() error }); ok {
+		halfCloser.CloseWrite()
+	} else {
+		conn.Close()
+	}
+}
+
+// replayConn reads from reader, which replays bytes already read off the connection before
+// reading the rest of it.
+type replayConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (rC *replayConn) Read(p []byte) (int, error) {
+	return rC.reader.Read(p)
+}
+
+// readOnlyConn lets a TLS server read a ClientHello while making sure it never writes.
+type readOnlyConn struct {
+	reader io.Reader
+}
+
+func (rOC readOnlyConn) Read(p []byte) (int, error)         { return rOC.reader.Read(p) }
+func (rOC readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (rOC readOnlyConn) Close() error                       { return nil }
+func (rOC readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (rOC readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (rOC readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (rOC readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (rOC readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
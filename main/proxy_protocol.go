@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyProtocolSignature starts every PROXY protocol v2 header.
+var proxyProtocolSignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errProxyProtocolHeader = errors.New("invalid PROXY protocol header")
+
+// proxyProtocolListener accepts PROXY protocol v1 and v2 headers from connections coming from
+// the trusted networks, such as a TCP load balancer, and reports the addresses they carry as
+// the connection's addresses. Connections from anywhere else are taken as they are.
+type proxyProtocolListener struct {
+	net.Listener
+
+	trusted       []*net.IPNet
+	headerTimeout time.Duration
+}
+
+func newProxyProtocolListener(listener net.Listener, trusted []*net.IPNet, headerTimeout time.Duration) *proxyProtocolListener {
+	return &proxyProtocolListener{Listener: listener, trusted: trusted, headerTimeout: headerTimeout}
+}
+
+func (pPL *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := pPL.Listener.Accept()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		for _, network := range pPL.trusted {
+			if network.Contains(tcpAddr.IP) {
+				return &proxyProtocolConn{Conn: conn, reader: bufio.NewReader(conn), headerTimeout: pPL.headerTimeout, once: &sync.Once{}}, nil
+			}
+		}
+	}
+
+	return conn, nil
+}
+
+// parseProxyProtocolSources parses a comma separated list of addresses and CIDR ranges.
+func parseProxyProtocolSources(value string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+
+		network, err := parseNetwork(entry)
+
+		if err != nil {
+			return nil, err
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// proxyProtocolConn reads the PROXY protocol header off the connection the first time it is
+// read from or asked for its addresses, which happens off the accept loop.
+type proxyProtocolConn struct {
+	net.Conn
+
+	reader        *bufio.Reader
+	headerTimeout time.Duration
+
+	once        *sync.Once
+	err         error
+	source      net.Addr
+	destination net.Addr
+}
+
+func (pPC *proxyProtocolConn) readHeader() {
+	pPC.once.Do(func() {
+		pPC.Conn.SetReadDeadline(time.Now().Add(pPC.headerTimeout))
+
+		pPC.source, pPC.destination, pPC.err = readProxyProtocolHeader(pPC.reader)
+
+		pPC.Conn.SetReadDeadline(time.Time{})
+
+		if pPC.err != nil {
+			log.Printf("proxyprotocol: event=rejected remote=%s err=%q\n", pPC.Conn.RemoteAddr(), pPC.err)
+
+			pPC.err = fmt.Errorf("%s from %s: %s", errProxyProtocolHeader, pPC.Conn.RemoteAddr(), pPC.err)
+		}
+	})
+}
+
+func (pPC *proxyProtocolConn) Read(p []byte) (int, error) {
+	if pPC.readHeader(); pPC.err != nil {
+		return 0, pPC.err
+	}
+
+	return pPC.reader.Read(p)
+}
+
+func (pPC *proxyProtocolConn) RemoteAddr() net.Addr {
+	if pPC.readHeader(); pPC.source != nil {
+		return pPC.source
+	}
+
+	return pPC.Conn.RemoteAddr()
+}
+
+func (pPC *proxyProtocolConn) LocalAddr() net.Addr {
+	if pPC.readHeader(); pPC.destination != nil {
+		return pPC.destination
+	}
+
+	return pPC.Conn.LocalAddr()
+}
+
+func (pPC *proxyProtocolConn) CloseWrite() error {
+	if halfCloser, ok := pPC.Conn.(interface{ CloseWrite() error }); ok {
+		return halfCloser.CloseWrite()
+	}
+
+	return pPC.Conn.Close()
+}
+
+// readProxyProtocolHeader reads a v1 or v2 header, returning nil addresses for headers that
+// carry none, such as v1 UNKNOWN and v2 LOCAL ones from load balancer health checks.
+func readProxyProtocolHeader(reader *bufio.Reader) (net.Addr, net.Addr, error) {
+	start, err := reader.Peek(len(proxyProtocolSignature))
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if bytes.Equal(start, proxyProtocolSignature) {
+		return readProxyProtocolV2(reader)
+	}
+
+	if bytes.HasPrefix(start, []byte("PROXY ")) {
+		return readProxyProtocolV1(reader)
+	}
+
+	return nil, nil, errors.New("no PROXY protocol header")
+}
+
+func readProxyProtocolV1(reader *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+
+	// A v1 header is at most 107 bytes, CRLF included
+	for len(line) < 107 {
+		c, err := reader.ReadByte()
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		line = append(line, c)
+
+		if c == '\n' {
+			break
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("v1 header is not terminated by CRLF")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("malformed v1 header %q", line)
+	}
+
+	source, err := proxyProtocolTCPAddr(fields[2], fields[4])
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	destination, err := proxyProtocolTCPAddr(fields[3], fields[5])
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return source, destination, nil
+}
+
+func proxyProtocolTCPAddr(ip, port string) (*net.TCPAddr, error) {
+	parsedIP := net.ParseIP(ip)
+
+	if parsedIP == nil {
+		return nil, fmt.Errorf("invalid address %q", ip)
+	}
+
+	parsedPort, err := strconv.ParseUint(port, 10, 16)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", port)
+	}
+
+	return &net.TCPAddr{IP: parsedIP, Port: int(parsedPort)}, nil
+}
+
+func readProxyProtocolV2(reader *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, 16)
+
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, nil, err
+	}
+
+	version, command, family := header[12]>>4, header[12]&0x0F, header[13]
+
+	if version != 2 {
+		return nil, nil, fmt.Errorf("unsupported version %d", version)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, nil, err
+	}
+
+	switch command {
+	case 0x0:
+		// LOCAL, the load balancer talking for itself
+		return nil, nil, nil
+	case 0x1:
+	default:
+		return nil, nil, fmt.Errorf("unsupported command %d", command)
+	}
+
+	switch family {
+	case 0x11:
+		if len(payload) < 12 {
+			return nil, nil, errors.New("short v2 IPv4 addresses")
+		}
+
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:]))},
+			&net.TCPAddr{IP: net.IP(payload[4:8]), Port: int(binary.BigEndian.Uint16(payload[10:]))}, nil
+	case 0x21:
+		if len(payload) < 36 {
+			return nil, nil, errors.New("short v2 IPv6 addresses")
+		}
+
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:]))},
+			&net.TCPAddr{IP: net.IP(payload[16:32]), Port: int(binary.BigEndian.Uint16(payload[34:]))}, nil
+	}
+
+	// Unix sockets and unspecified families carry nothing useful for a TCP router
+	return nil, nil, nil
+}
+
+// writeProxyProtocolHeader writes a v1 or v2 header describing a connection from source to
+// destination, falling back to UNKNOWN or LOCAL when they aren't both TCP addresses of the same
+// family.
+func writeProxyProtocolHeader(w io.Writer, version int, source, destination net.Addr) error {
+	sourceTCP, sourceOK := source.(*net.TCPAddr)
+	destinationTCP, destinationOK := destination.(*net.TCPAddr)
+
+	known := sourceOK && destinationOK && (sourceTCP.IP.To4() == nil) == (destinationTCP.IP.To4() == nil)
+
+	if version == 1 {
+		if !known {
+			_, err := io.WriteString(w, "PROXY UNKNOWN\r\n")
+
+			return err
+		}
+
+		family := "TCP6"
+
+		if sourceTCP.IP.To4() != nil {
+			family = "TCP4"
+		}
+
+		_, err := fmt.Fprintf(w, "PROXY %s %s %s %d %d\r\n", family, sourceTCP.IP, destinationTCP.IP, sourceTCP.Port, destinationTCP.Port)
+
+		return err
+	}
+
+	header := append([]byte(nil), proxyProtocolSignature...)
+
+	if !known {
+		_, err := w.Write(append(header, 0x20, 0x00, 0x00, 0x00))
+
+		return err
+	}
+
+	var addresses []byte
+
+	family := byte(0x21)
+
+	if source4, destination4 := sourceTCP.IP.To4(), destinationTCP.IP.To4(); source4 != nil {
+		family = 0x11
+
+		addresses = append(append(addresses, source4...), destination4...)
+	} else {
+		addresses = append(append(addresses, sourceTCP.IP.To16()...), destinationTCP.IP.To16()...)
+	}
+
+	ports := make([]byte, 4)
+
+	binary.BigEndian.PutUint16(ports, uint16(sourceTCP.Port))
+	binary.BigEndian.PutUint16(ports[2:], uint16(destinationTCP.Port))
+
+	addresses = append(addresses, ports...)
+
+	length := make([]byte, 2)
+
+	binary.BigEndian.PutUint16(length, uint16(len(addresses)))
+
+	header = append(header, 0x21, family)
+	header = append(header, length...)
+
+	_, err := w.Write(append(header, addresses...))
+
+	return err
+}
+
+func validateProxyProtocolVersion(version int) error {
+	if version != 0 && version != 1 && version != 2 {
+		return fmt.Errorf("proxyProtocol must be 1 or 2, not %d", version)
+	}
+
+	return nil
+}
+
+type proxyProtocolContextKey struct{}
+
+type proxyProtocolAddrs struct {
+	source      net.Addr
+	destination net.Addr
+}
+
+// withProxyProtocolAddrs stores the client and local addresses of r in ctx for transports that
+// send PROXY protocol headers to upstreams.
+func withProxyProtocolAddrs(ctx context.Context, r *http.Request) context.Context {
+	addrs := proxyProtocolAddrs{}
+
+	if source, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		addrs.source = source
+	}
+
+	if destination, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		addrs.destination = destination
+	}
+
+	return context.WithValue(ctx, proxyProtocolContextKey{}, addrs)
+}
+
+// proxyProtocolDialer dials upstreams and introduces each connection with a PROXY protocol
+// header for the client whose request it carries.
+func proxyProtocolDialer(version int) func(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, address)
+
+		if err != nil {
+			return nil, err
+		}
+
+		addrs, _ := ctx.Value(proxyProtocolContextKey{}).(proxyProtocolAddrs)
+
+		if err := writeProxyProtocolHeader(conn, version, addrs.source, addrs.destination); err != nil {
+			conn.Close()
+
+			return nil, err
+		}
+
+		return conn, nil
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+// proxyProtocolV2 builds a v2 header declaring length bytes of payload, whatever its real size.
+func proxyProtocolV2(versionCommand, family byte, length int, payload []byte) string {
+	header := append([]byte(nil), proxyProtocolSignature...)
+
+	header = append(header, versionCommand, family, 0, 0)
+
+	binary.BigEndian.PutUint16(header[14:], uint16(length))
+
+	return string(append(header, payload...))
+}
+
+func TestReadProxyProtocolHeader(t *testing.T) {
+	source4 := &net.TCPAddr{IP: net.ParseIP("192.0.2.1").To4(), Port: 56324}
+	destination4 := &net.TCPAddr{IP: net.ParseIP("198.51.100.1").To4(), Port: 443}
+
+	source6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}
+	destination6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+
+	written := func(version int, source, destination net.Addr) string {
+		var header bytes.Buffer
+
+		if err := writeProxyProtocolHeader(&header, version, source, destination); err != nil {
+			t.Fatal(err)
+		}
+
+		return header.String()
+	}
+
+	addresses4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xDC, 0x04, 0x01, 0xBB}
+
+	for _, test := range []struct {
+		name        string
+		header      string
+		source      string
+		destination string
+		valid       bool
+	}{
+		{"v1 TCP4", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", "192.0.2.1:56324", "198.51.100.1:443", true},
+		{"v1 TCP6", "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", "[2001:db8::1]:56324", "[2001:db8::2]:443", true},
+		{"v1 UNKNOWN", "PROXY UNKNOWN\r\n", "", "", true},
+		{"v1 written", written(1, source6, destination6), "[2001:db8::1]:56324", "[2001:db8::2]:443", true},
+		{"v1 truncated", "PROXY TCP4 192.0.2.1 198.51.100.1 56324", "", "", false},
+		{"v1 without CR", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n", "", "", false},
+		{"v1 oversized", "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", "", "", false},
+		{"v1 missing port", "PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n", "", "", false},
+		{"v1 port out of range", "PROXY TCP4 192.0.2.1 198.51.100.1 65536 443\r\n", "", "", false},
+		{"v1 bad address", "PROXY TCP4 192.0.2 198.51.100.1 56324 443\r\n", "", "", false},
+		{"v1 bad family", "PROXY UDP4 192.0.2.1 198.51.100.1 56324 443\r\n", "", "", false},
+		{"v2 IPv4", written(2, source4, destination4), "192.0.2.1:56324", "198.51.100.1:443", true},
+		{"v2 IPv6", written(2, source6, destination6), "[2001:db8::1]:56324", "[2001:db8::2]:443", true},
+		{"v2 LOCAL", written(2, nil, nil), "", "", true},
+		{"v2 IPv4 with TLVs", proxyProtocolV2(0x21, 0x11, 16, append(addresses4, 0x04, 0x00, 0x01, 0x00)), "192.0.2.1:56324", "198.51.100.1:443", true},
+		{"v2 unix socket", proxyProtocolV2(0x21, 0x31, 0, nil), "", "", true},
+		{"v2 truncated fixed header", string(proxyProtocolSignature) + "\x21\x11", "", "", false},
+		{"v2 truncated addresses", proxyProtocolV2(0x21, 0x11, 12, addresses4[:6]), "", "", false},
+		{"v2 oversized length", proxyProtocolV2(0x21, 0x11, 0xFFFF, addresses4), "", "", false},
+		{"v2 short IPv4 addresses", proxyProtocolV2(0x21, 0x11, 8, addresses4[:8]), "", "", false},
+		{"v2 short IPv6 addresses", proxyProtocolV2(0x21, 0x21, 12, addresses4), "", "", false},
+		{"v2 wrong version", proxyProtocolV2(0x11, 0x11, 12, addresses4), "", "", false},
+		{"v2 unknown command", proxyProtocolV2(0x22, 0x11, 12, addresses4), "", "", false},
+		{"no header", "GET / HTTP/1.1\r\n", "", "", false},
+		{"short connection", "PROXY", "", "", false},
+	} {
+		// Truncated headers end with the connection rather than running into the request
+		request := ""
+
+		if test.valid {
+			request = "GET / HTTP/1.1\r\n"
+		}
+
+		reader := bufio.NewReader(strings.NewReader(test.header + request))
+
+		source, destination, err := readProxyProtocolHeader(reader)
+
+		if (err == nil) != test.valid {
+			t.Errorf("%s: got %v, want valid %t", test.name, err, test.valid)
+
+			continue
+		}
+
+		if !test.valid {
+			continue
+		}
+
+		if got := addrString(source); got != test.source {
+			t.Errorf("%s: got source %q, want %q", test.name, got, test.source)
+		}
+
+		if got := addrString(destination); got != test.destination {
+			t.Errorf("%s: got destination %q, want %q", test.name, got, test.destination)
+		}
+
+		// The header must be consumed exactly, leaving the request behind it
+		if rest, _ := ioutil.ReadAll(reader); string(rest) != request {
+			t.Errorf("%s: left %q after the header, want %q", test.name, rest, request)
+		}
+	}
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+
+	return addr.String()
+}
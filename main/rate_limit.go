@@ -0,0 +1,264 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// rateLimitPolicy limits requests with token buckets, one per key. Rate requests are allowed
+// every Per, one second by default, with up to Burst, Rate by default, allowed at once. Key
+// picks who shares a bucket: "ip", the default, the client IP, "header:<name>" the value of a
+// request header, "apiKey" the X-API-Key header or Authorization bearer token, and "route"
+// everyone. Requests without the header or key fall back to their client IP. Scope "route", the
+// default, gives every route its own buckets, while "project" shares them across the project.
+type rateLimitPolicy struct {
+	Rate  float64        `json:"rate"`
+	Per   configDuration `json:"per,omitempty"`
+	Burst int            `json:"burst,omitempty"`
+	Key   string         `json:"key,omitempty"`
+	Scope string         `json:"scope,omitempty"`
+}
+
+func (rLP *rateLimitPolicy) validate() error {
+	if rLP.Rate <= 0 {
+		return errors.New("rate must be above 0")
+	}
+
+	if rLP.Per < 0 || rLP.Burst < 0 {
+		return errors.New("per and burst can't be negative")
+	}
+
+	switch {
+	case rLP.Key == "", rLP.Key == "ip", rLP.Key == "apiKey", rLP.Key == "route":
+	case strings.HasPrefix(rLP.Key, "header:") && len(rLP.Key) > len("header:"):
+	default:
+		return fmt.Errorf("unknown key %q, expected ip, header:<name>, apiKey or route", rLP.Key)
+	}
+
+	if rLP.Scope != "" && rLP.Scope != "route" && rLP.Scope != "project" {
+		return fmt.Errorf("unknown scope %q, expected route or project", rLP.Scope)
+	}
+
+	return nil
+}
+
+func (rLP *rateLimitPolicy) burst() float64 {
+	if rLP.Burst > 0 {
+		return float64(rLP.Burst)
+	}
+
+	return math.Max(1, math.Floor(rLP.Rate))
+}
+
+// perSecond is the rate the policy's buckets refill at.
+func (rLP *rateLimitPolicy) perSecond() float64 {
+	per := time.Duration(rLP.Per)
+
+	if per <= 0 {
+		per = time.Second
+	}
+
+	return rLP.Rate / per.Seconds()
+}
+
+// key names the bucket the request draws from.
+func (rLP *rateLimitPolicy) key(c *gin.Context, settings routeSettings) string {
+	scope := "route:" + settings.domain + settings.route
+
+	if rLP.Scope == "project" {
+		scope = "project:" + settings.project
+	}
+
+	switch {
+	case rLP.Key == "route":
+		return scope
+	case rLP.Key == "apiKey":
+		apiKey := c.Request.Header.Get("X-API-Key")
+
+		if authorization := c.Request.Header.Get("Authorization"); apiKey == "" && strings.HasPrefix(authorization, "Bearer ") {
+			apiKey = strings.TrimPrefix(authorization, "Bearer ")
+		}
+
+		if apiKey != "" {
+			// Keeps the keys themselves out of memory and bounds the size of long ones
+			hash := sha256.Sum256([]byte(apiKey))
+
+			return scope + "|apiKey:" + hex.EncodeToString(hash[:16])
+		}
+	case strings.HasPrefix(rLP.Key, "header:"):
+		if value := c.Request.Header.Get(strings.TrimPrefix(rLP.Key, "header:")); value != "" {
+			return scope + "|" + rLP.Key + ":" + value
+		}
+	}
+
+	// The connecting peer unless trusted proxies vouch for another address, so clients can't
+	// get a fresh bucket per request by making up X-Forwarded-For values
+	return scope + "|ip:" + requestClientIP(c)
+}
+
+type tokenBucket struct {
+	tokens    float64
+	updatedAt time.Time
+
+	// fullAt is when the bucket will have refilled, from then on it is no different from a
+	// new bucket and can be dropped
+	fullAt time.Time
+}
+
+// rateLimiter holds the token buckets of every rate limited route, bounded to maxKeys buckets.
+// Buckets outlive route config reloads so a reload doesn't hand out fresh bursts.
+type rateLimiter struct {
+	maxKeys int
+
+	lock    *sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimiter(maxKeys int) *rateLimiter {
+	rL := &rateLimiter{
+		maxKeys: maxKeys,
+		lock:    &sync.Mutex{},
+		buckets: make(map[string]*tokenBucket),
+	}
+
+	rateLimitMetrics.Set("keys", expvar.Func(func() interface{} {
+		rL.lock.Lock()
+
+		defer rL.lock.Unlock()
+
+		return len(rL.buckets)
+	}))
+
+	return rL
+}
+
+// Sweep drops refilled buckets every interval, which forgets nothing they would remember.
+func (rL *rateLimiter) Sweep(interval time.Duration) {
+	for range time.Tick(interval) {
+		rL.lock.Lock()
+
+		rL.evictFull(time.Now())
+
+		rL.lock.Unlock()
+	}
+}
+
+func (rL *rateLimiter) evictFull(now time.Time) {
+	for key, bucket := range rL.buckets {
+		if !now.Before(bucket.fullAt) {
+			delete(rL.buckets, key)
+		}
+	}
+}
+
+// take draws a token for key, reporting whether there was one, the tokens left and how long
+// until the next token and until the bucket is full again.
+func (rL *rateLimiter) take(key string, burst, perSecond float64) (bool, float64, time.Duration, time.Duration) {
+	rL.lock.Lock()
+
+	defer rL.lock.Unlock()
+
+	now := time.Now()
+
+	bucket, exists := rL.buckets[key]
+
+	if !exists {
+		if len(rL.buckets) >= rL.maxKeys {
+			rL.evictFull(now)
+		}
+
+		if len(rL.buckets) >= rL.maxKeys {
+			// Every bucket is in use, losing an arbitrary one's state beats growing without bound
+			for other := range rL.buckets {
+				delete(rL.buckets, other)
+
+				rateLimitMetrics.Add("evicted", 1)
+
+				break
+			}
+		}
+
+		bucket = &tokenBucket{tokens: burst, updatedAt: now}
+
+		rL.buckets[key] = bucket
+	}
+
+	bucket.tokens = math.Min(burst, bucket.tokens+now.Sub(bucket.updatedAt).Seconds()*perSecond)
+	bucket.updatedAt = now
+
+	allowed := bucket.tokens >= 1
+
+	if allowed {
+		bucket.tokens--
+	}
+
+	untilNext := time.Duration(0)
+
+	if bucket.tokens < 1 {
+		untilNext = time.Duration((1 - bucket.tokens) / perSecond * float64(time.Second))
+	}
+
+	untilFull := time.Duration((burst - bucket.tokens) / perSecond * float64(time.Second))
+
+	bucket.fullAt = now.Add(untilFull)
+
+	return allowed, bucket.tokens, untilNext, untilFull
+}
+
+// Check draws a token for the request under policy, setting the RateLimit-* headers and
+// answering with 429, or RESOURCE_EXHAUSTED for gRPC calls, when there is none. It reports
+// whether it answered.
+func (rL *rateLimiter) Check(c *gin.Context, settings routeSettings, policy *rateLimitPolicy) bool {
+	burst := policy.burst()
+
+	allowed, remaining, untilNext, untilFull := rL.take(policy.key(c, settings), burst, policy.perSecond())
+
+	c.Header("RateLimit-Limit", strconv.Itoa(int(burst)))
+	c.Header("RateLimit-Remaining", strconv.Itoa(int(remaining)))
+	c.Header("RateLimit-Reset", strconv.Itoa(ceilSeconds(untilFull)))
+
+	if allowed {
+		return false
+	}
+
+	retryAfter := strconv.Itoa(ceilSeconds(untilNext))
+
+	c.Header("Retry-After", retryAfter)
+
+	rateLimitMetrics.Add("limited", 1)
+	rateLimitLimitedByProject.Add(metricsProjectName(settings.project), 1)
+
+	log.Printf("ratelimit: event=limited domain=%s project=%s route=%s client_ip=%s retry_after=%s\n", settings.domain, settings.project, settings.route, requestClientIP(c), retryAfter)
+
+	if isGRPCRequest(c.Request) {
+		writeGRPCError(c.Writer, c.Request, grpcResourceExhausted, "rate limit exceeded, retry in "+retryAfter+"s")
+
+		c.Abort()
+
+		return true
+	}
+
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+		"msg":  "rate limit exceeded, retry in " + retryAfter + "s",
+		"err":  true,
+		"data": gin.H{},
+	})
+
+	return true
+}
+
+func ceilSeconds(duration time.Duration) int {
+	return int(math.Ceil(duration.Seconds()))
+}
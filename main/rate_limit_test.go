@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRateLimitKeyIgnoresSpoofedForwardedFor(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	policy := &rateLimitPolicy{Rate: 1, Burst: 2}
+
+	rL := newRateLimiter(100)
+
+	router := gin.New()
+
+	router.GET("/", func(c *gin.Context) {
+		if rL.Check(c, routeSettings{domain: "example.com", project: "api", route: "/"}, policy) {
+			return
+		}
+
+		c.String(http.StatusOK, "ok")
+	})
+
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+
+		request.RemoteAddr = "192.0.2.1:4000"
+
+		// A different made up address each time
+		request.Header.Set("X-Forwarded-For", "203.0.113."+string(rune('1'+i)))
+
+		recorder := httptest.NewRecorder()
+
+		router.ServeHTTP(recorder, request)
+
+		if recorder.Code != want {
+			t.Fatalf("request %d: got %d, want %d", i+1, recorder.Code, want)
+		}
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	request.RemoteAddr = "192.0.2.2:4000"
+
+	recorder := httptest.NewRecorder()
+
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("another peer: got %d, want its own bucket", recorder.Code)
+	}
+}
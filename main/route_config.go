@@ -0,0 +1,546 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// routeMatch picks the routes a rule applies to. Empty fields match anything, Domain is the
+// domain as uyghurs sends it (the default domain for routes without one) and Route is the
+// exact route prefix.
+type routeMatch struct {
+	Domain  string `json:"domain"`
+	Project string `json:"project"`
+	Route   string `json:"route"`
+}
+
+// intersect is the match covering the routes matched by both rM and other, reporting whether
+// there are any.
+func (rM routeMatch) intersect(other routeMatch) (routeMatch, bool) {
+	intersection := rM
+
+	if other.Domain != "" {
+		if rM.Domain != "" && !strings.EqualFold(rM.Domain, other.Domain) {
+			return routeMatch{}, false
+		}
+
+		intersection.Domain = other.Domain
+	}
+
+	if other.Project != "" {
+		if rM.Project != "" && rM.Project != other.Project {
+			return routeMatch{}, false
+		}
+
+		intersection.Project = other.Project
+	}
+
+	if other.Route != "" {
+		if rM.Route != "" && rM.Route != other.Route {
+			return routeMatch{}, false
+		}
+
+		intersection.Route = other.Route
+	}
+
+	return intersection, true
+}
+
+// specificity ranks rules so that naming a route beats naming a project, which beats naming
+// a domain.
+func (rM routeMatch) specificity() int {
+	specificity := 0
+
+	if rM.Route != "" {
+		specificity += 4
+	}
+
+	if rM.Project != "" {
+		specificity += 2
+	}
+
+	if rM.Domain != "" {
+		specificity++
+	}
+
+	return specificity
+}
+
+func (rM routeMatch) matches(domain, project, route string) bool {
+	return (rM.Domain == "" || strings.EqualFold(rM.Domain, domain)) &&
+		(rM.Project == "" || rM.Project == project) &&
+		(rM.Route == "" || rM.Route == route)
+}
+
+// routeRule holds the router side settings for the routes it matches, each section is taken
+// from the most specific rule that sets it, apart from securityHeaders and headers which are
+// layered.
+type routeRule struct {
+	Match           routeMatch             `json:"match"`
+	Upstream        *upstreamPolicy        `json:"upstream,omitempty"`
+	GRPCWeb         *grpcWebPolicy         `json:"grpcWeb,omitempty"`
+	Websocket       *websocketPolicy       `json:"websocket,omitempty"`
+	Access          *accessPolicy          `json:"access,omitempty"`
+	RateLimit       *rateLimitPolicy       `json:"rateLimit,omitempty"`
+	Concurrency     *concurrencyPolicy     `json:"concurrency,omitempty"`
+	Auth            *authPolicy            `json:"auth,omitempty"`
+	JWT             *jwtPolicy             `json:"jwt,omitempty"`
+	OIDC            *oidcPolicy            `json:"oidc,omitempty"`
+	CORS            *corsPolicy            `json:"cors,omitempty"`
+	SecurityHeaders *securityHeadersPolicy `json:"securityHeaders,omitempty"`
+	Headers         *headerRulesPolicy     `json:"headers,omitempty"`
+}
+
+// configDuration is a time.Duration written as a string like "90s" in the route config.
+type configDuration time.Duration
+
+func (cD *configDuration) UnmarshalJSON(data []byte) error {
+	var value string
+
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("durations must be strings like \"90s\": %s", err)
+	}
+
+	duration, err := time.ParseDuration(value)
+
+	if err != nil {
+		return err
+	}
+
+	*cD = configDuration(duration)
+
+	return nil
+}
+
+func (cD configDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(cD).String())
+}
+
+type routeConfig struct {
+	Rules       []*routeRule        `json:"routes"`
+	Passthrough []*passthroughRoute `json:"passthrough"`
+
+	// files the rules read, so the store notices when a referenced CA or key changes
+	files []string
+}
+
+func parseRouteConfig(data []byte) (*routeConfig, error) {
+	rC := &routeConfig{}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(rC); err != nil {
+		return nil, err
+	}
+
+	var errs []string
+
+	for i, rule := range rC.Rules {
+		if rule == nil {
+			errs = append(errs, fmt.Sprintf("routes[%d]: empty rule", i))
+
+			continue
+		}
+
+		if rule.Upstream != nil {
+			files, err := rule.Upstream.build()
+
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("routes[%d].upstream: %s", i, err))
+			}
+
+			rC.files = append(rC.files, files...)
+		}
+
+		if rule.Access != nil {
+			files, err := rule.Access.build()
+
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("routes[%d].access: %s", i, err))
+			}
+
+			rC.files = append(rC.files, files...)
+		}
+
+		if rule.RateLimit != nil {
+			if err := rule.RateLimit.validate(); err != nil {
+				errs = append(errs, fmt.Sprintf("routes[%d].rateLimit: %s", i, err))
+			}
+		}
+
+		if rule.Concurrency != nil {
+			if err := rule.Concurrency.validate(); err != nil {
+				errs = append(errs, fmt.Sprintf("routes[%d].concurrency: %s", i, err))
+			}
+		}
+
+		if rule.Auth != nil {
+			files, err := rule.Auth.build()
+
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("routes[%d].auth: %s", i, err))
+			}
+
+			rC.files = append(rC.files, files...)
+		}
+
+		if rule.JWT != nil {
+			files, err := rule.JWT.build()
+
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("routes[%d].jwt: %s", i, err))
+			}
+
+			rC.files = append(rC.files, files...)
+		}
+
+		if rule.GRPCWeb != nil {
+			if err := rule.GRPCWeb.validate(); err != nil {
+				errs = append(errs, fmt.Sprintf("routes[%d].grpcWeb: %s", i, err))
+			}
+
+			if err := rC.validateGRPCWebUpstream(rule); err != nil {
+				errs = append(errs, fmt.Sprintf("routes[%d].grpcWeb: %s", i, err))
+			}
+		}
+
+		if rule.CORS != nil {
+			if err := rule.CORS.validate(); err != nil {
+				errs = append(errs, fmt.Sprintf("routes[%d].cors: %s", i, err))
+			}
+		}
+
+		if rule.SecurityHeaders != nil {
+			if err := rule.SecurityHeaders.validate(); err != nil {
+				errs = append(errs, fmt.Sprintf("routes[%d].securityHeaders: %s", i, err))
+			}
+		}
+
+		if rule.Headers != nil {
+			if err := rule.Headers.build(); err != nil {
+				errs = append(errs, fmt.Sprintf("routes[%d].headers: %s", i, err))
+			}
+		}
+
+		if rule.OIDC != nil {
+			files, err := rule.OIDC.build()
+
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("routes[%d].oidc: %s", i, err))
+			}
+
+			rC.files = append(rC.files, files...)
+		}
+	}
+
+	for i, route := range rC.Passthrough {
+		if route == nil {
+			errs = append(errs, fmt.Sprintf("passthrough[%d]: empty route", i))
+		} else if err := route.validate(); err != nil {
+			errs = append(errs, fmt.Sprintf("passthrough[%d]: %s", i, err))
+		}
+	}
+
+	if len(errs) != 0 {
+		return nil, errors.New(strings.Join(errs, "; "))
+	}
+
+	return rC, nil
+}
+
+// validateGRPCWebUpstream checks that every route the grpcWeb rule covers gets an h2 or h2c
+// upstream, looking at the rule's own scope and at its overlap with each upstream rule, as a
+// more specific upstream may take over part of it.
+func (rC *routeConfig) validateGRPCWebUpstream(grpcWebRule *routeRule) error {
+	hasUpstream := func(rule *routeRule) bool { return rule != nil && rule.Upstream != nil }
+
+	scopes := []routeMatch{grpcWebRule.Match}
+
+	for _, rule := range rC.Rules {
+		if rule == nil || rule.Upstream == nil {
+			continue
+		}
+
+		if scope, overlaps := grpcWebRule.Match.intersect(rule.Match); overlaps {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	for _, scope := range scopes {
+		protocol := ""
+
+		if upstreamRule := rC.Lookup(scope.Domain, scope.Project, scope.Route, hasUpstream); upstreamRule != nil {
+			protocol = upstreamRule.Upstream.Protocol
+		}
+
+		if protocol != "h2" && protocol != "h2c" {
+			return fmt.Errorf("upstream.protocol is %q for domain=%q project=%q route=%q, gRPC-Web needs h2 or h2c", protocol, scope.Domain, scope.Project, scope.Route)
+		}
+	}
+
+	return nil
+}
+
+// Lookup finds the most specific rule matching the route for which has is true, the first
+// such rule in the file winning ties.
+func (rC *routeConfig) Lookup(domain, project, route string, has func(*routeRule) bool) *routeRule {
+	if rC == nil {
+		return nil
+	}
+
+	var found *routeRule
+
+	for _, rule := range rC.Rules {
+		if !has(rule) || !rule.Match.matches(domain, project, route) {
+			continue
+		}
+
+		if found == nil || rule.Match.specificity() > found.Match.specificity() {
+			found = rule
+		}
+	}
+
+	return found
+}
+
+// LookupAll finds every rule matching the route for which has is true, least specific first,
+// for sections whose settings are layered rather than taken whole from one rule.
+func (rC *routeConfig) LookupAll(domain, project, route string, has func(*routeRule) bool) []*routeRule {
+	if rC == nil {
+		return nil
+	}
+
+	var found []*routeRule
+
+	for _, rule := range rC.Rules {
+		if has(rule) && rule.Match.matches(domain, project, route) {
+			found = append(found, rule)
+		}
+	}
+
+	sort.SliceStable(found, func(i, j int) bool { return found[i].Match.specificity() < found[j].Match.specificity() })
+
+	return found
+}
+
+func (rC *routeConfig) close() {
+	if rC == nil {
+		return
+	}
+
+	for _, rule := range rC.Rules {
+		if rule.Upstream != nil {
+			rule.Upstream.close()
+		}
+	}
+}
+
+type routeConfigStatus struct {
+	Path      string    `json:"path"`
+	Rules     int       `json:"rules"`
+	LoadedAt  time.Time `json:"loadedAt"`
+	LastError string    `json:"lastError"`
+}
+
+// routeConfigStore holds the router side route settings loaded from a JSON file, reloading them
+// when the file, or a file it references, changes. A file that fails to load keeps the
+// previously loaded settings in place.
+type routeConfigStore struct {
+	path string
+
+	lock      *sync.RWMutex
+	config    *routeConfig
+	signature string
+	loadedAt  time.Time
+	lastError string
+}
+
+// newRouteConfigStore loads the file at path, an empty path giving a store with no rules.
+func newRouteConfigStore(path string) (*routeConfigStore, error) {
+	rCS := &routeConfigStore{path: path, lock: &sync.RWMutex{}, config: &routeConfig{}}
+
+	if path == "" {
+		return rCS, nil
+	}
+
+	if _, err := rCS.Reload(); err != nil {
+		return nil, err
+	}
+
+	return rCS, nil
+}
+
+// Watch polls the file every interval and reloads the settings when it changes.
+func (rCS *routeConfigStore) Watch(interval time.Duration, done <-chan struct{}) {
+	if rCS.path == "" {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		if reloaded, err := rCS.Reload(); err != nil {
+			log.Printf("routeconfig: event=reload_failed path=%s err=%q\n", rCS.path, err)
+		} else if reloaded {
+			log.Printf("routeconfig: event=reloaded path=%s rules=%d\n", rCS.path, len(rCS.Config().Rules))
+		}
+	}
+}
+
+// Reload loads the file if it or a file it references changed since the last load, reporting
+// whether it did.
+func (rCS *routeConfigStore) Reload() (bool, error) {
+	rCS.lock.RLock()
+
+	previous := rCS.config
+
+	unchanged := rCS.signature != "" && fileSignature(append([]string{rCS.path}, previous.files...)) == rCS.signature
+
+	rCS.lock.RUnlock()
+
+	if unchanged {
+		return false, nil
+	}
+
+	data, err := ioutil.ReadFile(rCS.path)
+
+	if err == nil {
+		var config *routeConfig
+
+		if config, err = parseRouteConfig(data); err == nil {
+			rCS.lock.Lock()
+
+			rCS.config = config
+			rCS.signature = fileSignature(append([]string{rCS.path}, config.files...))
+			rCS.loadedAt = time.Now()
+			rCS.lastError = ""
+
+			rCS.lock.Unlock()
+
+			previous.close()
+
+			return true, nil
+		}
+	}
+
+	rCS.lock.Lock()
+
+	defer rCS.lock.Unlock()
+
+	rCS.lastError = err.Error()
+
+	// Don't retry the same broken file on every tick
+	rCS.signature = fileSignature(append([]string{rCS.path}, previous.files...))
+
+	return false, err
+}
+
+func (rCS *routeConfigStore) Config() *routeConfig {
+	rCS.lock.RLock()
+
+	defer rCS.lock.RUnlock()
+
+	return rCS.config
+}
+
+func (rCS *routeConfigStore) Status() routeConfigStatus {
+	rCS.lock.RLock()
+
+	defer rCS.lock.RUnlock()
+
+	return routeConfigStatus{
+		Path:      rCS.path,
+		Rules:     len(rCS.config.Rules),
+		LoadedAt:  rCS.loadedAt,
+		LastError: rCS.lastError,
+	}
+}
+
+// fileSignature summarizes the size and modification time of files, missing files included.
+func fileSignature(files []string) string {
+	var signature strings.Builder
+
+	for _, file := range files {
+		info, err := os.Stat(file)
+
+		if err != nil {
+			fmt.Fprintf(&signature, "%s:missing;", file)
+
+			continue
+		}
+
+		fmt.Fprintf(&signature, "%s:%d:%d;", file, info.Size(), info.ModTime().UnixNano())
+	}
+
+	return signature.String()
+}
+
+// routeSettings finds a route's current settings in the route config, so reloading it takes
+// effect without rebuilding routes.
+type routeSettings struct {
+	configs *routeConfigStore
+
+	domain  string
+	project string
+	route   string
+}
+
+func (rS routeSettings) Lookup(has func(*routeRule) bool) *routeRule {
+	if rS.configs == nil {
+		return nil
+	}
+
+	return rS.configs.Config().Lookup(rS.domain, rS.project, rS.route, has)
+}
+
+func (rS routeSettings) LookupAll(has func(*routeRule) bool) []*routeRule {
+	if rS.configs == nil {
+		return nil
+	}
+
+	return rS.configs.Config().LookupAll(rS.domain, rS.project, rS.route, has)
+}
+
+// routeTransport sends a route's upstream requests through the transport its current upstream
+// settings call for.
+type routeTransport struct {
+	settings routeSettings
+}
+
+func (rT *routeTransport) Upstream() *upstreamPolicy {
+	rule := rT.settings.Lookup(func(rule *routeRule) bool { return rule.Upstream != nil })
+
+	if rule == nil {
+		return nil
+	}
+
+	return rule.Upstream
+}
+
+func (rT *routeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if upstream := rT.Upstream(); upstream != nil && upstream.transport != nil {
+		return upstream.transport.RoundTrip(req)
+	}
+
+	return http.DefaultTransport.RoundTrip(req)
+}
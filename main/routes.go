@@ -0,0 +1,546 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/the-rileyj/uyghurs"
+)
+
+type domainRoutesManager struct {
+	routesMap    map[string]*extendedRouteInfo
+	domainRegexp *regexp.Regexp
+}
+
+var (
+	errRevisionNotFound = errors.New("revision is not in the routing history")
+	errNotPinned        = errors.New("routing table is not pinned")
+)
+
+type routesManager struct {
+	defaultDomain    string
+	defaultRouteInfo *extendedRouteInfo
+	domainRoutesMap  map[string]*domainRoutesManager
+
+	// projectsMap holds the latest routes from uyghurs and liveProjectsMap the ones being
+	// served, the two only differ while the table is pinned to an earlier revision
+	projectsMap     map[string]*uyghurs.ProjectMetadata
+	liveProjectsMap map[string]*uyghurs.ProjectMetadata
+
+	revision       int64
+	pinnedRevision int64
+	history        *routingHistory
+
+	// routeConfig holds the router side settings, such as upstream TLS, looked up per route
+	routeConfig *routeConfigStore
+	websockets  *websocketTracker
+	rateLimits  *rateLimiter
+	concurrency *concurrencyLimiter
+
+	lock *sync.Mutex
+}
+
+type extendedRouteInfo struct {
+	uyghurs.RouteInfo
+	ProjectName         string
+	ReverseProxyHandler gin.HandlerFunc
+}
+
+func newRoutesManager(defaultDomain, defaultHost string, historySize int, routeConfig *routeConfigStore, websockets *websocketTracker, rateLimits *rateLimiter, concurrency *concurrencyLimiter) *routesManager {
+	rM := &routesManager{
+		defaultDomain: defaultDomain,
+		projectsMap:   make(map[string]*uyghurs.ProjectMetadata),
+		history:       newRoutingHistory(historySize),
+		routeConfig:   routeConfig,
+		websockets:    websockets,
+		rateLimits:    rateLimits,
+		concurrency:   concurrency,
+		lock:          &sync.Mutex{},
+	}
+
+	defaultHostURL, err := url.Parse(defaultHost)
+
+	if err != nil {
+		panic(err)
+	}
+
+	rM.defaultRouteInfo = &extendedRouteInfo{
+		RouteInfo: uyghurs.RouteInfo{
+			Domain:      defaultDomain,
+			ForwardHost: defaultHost,
+			Route:       "/",
+		},
+		ReverseProxyHandler: rM.newProxyHandler(defaultHost, defaultHostURL, defaultDomain, "", "/"),
+	}
+
+	if err := rM.apply(rM.projectsMap, routingChange{Source: "startup"}, ""); err != nil {
+		panic(err)
+	}
+
+	return rM
+}
+
+func (rM *routesManager) GetDefaultRouteInfo() *extendedRouteInfo {
+	rM.lock.Lock()
+
+	defer rM.lock.Unlock()
+
+	domainRoutesManager, exists := rM.domainRoutesMap[rM.defaultDomain]
+
+	if !exists {
+		log.Fatal("NO DEFAULT ROUTE FOR DEFAULT DOMAIN")
+	}
+
+	routeInfo, exists := domainRoutesManager.routesMap["/"]
+
+	if !exists {
+		log.Fatal("NO DEFAULT ROUTE for '/'")
+	}
+
+	return routeInfo
+}
+
+func (rM *routesManager) GetRouteInfo(domain, route string) (*extendedRouteInfo, bool) {
+	rM.lock.Lock()
+
+	defer rM.lock.Unlock()
+
+	if domain == rM.defaultDomain {
+		domainRoutesManager, exists := rM.domainRoutesMap[domain]
+
+		if !exists {
+			return nil, false
+		}
+
+		var foundRouteInfo *extendedRouteInfo
+		exists = false
+
+		for routePrefix, routeInfo := range domainRoutesManager.routesMap {
+			if strings.HasPrefix(route, routePrefix) {
+				if foundRouteInfo != nil {
+					if len(foundRouteInfo.Route) < len(routePrefix) {
+						foundRouteInfo = routeInfo
+					}
+				} else {
+					foundRouteInfo = routeInfo
+					exists = true
+				}
+			}
+		}
+
+		return foundRouteInfo, exists
+	}
+
+	for _, domainRoutesManager := range rM.domainRoutesMap {
+		if domainRoutesManager.domainRegexp != nil && domainRoutesManager.domainRegexp.MatchString(domain) {
+			var foundRouteInfo *extendedRouteInfo
+			exists := false
+
+			for routePrefix, routeInfo := range domainRoutesManager.routesMap {
+				if strings.HasPrefix(route, routePrefix) {
+					if foundRouteInfo != nil {
+						if len(foundRouteInfo.Route) < len(routePrefix) {
+							foundRouteInfo = routeInfo
+						}
+					} else {
+						foundRouteInfo = routeInfo
+						exists = true
+					}
+				}
+			}
+
+			if !exists {
+				// Fallback to default route for domain
+				foundRouteInfo, exists = domainRoutesManager.routesMap["/"]
+			}
+
+			return foundRouteInfo, exists
+		}
+	}
+
+	return nil, false
+}
+
+// IsRoutedHost reports whether host is the default domain or named literally by a routed
+// domain, as opposed to only matching a domain pattern.
+func (rM *routesManager) IsRoutedHost(host string) bool {
+	rM.lock.Lock()
+
+	defer rM.lock.Unlock()
+
+	if strings.EqualFold(host, rM.defaultDomain) {
+		return true
+	}
+
+	for domain := range rM.domainRoutesMap {
+		if literalDomain, isLiteral := literalDomainPattern(domain); isLiteral && strings.EqualFold(host, literalDomain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// literalDomainPattern returns the host a domain pattern spells out, treating unescaped
+// dots as the literal dots they almost always are meant to be.
+func literalDomainPattern(domain string) (string, bool) {
+	domain = strings.TrimSuffix(strings.TrimPrefix(domain, "^"), "$")
+
+	literal := strings.Replace(domain, `\.`, ".", -1)
+
+	if strings.IndexFunc(literal, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '.')
+	}) != -1 {
+		return "", false
+	}
+
+	return literal, literal != ""
+}
+
+// UpdateProjectRoutes validates the project's routes against the latest routing table
+// and, only if every route is valid, swaps in a table rebuilt with the project's new routes.
+// On failure the live table is left untouched and the validation errors are returned.
+// While the table is pinned valid updates are kept for when it is released, and applied
+// reports false.
+func (rM *routesManager) UpdateProjectRoutes(projectMetadata *uyghurs.ProjectMetadata, change routingChange) (bool, error) {
+	rM.lock.Lock()
+
+	defer rM.lock.Unlock()
+
+	if err := validateProjectMetadata(projectMetadata, rM.projectsMap, rM.defaultDomain); err != nil {
+		return false, err
+	}
+
+	projectsMap := make(map[string]*uyghurs.ProjectMetadata, len(rM.projectsMap)+1)
+
+	for projectName, currentProjectMetadata := range rM.projectsMap {
+		projectsMap[projectName] = currentProjectMetadata
+	}
+
+	projectsMap[projectMetadata.ProjectName] = projectMetadata
+
+	if rM.pinnedRevision != 0 {
+		rM.projectsMap = projectsMap
+
+		return false, nil
+	}
+
+	if err := rM.apply(projectsMap, change, projectMetadata.ProjectName); err != nil {
+		return false, err
+	}
+
+	rM.projectsMap = projectsMap
+
+	return true, nil
+}
+
+// Rollback serves the routing table of an earlier revision again and pins it there,
+// holding back updates from uyghurs until Release is called. It returns the new revision.
+func (rM *routesManager) Rollback(revision int64) (int64, error) {
+	rM.lock.Lock()
+
+	defer rM.lock.Unlock()
+
+	entry, exists := rM.history.Get(revision)
+
+	if !exists {
+		return 0, errRevisionNotFound
+	}
+
+	if err := rM.apply(entry.projectsMap, routingChange{Source: fmt.Sprintf("rollback to %d", revision)}, ""); err != nil {
+		return 0, err
+	}
+
+	rM.pinnedRevision = revision
+
+	return rM.revision, nil
+}
+
+// Release unpins the routing table, bringing it up to date with the latest routes
+// received from uyghurs. It returns the new revision.
+func (rM *routesManager) Release() (int64, error) {
+	rM.lock.Lock()
+
+	defer rM.lock.Unlock()
+
+	if rM.pinnedRevision == 0 {
+		return 0, errNotPinned
+	}
+
+	if err := rM.apply(rM.projectsMap, routingChange{Source: "release"}, ""); err != nil {
+		return 0, err
+	}
+
+	rM.pinnedRevision = 0
+
+	return rM.revision, nil
+}
+
+// Revisions returns the live revision and the revision the table is pinned to, if any.
+func (rM *routesManager) Revisions() (int64, int64) {
+	rM.lock.Lock()
+
+	defer rM.lock.Unlock()
+
+	return rM.revision, rM.pinnedRevision
+}
+
+func (rM *routesManager) History() []routingHistoryEntry {
+	rM.lock.Lock()
+
+	defer rM.lock.Unlock()
+
+	return rM.history.Entries()
+}
+
+// HistoryEntry returns a recorded revision along with the projects that were routed in it.
+func (rM *routesManager) HistoryEntry(revision int64) (routingHistoryEntry, map[string]*uyghurs.ProjectMetadata, error) {
+	rM.lock.Lock()
+
+	defer rM.lock.Unlock()
+
+	entry, exists := rM.history.Get(revision)
+
+	if !exists {
+		return routingHistoryEntry{}, nil, errRevisionNotFound
+	}
+
+	return *entry, entry.projectsMap, nil
+}
+
+func (rM *routesManager) Diff(fromRevision, toRevision int64) ([]routeDiff, error) {
+	rM.lock.Lock()
+
+	defer rM.lock.Unlock()
+
+	fromEntry, fromExists := rM.history.Get(fromRevision)
+	toEntry, toExists := rM.history.Get(toRevision)
+
+	if !fromExists || !toExists {
+		return nil, errRevisionNotFound
+	}
+
+	return diffRoutes(fromEntry.projectsMap, toEntry.projectsMap, rM.defaultDomain), nil
+}
+
+// apply makes projectsMap the live routing table and records it as a new revision.
+// Callers must hold the lock.
+func (rM *routesManager) apply(projectsMap map[string]*uyghurs.ProjectMetadata, change routingChange, projectName string) error {
+	domainRoutesMap, err := rM.buildDomainRoutes(projectsMap)
+
+	if err != nil {
+		return err
+	}
+
+	rM.domainRoutesMap = domainRoutesMap
+	rM.liveProjectsMap = projectsMap
+	rM.revision++
+
+	rM.history.Add(&routingHistoryEntry{
+		Revision:        rM.revision,
+		Source:          change.Source,
+		Project:         projectName,
+		Timestamp:       time.Now(),
+		UyghursRevision: change.UyghursRevision,
+		Commit:          change.Commit,
+		projectsMap:     projectsMap,
+	})
+
+	if rM.websockets != nil {
+		go rM.websockets.DrainStale(rM.ServesRoute)
+	}
+
+	return nil
+}
+
+// ServesRoute reports whether the live routing table still sends domain and route to
+// projectName's forwardHost.
+func (rM *routesManager) ServesRoute(domain, projectName, route, forwardHost string) bool {
+	rM.lock.Lock()
+
+	defer rM.lock.Unlock()
+
+	domainRoutesManager, exists := rM.domainRoutesMap[domain]
+
+	if !exists {
+		return false
+	}
+
+	routeInfo, exists := domainRoutesManager.routesMap[route]
+
+	return exists && routeInfo.ProjectName == projectName && routeInfo.ForwardHost == forwardHost
+}
+
+// buildDomainRoutes builds a complete routing table from the default route plus the routes
+// of every project, in project name order so the result doesn't depend on map iteration.
+func (rM *routesManager) buildDomainRoutes(projectsMap map[string]*uyghurs.ProjectMetadata) (map[string]*domainRoutesManager, error) {
+	domainRoutesMap := map[string]*domainRoutesManager{
+		rM.defaultDomain: {
+			routesMap:    map[string]*extendedRouteInfo{"/": rM.defaultRouteInfo},
+			domainRegexp: nil,
+		},
+	}
+
+	projectNames := make([]string, 0, len(projectsMap))
+
+	for projectName := range projectsMap {
+		projectNames = append(projectNames, projectName)
+	}
+
+	sort.Strings(projectNames)
+
+	for _, projectName := range projectNames {
+		for _, routeInfo := range projectsMap[projectName].ProjectRoutes {
+			domain := routeInfo.Domain
+
+			if domain == "" {
+				domain = rM.defaultDomain
+			}
+
+			domainRoutesMan, exists := domainRoutesMap[domain]
+
+			if !exists {
+				domainRegexp, err := regexp.Compile(domain)
+
+				if err != nil {
+					return nil, fmt.Errorf("failed to compile domain %q of project %s: %s", domain, projectName, err)
+				}
+
+				domainRoutesMan = &domainRoutesManager{
+					routesMap:    make(map[string]*extendedRouteInfo),
+					domainRegexp: domainRegexp,
+				}
+
+				domainRoutesMap[domain] = domainRoutesMan
+			}
+
+			newRouteHostURL, err := url.Parse(routeInfo.ForwardHost)
+
+			if err != nil {
+				return nil, fmt.Errorf("failed to add new route %s: %s", domain+routeInfo.Route, err)
+			}
+
+			domainRoutesMan.routesMap[routeInfo.Route] = &extendedRouteInfo{
+				RouteInfo:           *routeInfo,
+				ProjectName:         projectName,
+				ReverseProxyHandler: rM.newProxyHandler(routeInfo.ForwardHost, newRouteHostURL, domain, projectName, routeInfo.Route),
+			}
+		}
+	}
+
+	return domainRoutesMap, nil
+}
+
+// newProxyHandler proxies to target, the parsed forwardHost, through the transport the route
+// config currently sets for the route. gRPC calls are held to their deadlines and answered with
+// gRPC statuses when the upstream fails, and websockets go through the websocket tracker.
+// The route's security headers are set first so every answer carries them, then clients the
+// route's access policy denies are turned away, then requests over the route's rate limit. CORS
+// preflights are answered next, as they carry no credentials, then requests the route's OIDC,
+// auth and JWT policies don't let in are turned away. The route's header rules are applied to
+// the requests let through, and those other than websockets then wait for a slot under the
+// route's concurrency limit.
+func (rM *routesManager) newProxyHandler(forwardHost string, target *url.URL, domain, projectName, route string) gin.HandlerFunc {
+	reverseProxy := httputil.NewSingleHostReverseProxy(target)
+
+	settings := routeSettings{configs: rM.routeConfig, domain: domain, project: projectName, route: route}
+
+	reverseProxy.ErrorHandler = proxyErrorHandler
+	reverseProxy.ModifyResponse = func(resp *http.Response) error {
+		if err := grpcModifyResponse(resp); err != nil {
+			return err
+		}
+
+		if err := grpcWebModifyResponse(resp); err != nil {
+			return err
+		}
+
+		if err := corsModifyResponse(resp); err != nil {
+			return err
+		}
+
+		if err := securityHeadersModifyResponse(resp); err != nil {
+			return err
+		}
+
+		return headerRulesModifyResponse(resp)
+	}
+
+	if rM.routeConfig != nil {
+		reverseProxy.Transport = &routeTransport{settings: settings}
+	}
+
+	return func(c *gin.Context) {
+		if rules := settings.LookupAll(func(rule *routeRule) bool { return rule.SecurityHeaders != nil }); len(rules) != 0 {
+			mergeSecurityHeaders(appliedSecurityHeaders(c), rules).Apply(c)
+		}
+
+		if rule := settings.Lookup(func(rule *routeRule) bool { return rule.Access != nil }); rule != nil && rule.Access.Check(c, settings) {
+			return
+		}
+
+		if rule := settings.Lookup(func(rule *routeRule) bool { return rule.RateLimit != nil }); rule != nil && rM.rateLimits != nil && rM.rateLimits.Check(c, settings, rule.RateLimit) {
+			return
+		}
+
+		if rule := settings.Lookup(func(rule *routeRule) bool { return rule.CORS != nil }); rule != nil && rule.CORS.Handle(c) {
+			return
+		}
+
+		if rule := settings.Lookup(func(rule *routeRule) bool { return rule.GRPCWeb != nil }); rule != nil && rule.GRPCWeb.Handle(c) {
+			return
+		}
+
+		// After CORS and gRPC-Web, whose preflights carry no credentials
+		if rule := settings.Lookup(func(rule *routeRule) bool { return rule.OIDC != nil }); rule != nil && rule.OIDC.Check(c, settings) {
+			return
+		}
+
+		if rule := settings.Lookup(func(rule *routeRule) bool { return rule.Auth != nil }); rule != nil && rule.Auth.Check(c, settings) {
+			return
+		}
+
+		if rule := settings.Lookup(func(rule *routeRule) bool { return rule.JWT != nil }); rule != nil && rule.JWT.Check(c, settings) {
+			return
+		}
+
+		if rules := settings.LookupAll(func(rule *routeRule) bool { return rule.Headers != nil }); len(rules) != 0 {
+			applyHeaderRules(c, settings, rules)
+		}
+
+		if rM.websockets != nil && c.IsWebsocket() {
+			rM.websockets.Proxy(c, reverseProxy, settings, forwardHost)
+
+			return
+		}
+
+		request, cancel := withGRPCDeadline(c.Request)
+
+		defer cancel()
+
+		// Queueing counts against gRPC deadlines, so it comes after them
+		if rule := settings.Lookup(func(rule *routeRule) bool { return rule.Concurrency != nil }); rule != nil && rM.concurrency != nil {
+			release := rM.concurrency.Check(c, request, settings, forwardHost, rule.Concurrency)
+
+			if release == nil {
+				return
+			}
+
+			defer release()
+		}
+
+		request = request.WithContext(withProxyProtocolAddrs(request.Context(), request))
+
+		reverseProxy.ServeHTTP(c.Writer, request)
+	}
+}
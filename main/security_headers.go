@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+type securityHeadersContextKey struct{}
+
+// securityHeadersPolicy sets security headers on a route's responses. Unlike other sections it
+// is layered, so a domain rule can set headers for all of its routes and a project or route rule
+// only changes the ones it names, "off" removing one. Headers the upstream sends itself win
+// unless Enforce is set. Strict-Transport-Security is only sent over TLS, the -hsts flags
+// setting it below every rule.
+type securityHeadersPolicy struct {
+	StrictTransportSecurity         string `json:"strictTransportSecurity,omitempty"`
+	ContentSecurityPolicy           string `json:"contentSecurityPolicy,omitempty"`
+	ContentSecurityPolicyReportOnly string `json:"contentSecurityPolicyReportOnly,omitempty"`
+	FrameOptions                    string `json:"frameOptions,omitempty"`
+	ReferrerPolicy                  string `json:"referrerPolicy,omitempty"`
+	PermissionsPolicy               string `json:"permissionsPolicy,omitempty"`
+	ContentTypeOptions              string `json:"contentTypeOptions,omitempty"`
+	Enforce                         *bool  `json:"enforce,omitempty"`
+}
+
+// headers pairs every header the policy can set with its value.
+func (sHP *securityHeadersPolicy) headers() [][2]string {
+	return [][2]string{
+		{"Strict-Transport-Security", sHP.StrictTransportSecurity},
+		{"Content-Security-Policy", sHP.ContentSecurityPolicy},
+		{"Content-Security-Policy-Report-Only", sHP.ContentSecurityPolicyReportOnly},
+		{"X-Frame-Options", sHP.FrameOptions},
+		{"Referrer-Policy", sHP.ReferrerPolicy},
+		{"Permissions-Policy", sHP.PermissionsPolicy},
+		{"X-Content-Type-Options", sHP.ContentTypeOptions},
+	}
+}
+
+func (sHP *securityHeadersPolicy) validate() error {
+	for _, header := range sHP.headers() {
+		if strings.ContainsAny(header[1], "\r\n") {
+			return fmt.Errorf("%s has a line break", header[0])
+		}
+	}
+
+	if sHP.StrictTransportSecurity != "" && !securityHeaderOff(sHP.StrictTransportSecurity) && !strings.HasPrefix(strings.ToLower(sHP.StrictTransportSecurity), "max-age=") {
+		return errors.New("strictTransportSecurity must start with max-age=")
+	}
+
+	switch strings.ToUpper(sHP.FrameOptions) {
+	case "", "OFF", "DENY", "SAMEORIGIN":
+	default:
+		return fmt.Errorf("unknown frameOptions %q, expected DENY, SAMEORIGIN or off", sHP.FrameOptions)
+	}
+
+	if sHP.ContentTypeOptions != "" && !securityHeaderOff(sHP.ContentTypeOptions) && !strings.EqualFold(sHP.ContentTypeOptions, "nosniff") {
+		return fmt.Errorf("unknown contentTypeOptions %q, expected nosniff or off", sHP.ContentTypeOptions)
+	}
+
+	return nil
+}
+
+// securityHeaderOff reports whether a policy value asks for the header to be removed, in any
+// case as validate accepts.
+func securityHeaderOff(value string) bool {
+	return strings.EqualFold(value, "off")
+}
+
+// mergeSecurityHeaders layers the policies of the rules, least specific first, over base, the
+// policy already applied to the request, if any.
+func mergeSecurityHeaders(base *securityHeadersPolicy, rules []*routeRule) *securityHeadersPolicy {
+	merged := &securityHeadersPolicy{}
+
+	if base != nil {
+		*merged = *base
+	}
+
+	for _, rule := range rules {
+		policy := rule.SecurityHeaders
+
+		for _, field := range []struct {
+			value  string
+			merged *string
+		}{
+			{policy.StrictTransportSecurity, &merged.StrictTransportSecurity},
+			{policy.ContentSecurityPolicy, &merged.ContentSecurityPolicy},
+			{policy.ContentSecurityPolicyReportOnly, &merged.ContentSecurityPolicyReportOnly},
+			{policy.FrameOptions, &merged.FrameOptions},
+			{policy.ReferrerPolicy, &merged.ReferrerPolicy},
+			{policy.PermissionsPolicy, &merged.PermissionsPolicy},
+			{policy.ContentTypeOptions, &merged.ContentTypeOptions},
+		} {
+			if field.value != "" {
+				*field.merged = field.value
+			}
+		}
+
+		if policy.Enforce != nil {
+			merged.Enforce = policy.Enforce
+		}
+	}
+
+	return merged
+}
+
+// securityHeadersState is what the response needs from the request to let the upstream's
+// headers win or lose against the router's.
+type securityHeadersState struct {
+	policy *securityHeadersPolicy
+	header http.Header
+}
+
+// Apply sets the policy's headers on the response before anything else can answer the request,
+// so the router's own denials carry them too.
+func (sHP *securityHeadersPolicy) Apply(c *gin.Context) {
+	header := c.Writer.Header()
+
+	for _, pair := range sHP.headers() {
+		name, value := pair[0], pair[1]
+
+		if value == "" {
+			continue
+		}
+
+		if securityHeaderOff(value) || (name == "Strict-Transport-Security" && c.Request.TLS == nil) {
+			header.Del(name)
+
+			continue
+		}
+
+		header.Set(name, value)
+	}
+
+	state := &securityHeadersState{policy: sHP, header: header}
+
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), securityHeadersContextKey{}, state))
+}
+
+// appliedSecurityHeaders is the policy Apply last set on the request, nil if none was.
+func appliedSecurityHeaders(c *gin.Context) *securityHeadersPolicy {
+	if state, _ := c.Request.Context().Value(securityHeadersContextKey{}).(*securityHeadersState); state != nil {
+		return state.policy
+	}
+
+	return nil
+}
+
+// securityHeadersModifyResponse keeps one of each security header, the upstream's unless the
+// route enforces the router's.
+func securityHeadersModifyResponse(resp *http.Response) error {
+	if resp.Request == nil {
+		return nil
+	}
+
+	state, _ := resp.Request.Context().Value(securityHeadersContextKey{}).(*securityHeadersState)
+
+	if state == nil {
+		return nil
+	}
+
+	enforce := state.policy.Enforce != nil && *state.policy.Enforce
+
+	for _, pair := range state.policy.headers() {
+		name := pair[0]
+
+		if pair[1] == "" || resp.Header.Get(name) == "" {
+			continue
+		}
+
+		if enforce {
+			resp.Header.Del(name)
+		} else {
+			state.header.Del(name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newRouteConfigTestServer proxies routes on example.com, matched by prefix, to an upstream
+// answering with upstreamHeader, under the route config in config.
+func newRouteConfigTestServer(t *testing.T, config string, upstreamHeader http.Header, routes []string, useTLS bool, middleware ...gin.HandlerFunc) *httptest.Server {
+	gin.SetMode(gin.TestMode)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, values := range upstreamHeader {
+			w.Header()[name] = values
+		}
+
+		w.Write([]byte("upstream"))
+	}))
+
+	t.Cleanup(upstream.Close)
+
+	configPath := filepath.Join(t.TempDir(), "routes.json")
+
+	if err := ioutil.WriteFile(configPath, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	routeConfig, err := newRouteConfigStore(configPath)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target, _ := url.Parse(upstream.URL)
+
+	rM := &routesManager{routeConfig: routeConfig}
+
+	handlers := make(map[string]gin.HandlerFunc)
+
+	for _, route := range routes {
+		handlers[route] = rM.newProxyHandler(upstream.URL, target, "example.com", "site", route)
+	}
+
+	router := gin.New()
+
+	router.Use(middleware...)
+
+	router.NoRoute(func(c *gin.Context) {
+		matched := ""
+
+		for route := range handlers {
+			if strings.HasPrefix(c.Request.URL.Path, route) && len(route) > len(matched) {
+				matched = route
+			}
+		}
+
+		handlers[matched](c)
+	})
+
+	server := httptest.NewUnstartedServer(router)
+
+	if useTLS {
+		server.StartTLS()
+	} else {
+		server.Start()
+	}
+
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func assertResponseHeaders(t *testing.T, client *http.Client, target string, want map[string][]string) {
+	t.Helper()
+
+	resp, err := client.Get(target)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+
+	for name, values := range want {
+		if got := resp.Header.Values(name); strings.Join(got, "|") != strings.Join(values, "|") {
+			t.Errorf("%s %s: got %q, want %q", target, name, got, values)
+		}
+	}
+}
+
+func TestSecurityHeadersLayering(t *testing.T) {
+	server := newRouteConfigTestServer(t, `{"routes": [
+		{"match": {"domain": "example.com"}, "securityHeaders": {"contentSecurityPolicy": "default-src 'self'", "frameOptions": "DENY", "referrerPolicy": "no-referrer", "contentTypeOptions": "nosniff"}},
+		{"match": {"project": "site"}, "securityHeaders": {"frameOptions": "SAMEORIGIN", "referrerPolicy": "Off"}},
+		{"match": {"route": "/admin"}, "securityHeaders": {"contentSecurityPolicy": "default-src 'none'", "contentTypeOptions": "OFF"}}
+	]}`, nil, []string{"/", "/admin"}, false)
+
+	assertResponseHeaders(t, server.Client(), server.URL+"/", map[string][]string{
+		"Content-Security-Policy": {"default-src 'self'"},
+		"X-Frame-Options":         {"SAMEORIGIN"},
+		"Referrer-Policy":         nil,
+		"X-Content-Type-Options":  {"nosniff"},
+	})
+
+	assertResponseHeaders(t, server.Client(), server.URL+"/admin", map[string][]string{
+		"Content-Security-Policy": {"default-src 'none'"},
+		"X-Frame-Options":         {"SAMEORIGIN"},
+		"Referrer-Policy":         nil,
+		"X-Content-Type-Options":  nil,
+	})
+}
+
+func TestSecurityHeadersEnforce(t *testing.T) {
+	upstreamHeader := http.Header{
+		"X-Frame-Options":         {"SAMEORIGIN"},
+		"Content-Security-Policy": {"default-src *"},
+		"Referrer-Policy":         {"unsafe-url"},
+	}
+
+	server := newRouteConfigTestServer(t, `{"routes": [
+		{"match": {"domain": "example.com"}, "securityHeaders": {"contentSecurityPolicy": "default-src 'self'", "frameOptions": "DENY", "permissionsPolicy": "camera=()", "referrerPolicy": "off"}},
+		{"match": {"route": "/enforced"}, "securityHeaders": {"enforce": true}}
+	]}`, upstreamHeader, []string{"/", "/enforced"}, false)
+
+	// The upstream's own headers win, and the router only fills in the rest
+	assertResponseHeaders(t, server.Client(), server.URL+"/", map[string][]string{
+		"Content-Security-Policy": {"default-src *"},
+		"X-Frame-Options":         {"SAMEORIGIN"},
+		"Permissions-Policy":      {"camera=()"},
+		"Referrer-Policy":         {"unsafe-url"},
+	})
+
+	assertResponseHeaders(t, server.Client(), server.URL+"/enforced", map[string][]string{
+		"Content-Security-Policy": {"default-src 'self'"},
+		"X-Frame-Options":         {"DENY"},
+		"Permissions-Policy":      {"camera=()"},
+		"Referrer-Policy":         nil,
+	})
+}
+
+func TestSecurityHeadersHSTSOnlyOverTLS(t *testing.T) {
+	config := `{"routes": [{"match": {"domain": "example.com"}, "securityHeaders": {"strictTransportSecurity": "max-age=600"}}]}`
+
+	for _, useTLS := range []bool{false, true} {
+		server := newRouteConfigTestServer(t, config, nil, []string{"/"}, useTLS)
+
+		var want []string
+
+		if useTLS {
+			want = []string{"max-age=600"}
+		}
+
+		assertResponseHeaders(t, server.Client(), server.URL+"/", map[string][]string{"Strict-Transport-Security": want})
+	}
+}
+
+func TestSecurityHeadersOverHSTSFlags(t *testing.T) {
+	hsts := hstsMiddleware(time.Hour, true, false)
+
+	flagValue := []string{"max-age=3600; includeSubDomains"}
+
+	server := newRouteConfigTestServer(t, `{"routes": [
+		{"match": {"route": "/custom"}, "securityHeaders": {"strictTransportSecurity": "max-age=60"}},
+		{"match": {"route": "/off"}, "securityHeaders": {"strictTransportSecurity": "off"}},
+		{"match": {"route": "/framed"}, "securityHeaders": {"frameOptions": "DENY"}}
+	]}`, nil, []string{"/", "/custom", "/off", "/framed"}, true, hsts)
+
+	for route, want := range map[string][]string{
+		"/":       flagValue,
+		"/custom": {"max-age=60"},
+		"/off":    nil,
+		"/framed": flagValue,
+	} {
+		assertResponseHeaders(t, server.Client(), server.URL+route, map[string][]string{"Strict-Transport-Security": want})
+	}
+
+	server = newRouteConfigTestServer(t, `{"routes": [
+		{"match": {"route": "/enforced"}, "securityHeaders": {"enforce": true}}
+	]}`, http.Header{"Strict-Transport-Security": {"max-age=1"}}, []string{"/", "/enforced"}, true, hsts)
+
+	// One header either way, the upstream's unless the route enforces the router's
+	assertResponseHeaders(t, server.Client(), server.URL+"/", map[string][]string{"Strict-Transport-Security": {"max-age=1"}})
+	assertResponseHeaders(t, server.Client(), server.URL+"/enforced", map[string][]string{"Strict-Transport-Security": flagValue})
+
+	server = newRouteConfigTestServer(t, `{"routes": []}`, nil, []string{"/"}, false, hsts)
+
+	assertResponseHeaders(t, server.Client(), server.URL+"/", map[string][]string{"Strict-Transport-Security": nil})
+}
+
+func TestSecurityHeadersPolicyValidate(t *testing.T) {
+	for _, test := range []struct {
+		policy securityHeadersPolicy
+		valid  bool
+	}{
+		{securityHeadersPolicy{StrictTransportSecurity: "max-age=31536000; includeSubDomains"}, true},
+		{securityHeadersPolicy{StrictTransportSecurity: "Off"}, true},
+		{securityHeadersPolicy{StrictTransportSecurity: "includeSubDomains"}, false},
+		{securityHeadersPolicy{FrameOptions: "sameorigin"}, true},
+		{securityHeadersPolicy{FrameOptions: "ALLOW-FROM https://example.com"}, false},
+		{securityHeadersPolicy{ContentTypeOptions: "OFF"}, true},
+		{securityHeadersPolicy{ContentTypeOptions: "sniff"}, false},
+		{securityHeadersPolicy{ContentSecurityPolicy: "default-src 'self'\r\nX-Injected: 1"}, false},
+	} {
+		if err := test.policy.validate(); (err == nil) != test.valid {
+			t.Errorf("%+v: got %v, want valid %t", test.policy, err, test.valid)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// shutdownOnSignal waits for SIGINT or SIGTERM, then closes websockets with a close frame and
+// gracefully shuts the servers down, giving both timeout. The returned channel is closed once
+// everything has stopped.
+func shutdownOnSignal(websockets *websocketTracker, timeout time.Duration, servers ...*http.Server) <-chan struct{} {
+	stopped := make(chan struct{})
+
+	signals := make(chan os.Signal, 1)
+
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		defer close(stopped)
+
+		received := <-signals
+
+		log.Printf("Shutting down on %s\n", received)
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+
+		defer cancel()
+
+		// Hijacked websocket connections are invisible to Shutdown, so drain them alongside it
+		drained := make(chan struct{})
+
+		go func() {
+			websockets.DrainAll(ctx, "server shutting down")
+
+			close(drained)
+		}()
+
+		for _, server := range servers {
+			if err := server.Shutdown(ctx); err != nil {
+				log.Printf("Error shutting down %s: %s\n", server.Addr, err)
+			}
+		}
+
+		<-drained
+	}()
+
+	return stopped
+}
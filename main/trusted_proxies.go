@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Context keys holding the client IP recovered from trusted proxy headers and the address of
+// the peer that actually connected to the router.
+const (
+	clientIPKey = "clientIP"
+	peerAddrKey = "peerAddr"
+)
+
+// trustedProxies is a CIDR list, such as Cloudflare's published ranges, loaded from a file with
+// one range or address per line and "#" comments, reloaded when the file changes.
+type trustedProxies struct {
+	path string
+
+	lock     *sync.RWMutex
+	networks []*net.IPNet
+	modTime  time.Time
+}
+
+func newTrustedProxies(path string) (*trustedProxies, error) {
+	tP := &trustedProxies{path: path, lock: &sync.RWMutex{}}
+
+	if _, err := tP.Reload(); err != nil {
+		return nil, err
+	}
+
+	return tP, nil
+}
+
+// Watch polls the file every interval and reloads the ranges when it changes.
+func (tP *trustedProxies) Watch(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		if reloaded, err := tP.Reload(); err != nil {
+			log.Printf("trustedproxies: event=reload_failed path=%s err=%q\n", tP.path, err)
+		} else if reloaded {
+			log.Printf("trustedproxies: event=reloaded path=%s ranges=%d\n", tP.path, len(tP.Networks()))
+		}
+	}
+}
+
+// Reload reads the file if it changed since the last load, reporting whether it did. A file
+// that fails to parse keeps the previously loaded ranges.
+func (tP *trustedProxies) Reload() (bool, error) {
+	info, err := os.Stat(tP.path)
+
+	if err != nil {
+		return false, err
+	}
+
+	tP.lock.RLock()
+
+	unchanged := info.ModTime().Equal(tP.modTime)
+
+	tP.lock.RUnlock()
+
+	if unchanged {
+		return false, nil
+	}
+
+	networks, err := readNetworksFile(tP.path)
+
+	if err != nil {
+		return false, err
+	}
+
+	tP.lock.Lock()
+
+	defer tP.lock.Unlock()
+
+	tP.networks = networks
+	tP.modTime = info.ModTime()
+
+	return true, nil
+}
+
+func (tP *trustedProxies) Networks() []*net.IPNet {
+	tP.lock.RLock()
+
+	defer tP.lock.RUnlock()
+
+	return tP.networks
+}
+
+func (tP *trustedProxies) Contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range tP.Networks() {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ClientIP recovers the client's address for a request from peer. Only trusted peers get their
+// CF-Connecting-IP or X-Forwarded-For believed, and X-Forwarded-For is walked from the right so
+// a client can't prepend an address of its choosing.
+func (tP *trustedProxies) ClientIP(peer net.IP, header http.Header) net.IP {
+	if !tP.Contains(peer) {
+		return peer
+	}
+
+	if connectingIP := net.ParseIP(strings.TrimSpace(header.Get("CF-Connecting-IP"))); connectingIP != nil {
+		return connectingIP
+	}
+
+	clientIP := peer
+
+	var forwardedFor []string
+
+	for _, value := range header["X-Forwarded-For"] {
+		forwardedFor = append(forwardedFor, strings.Split(value, ",")...)
+	}
+
+	for i := len(forwardedFor) - 1; i >= 0; i-- {
+		forwardedIP := net.ParseIP(strings.TrimSpace(forwardedFor[i]))
+
+		if forwardedIP == nil {
+			break
+		}
+
+		clientIP = forwardedIP
+
+		if !tP.Contains(forwardedIP) {
+			break
+		}
+	}
+
+	return clientIP
+}
+
+// Middleware stores the client and peer addresses in the context and rewrites the request so
+// upstreams, logs and anything using c.ClientIP see the recovered client IP. With rejectUntrusted,
+// requests from peers outside the ranges get a 403.
+func (tP *trustedProxies) Middleware(rejectUntrusted bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		peerAddr := c.Request.RemoteAddr
+
+		peerHost, peerPort, err := net.SplitHostPort(peerAddr)
+
+		if err != nil {
+			peerHost = peerAddr
+		}
+
+		peer := net.ParseIP(peerHost)
+
+		trusted := tP.Contains(peer)
+
+		if rejectUntrusted && !trusted {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"msg":  "requests must come through a trusted proxy",
+				"err":  true,
+				"data": gin.H{},
+			})
+
+			return
+		}
+
+		clientIP := tP.ClientIP(peer, c.Request.Header)
+
+		if !trusted {
+			c.Request.Header.Del("CF-Connecting-IP")
+		}
+
+		if clientIP != nil {
+			c.Request.RemoteAddr = net.JoinHostPort(clientIP.String(), peerPort)
+			c.Request.Header.Set("X-Real-IP", clientIP.String())
+
+			c.Set(clientIPKey, clientIP.String())
+		}
+
+		// The reverse proxy sets X-Forwarded-For from the rewritten RemoteAddr
+		c.Request.Header.Del("X-Forwarded-For")
+
+		c.Set(peerAddrKey, peerAddr)
+
+		c.Next()
+	}
+}
+
+// requestClientIP is the client IP stored by the trusted proxies middleware, falling back to
+// the peer that connected when the middleware isn't in use. Gin's own guess would believe an
+// X-Forwarded-For sent by anyone, letting clients pick their address for access policies and
+// rate limits.
+func requestClientIP(c *gin.Context) string {
+	if clientIP := c.GetString(clientIPKey); clientIP != "" {
+		return clientIP
+	}
+
+	peerHost, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+
+	if err != nil {
+		return c.Request.RemoteAddr
+	}
+
+	return peerHost
+}
+
+// readNetworksFile reads a file of addresses and CIDR ranges, one per line, with # comments.
+func readNetworksFile(path string) ([]*net.IPNet, error) {
+	file, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	var networks []*net.IPNet
+
+	scanner := bufio.NewScanner(file)
+
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := scanner.Text()
+
+		if comment := strings.IndexByte(line, '#'); comment != -1 {
+			line = line[:comment]
+		}
+
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+
+		network, err := parseNetwork(line)
+
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, lineNumber, err)
+		}
+
+		networks = append(networks, network)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return networks, nil
+}
+
+func parseNetwork(value string) (*net.IPNet, error) {
+	if strings.IndexByte(value, '/') != -1 {
+		_, network, err := net.ParseCIDR(value)
+
+		return network, err
+	}
+
+	ip := net.ParseIP(value)
+
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", value)
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newTestTrustedProxies(t *testing.T) *trustedProxies {
+	path := filepath.Join(t.TempDir(), "ranges.txt")
+
+	ranges := "# cloudflare\n173.245.48.0/20\n2400:cb00::/32\n\n10.0.0.2 # internal load balancer\n"
+
+	if err := ioutil.WriteFile(path, []byte(ranges), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tP, err := newTrustedProxies(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tP
+}
+
+func TestTrustedProxiesClientIP(t *testing.T) {
+	tP := newTestTrustedProxies(t)
+
+	for _, test := range []struct {
+		name   string
+		peer   string
+		header http.Header
+		want   string
+	}{
+		{"untrusted peer", "203.0.113.9", nil, "203.0.113.9"},
+		{"untrusted peer spoofing CF-Connecting-IP", "203.0.113.9", http.Header{"Cf-Connecting-Ip": {"198.51.100.7"}}, "203.0.113.9"},
+		{"untrusted peer spoofing X-Forwarded-For", "203.0.113.9", http.Header{"X-Forwarded-For": {"198.51.100.7"}}, "203.0.113.9"},
+		{"trusted peer without headers", "173.245.48.1", nil, "173.245.48.1"},
+		{"CF-Connecting-IP", "173.245.48.1", http.Header{"Cf-Connecting-Ip": {"198.51.100.7"}, "X-Forwarded-For": {"192.0.2.1"}}, "198.51.100.7"},
+		{"malformed CF-Connecting-IP", "173.245.48.1", http.Header{"Cf-Connecting-Ip": {"unknown"}, "X-Forwarded-For": {"198.51.100.7"}}, "198.51.100.7"},
+		{"spoofed X-Forwarded-For entry", "173.245.48.1", http.Header{"X-Forwarded-For": {"6.6.6.6, 198.51.100.7"}}, "198.51.100.7"},
+		{"trusted hops walked from the right", "173.245.48.1", http.Header{"X-Forwarded-For": {"6.6.6.6, 198.51.100.7, 10.0.0.2"}}, "198.51.100.7"},
+		{"X-Forwarded-For across headers", "173.245.48.1", http.Header{"X-Forwarded-For": {"6.6.6.6", "198.51.100.7"}}, "198.51.100.7"},
+		{"every hop trusted", "173.245.48.1", http.Header{"X-Forwarded-For": {"10.0.0.2, 173.245.48.9"}}, "10.0.0.2"},
+		{"malformed last entry", "173.245.48.1", http.Header{"X-Forwarded-For": {"198.51.100.7, bogus"}}, "173.245.48.1"},
+		{"malformed entry behind a trusted hop", "173.245.48.1", http.Header{"X-Forwarded-For": {"bogus, 10.0.0.2"}}, "10.0.0.2"},
+		{"ipv6", "2400:cb00::1", http.Header{"X-Forwarded-For": {"2001:db8::1"}}, "2001:db8::1"},
+	} {
+		if got := tP.ClientIP(net.ParseIP(test.peer), test.header); got.String() != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestTrustedProxiesMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tP := newTestTrustedProxies(t)
+
+	for _, test := range []struct {
+		name            string
+		rejectUntrusted bool
+		peer            string
+		forwardedFor    string
+		status          int
+		clientIP        string
+	}{
+		{"trusted peer", true, "173.245.48.1:443", "6.6.6.6, 198.51.100.7", http.StatusOK, "198.51.100.7"},
+		{"untrusted peer", false, "203.0.113.9:443", "198.51.100.7", http.StatusOK, "203.0.113.9"},
+		{"untrusted peer rejected", true, "203.0.113.9:443", "198.51.100.7", http.StatusForbidden, ""},
+	} {
+		router := gin.New()
+
+		router.Use(tP.Middleware(test.rejectUntrusted))
+
+		router.GET("/", func(c *gin.Context) {
+			if forwardedFor := c.Request.Header.Get("X-Forwarded-For"); forwardedFor != "" {
+				t.Errorf("%s: X-Forwarded-For %q reached the handler", test.name, forwardedFor)
+			}
+
+			c.String(http.StatusOK, requestClientIP(c))
+		})
+
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+
+		request.RemoteAddr = test.peer
+		request.Header.Set("X-Forwarded-For", test.forwardedFor)
+
+		recorder := httptest.NewRecorder()
+
+		router.ServeHTTP(recorder, request)
+
+		if recorder.Code != test.status {
+			t.Errorf("%s: got status %d, want %d", test.name, recorder.Code, test.status)
+		} else if test.status == http.StatusOK && recorder.Body.String() != test.clientIP {
+			t.Errorf("%s: got client IP %q, want %q", test.name, recorder.Body.String(), test.clientIP)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// upstreamPolicy configures how the router talks to a route's forward host. Protocol is
+// "http1", "h2" (HTTP/2 over TLS) or "h2c" (HTTP/2 without TLS, for plain http gRPC services),
+// leaving it empty negotiates HTTP/2 over TLS and falls back to HTTP/1.1. ProxyProtocol, 1 or 2,
+// starts every upstream connection with a PROXY protocol header for the client, connections
+// then being used for a single request as each one can only speak for one client.
+type upstreamPolicy struct {
+	Protocol      string             `json:"protocol,omitempty"`
+	TLS           *upstreamTLSPolicy `json:"tls,omitempty"`
+	ProxyProtocol int                `json:"proxyProtocol,omitempty"`
+
+	transport http.RoundTripper
+}
+
+// upstreamTLSPolicy sets up TLS to https forward hosts. CAFile replaces the system roots,
+// CertFile and KeyFile present a client certificate, ServerName overrides the SNI and the name
+// verified, and PinSHA256 lists base64 SHA-256 hashes of subject public keys, one of which must
+// appear in the upstream's certificate chain.
+type upstreamTLSPolicy struct {
+	CAFile             string   `json:"caFile,omitempty"`
+	CertFile           string   `json:"certFile,omitempty"`
+	KeyFile            string   `json:"keyFile,omitempty"`
+	ServerName         string   `json:"serverName,omitempty"`
+	PinSHA256          []string `json:"pinSHA256,omitempty"`
+	InsecureSkipVerify bool     `json:"insecureSkipVerify,omitempty"`
+}
+
+// build creates the policy's transport, returning the files it read.
+func (uP *upstreamPolicy) build() ([]string, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	switch uP.Protocol {
+	case "":
+	case "http1":
+		transport.Protocols = &http.Protocols{}
+		transport.Protocols.SetHTTP1(true)
+	case "h2":
+		transport.Protocols = &http.Protocols{}
+		transport.Protocols.SetHTTP2(true)
+	case "h2c":
+		transport.Protocols = &http.Protocols{}
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	default:
+		return nil, fmt.Errorf("unknown protocol %q, expected http1, h2 or h2c", uP.Protocol)
+	}
+
+	if err := validateProxyProtocolVersion(uP.ProxyProtocol); err != nil {
+		return nil, err
+	}
+
+	if uP.ProxyProtocol != 0 {
+		transport.DialContext = proxyProtocolDialer(uP.ProxyProtocol)
+		transport.DisableKeepAlives = true
+	}
+
+	var files []string
+
+	if uP.TLS != nil {
+		tlsConfig, tlsFiles, err := uP.TLS.config()
+
+		files = append(files, tlsFiles...)
+
+		if err != nil {
+			return files, err
+		}
+
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	uP.transport = transport
+
+	return files, nil
+}
+
+func (uP *upstreamPolicy) close() {
+	if closer, ok := uP.transport.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
+
+func (uTP *upstreamTLSPolicy) config() (*tls.Config, []string, error) {
+	config := &tls.Config{
+		ServerName:         uTP.ServerName,
+		InsecureSkipVerify: uTP.InsecureSkipVerify,
+	}
+
+	var files []string
+
+	if uTP.CAFile != "" {
+		files = append(files, uTP.CAFile)
+
+		caPEM, err := ioutil.ReadFile(uTP.CAFile)
+
+		if err != nil {
+			return nil, files, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+
+		if !config.RootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, files, fmt.Errorf("no certificates found in %s", uTP.CAFile)
+		}
+	}
+
+	if (uTP.CertFile == "") != (uTP.KeyFile == "") {
+		return nil, files, errors.New("certFile and keyFile must be set together")
+	}
+
+	if uTP.CertFile != "" {
+		files = append(files, uTP.CertFile, uTP.KeyFile)
+
+		certificate, err := tls.LoadX509KeyPair(uTP.CertFile, uTP.KeyFile)
+
+		if err != nil {
+			return nil, files, err
+		}
+
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	if len(uTP.PinSHA256) != 0 {
+		pins := make(map[string]bool, len(uTP.PinSHA256))
+
+		for _, pin := range uTP.PinSHA256 {
+			if hash, err := base64.StdEncoding.DecodeString(pin); err != nil || len(hash) != sha256.Size {
+				return nil, files, fmt.Errorf("pin %q is not a base64 SHA-256 hash", pin)
+			}
+
+			pins[pin] = true
+		}
+
+		// Runs after the usual chain verification, or on its own with InsecureSkipVerify
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			for _, certificate := range state.PeerCertificates {
+				hash := sha256.Sum256(certificate.RawSubjectPublicKeyInfo)
+
+				if pins[base64.StdEncoding.EncodeToString(hash[:])] {
+					return nil
+				}
+			}
+
+			return errors.New("upstream certificate chain matches no pinned key")
+		}
+	}
+
+	return config, files, nil
+}
@@ -0,0 +1,735 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/the-rileyj/uyghurs"
+)
+
+type connectionState int
+
+const (
+	stateDisconnected connectionState = iota
+	stateConnecting
+	stateConnected
+)
+
+func (cS connectionState) String() string {
+	switch cS {
+	case stateConnecting:
+		return "connecting"
+	case stateConnected:
+		return "connected"
+	default:
+		return "disconnected"
+	}
+}
+
+// backoffPolicy computes how long to wait between failed connection attempts,
+// growing the delay exponentially up to Max and spreading it by +/- Jitter
+// (a fraction of the delay) so a fleet of routers doesn't reconnect in lockstep.
+type backoffPolicy struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+	Jitter     float64
+}
+
+func (bP backoffPolicy) Delay(attempt int) time.Duration {
+	delay := float64(bP.Initial) * math.Pow(bP.Multiplier, float64(attempt))
+
+	if math.IsInf(delay, 0) || math.IsNaN(delay) || delay > float64(bP.Max) {
+		delay = float64(bP.Max)
+	}
+
+	if bP.Jitter > 0 {
+		spread := delay * math.Min(bP.Jitter, 1)
+
+		delay += spread * (2*rand.Float64() - 1)
+	}
+
+	if delay < 0 {
+		delay = 0
+	}
+
+	return time.Duration(delay)
+}
+
+type uyghursClientStatus struct {
+	State          string    `json:"state"`
+	Endpoint       string    `json:"endpoint"`
+	ConnectedAt    time.Time `json:"connectedAt"`
+	LastMessageAt  time.Time `json:"lastMessageAt"`
+	LastError      string    `json:"lastError"`
+	Reconnects     int64     `json:"reconnects"`
+	FailedAttempts int       `json:"failedAttempts"`
+
+	AppliedRevision int64                   `json:"appliedRevision"`
+	Authoritative   string                  `json:"authoritative"`
+	Endpoints       []uyghursEndpointStatus `json:"endpoints"`
+}
+
+// heartbeatPolicy controls how often uyghurs is pinged and how long the connection may
+// stay silent before it is considered half-open and torn down. A zero Interval disables
+// pings and a zero Timeout disables both the read deadline and the reconnect on unanswered
+// uyghurs ping requests.
+type heartbeatPolicy struct {
+	Interval    time.Duration
+	Timeout     time.Duration
+	Application bool
+}
+
+type heartbeatTracker struct {
+	lastBeat int64
+}
+
+func newHeartbeatTracker() *heartbeatTracker {
+	hT := &heartbeatTracker{}
+
+	hT.Beat()
+
+	return hT
+}
+
+func (hT *heartbeatTracker) Beat() {
+	atomic.StoreInt64(&hT.lastBeat, time.Now().UnixNano())
+}
+
+func (hT *heartbeatTracker) Since() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&hT.lastBeat)))
+}
+
+// wsFrameWriter serializes frame writes so heartbeats and control frame replies
+// from the read loop never interleave on the wire.
+type wsFrameWriter struct {
+	conn         net.Conn
+	lock         *sync.Mutex
+	writeTimeout time.Duration
+}
+
+func (w *wsFrameWriter) WriteRaw(frameBytes []byte) error {
+	w.lock.Lock()
+
+	defer w.lock.Unlock()
+
+	w.conn.SetWriteDeadline(time.Now().Add(w.writeTimeout))
+
+	_, err := w.conn.Write(frameBytes)
+
+	return err
+}
+
+func (w *wsFrameWriter) WriteFrame(opCode ws.OpCode, payload []byte) error {
+	var frame bytes.Buffer
+
+	if err := wsutil.WriteClientMessage(&frame, opCode, payload); err != nil {
+		return err
+	}
+
+	return w.WriteRaw(frame.Bytes())
+}
+
+func (w *wsFrameWriter) WriteJSON(v interface{}) error {
+	payload, err := json.Marshal(v)
+
+	if err != nil {
+		return err
+	}
+
+	return w.WriteFrame(ws.OpText, payload)
+}
+
+type bufferedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (bC *bufferedConn) Read(p []byte) (int, error) {
+	return bC.reader.Read(p)
+}
+
+// routingUpdate is the envelope uyghurs wraps routing tables in so a router talking to
+// several uyghurs endpoints can tell a fresh table from a lagging one. Older uyghurs
+// servers send the bare project list instead, which carries no revision. GithubData is
+// the push that triggered the update, when uyghurs knows it.
+type routingUpdate struct {
+	Revision   int64                      `json:"revision"`
+	GithubData *uyghurs.GithubPush        `json:"githubData"`
+	Projects   []*uyghurs.ProjectMetadata `json:"projects"`
+}
+
+// routingUpdateReply is sent back to uyghurs after a routing update has been processed.
+type routingUpdateReply struct {
+	Revision int64                 `json:"revision"`
+	Results  []routingUpdateResult `json:"routingUpdateResults"`
+}
+
+type uyghursMessage struct {
+	uyghurs.WorkerMessage
+	routingUpdate
+}
+
+type uyghursEndpoint struct {
+	uyghursURL      url.URL
+	lastRevision    int64
+	lastConnectedAt time.Time
+	lastError       error
+}
+
+type uyghursEndpointStatus struct {
+	Host            string    `json:"host"`
+	LastRevision    int64     `json:"lastRevision"`
+	LastConnectedAt time.Time `json:"lastConnectedAt"`
+	LastError       string    `json:"lastError"`
+}
+
+// uyghursClient maintains the websocket connection to the uyghurs control plane,
+// handing every routing update it receives to handleUpdate and replying to uyghurs
+// with the per project results.
+//
+// Endpoints are tried in priority order: when the connected endpoint fails the client
+// fails over to the next reachable one, and while connected to a fallback it keeps probing
+// the endpoints ahead of it so it can fail back once they recover. Revisioned updates
+// older than the last applied revision are dropped, whichever endpoint they came from.
+type uyghursClient struct {
+	endpoints        []*uyghursEndpoint
+	dialTimeout      time.Duration
+	failbackInterval time.Duration
+	backoff          backoffPolicy
+	heartbeat        heartbeatPolicy
+	handleUpdate     func(source string, update *routingUpdate) []routingUpdateResult
+
+	lock            *sync.Mutex
+	state           connectionState
+	current         int
+	connectedAt     time.Time
+	lastMessageAt   time.Time
+	lastError       error
+	reconnects      int64
+	failures        int
+	everConnected   bool
+	appliedRevision int64
+	authoritative   string
+}
+
+func newUyghursClient(uyghursURLs []url.URL, failbackInterval time.Duration, backoff backoffPolicy, heartbeat heartbeatPolicy, handleUpdate func(string, *routingUpdate) []routingUpdateResult) *uyghursClient {
+	endpoints := make([]*uyghursEndpoint, len(uyghursURLs))
+
+	for i, uyghursURL := range uyghursURLs {
+		endpoints[i] = &uyghursEndpoint{uyghursURL: uyghursURL}
+	}
+
+	return &uyghursClient{
+		endpoints:        endpoints,
+		dialTimeout:      5 * time.Second,
+		failbackInterval: failbackInterval,
+		backoff:          backoff,
+		heartbeat:        heartbeat,
+		handleUpdate:     handleUpdate,
+		lock:             &sync.Mutex{},
+	}
+}
+
+func (uC *uyghursClient) Status() uyghursClientStatus {
+	uC.lock.Lock()
+
+	defer uC.lock.Unlock()
+
+	status := uyghursClientStatus{
+		State:           uC.state.String(),
+		Endpoint:        uC.endpoints[uC.current].uyghursURL.Host,
+		ConnectedAt:     uC.connectedAt,
+		LastMessageAt:   uC.lastMessageAt,
+		Reconnects:      uC.reconnects,
+		FailedAttempts:  uC.failures,
+		AppliedRevision: uC.appliedRevision,
+		Authoritative:   uC.authoritative,
+		Endpoints:       make([]uyghursEndpointStatus, len(uC.endpoints)),
+	}
+
+	if uC.lastError != nil {
+		status.LastError = uC.lastError.Error()
+	}
+
+	for i, endpoint := range uC.endpoints {
+		status.Endpoints[i] = uyghursEndpointStatus{
+			Host:            endpoint.uyghursURL.Host,
+			LastRevision:    endpoint.lastRevision,
+			LastConnectedAt: endpoint.lastConnectedAt,
+		}
+
+		if endpoint.lastError != nil {
+			status.Endpoints[i].LastError = endpoint.lastError.Error()
+		}
+	}
+
+	return status
+}
+
+// Run connects to uyghurs and processes routing updates until ctx is cancelled,
+// reconnecting with backoff whenever the connection fails. Connections dropped before they
+// were up for backoff.Max count as failed attempts too, so an endpoint that accepts and then
+// drops connections isn't redialed in a tight loop.
+func (uC *uyghursClient) Run(ctx context.Context) {
+	drops := 0
+
+	for {
+		conn, current, err := uC.connect(ctx)
+
+		if err != nil {
+			return
+		}
+
+		connectedAt := time.Now()
+
+		err = uC.readUpdates(conn, current)
+
+		conn.Close()
+
+		uC.setDisconnected(current, err)
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		log.Printf("uyghurs: event=disconnected endpoint=%s err=%q\n", uC.endpoints[current].uyghursURL.Host, err)
+
+		if errors.Is(err, errFailback) || time.Since(connectedAt) >= uC.backoff.Max {
+			drops = 0
+
+			continue
+		}
+
+		delay := uC.backoff.Delay(drops)
+
+		drops++
+
+		log.Printf("uyghurs: event=reconnect_delayed endpoint=%s drops=%d retry_in=%s\n", uC.endpoints[current].uyghursURL.Host, drops, delay)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// connect dials the uyghurs endpoints in priority order until one succeeds, backing off
+// between rounds where all of them failed. It only returns an error once ctx is done.
+func (uC *uyghursClient) connect(ctx context.Context) (net.Conn, int, error) {
+	for round := 0; ; round++ {
+		for current, endpoint := range uC.endpoints {
+			uC.setState(stateConnecting)
+
+			conn, err := uC.dial(ctx, endpoint)
+
+			if err == nil {
+				uC.setConnected(current)
+
+				log.Printf("uyghurs: event=connected endpoint=%s priority=%d round=%d\n", endpoint.uyghursURL.Host, current, round+1)
+
+				return conn, current, nil
+			}
+
+			if ctx.Err() != nil {
+				return nil, 0, ctx.Err()
+			}
+
+			uC.setDisconnected(current, err)
+
+			log.Printf("uyghurs: event=dial_failed endpoint=%s priority=%d round=%d err=%q\n", endpoint.uyghursURL.Host, current, round+1, err)
+		}
+
+		delay := uC.backoff.Delay(round)
+
+		log.Printf("uyghurs: event=all_endpoints_failed endpoints=%d round=%d retry_in=%s\n", len(uC.endpoints), round+1, delay)
+
+		select {
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (uC *uyghursClient) dial(ctx context.Context, endpoint *uyghursEndpoint) (net.Conn, error) {
+	uyghursMetrics.Add("dialAttempts", 1)
+
+	dialCtx, cancel := context.WithTimeout(ctx, uC.dialTimeout)
+
+	defer cancel()
+
+	conn, bufferedReader, _, err := ws.DefaultDialer.Dial(dialCtx, endpoint.uyghursURL.String())
+
+	if err != nil {
+		uyghursMetrics.Add("dialFailures", 1)
+
+		return nil, err
+	}
+
+	// Frames sent right behind the handshake response end up in the dialer's buffer
+	if bufferedReader != nil {
+		conn = &bufferedConn{Conn: conn, reader: io.MultiReader(bufferedReader, conn)}
+	}
+
+	return conn, nil
+}
+
+// readUpdates processes messages from conn until it fails, a heartbeat is missed or a
+// higher priority endpoint comes back, answering control frames and uyghurs pings along the way.
+func (uC *uyghursClient) readUpdates(conn net.Conn, current int) error {
+	endpoint := uC.endpoints[current]
+
+	writer := &wsFrameWriter{conn: conn, lock: &sync.Mutex{}, writeTimeout: uC.dialTimeout}
+
+	appHeartbeat := newHeartbeatTracker()
+
+	// Reasons for tearing the connection down from outside of the read loop
+	closeReasons := make(chan error, 2)
+	done := make(chan struct{})
+
+	defer close(done)
+
+	closeConn := func(reason error) {
+		select {
+		case closeReasons <- reason:
+		default:
+		}
+
+		conn.Close()
+	}
+
+	if uC.heartbeat.Interval > 0 {
+		go uC.sendHeartbeats(writer, appHeartbeat, done, closeConn)
+	}
+
+	if current > 0 && uC.failbackInterval > 0 {
+		go uC.probeFailback(current, done, closeConn)
+	}
+
+	handleControlFrame := func(hdr ws.Header, r io.Reader) error {
+		var reply bytes.Buffer
+
+		err := wsutil.ControlFrameHandler(&reply, ws.StateClientSide)(hdr, r)
+
+		if reply.Len() > 0 {
+			if writeErr := writer.WriteRaw(reply.Bytes()); err == nil {
+				err = writeErr
+			}
+		}
+
+		return err
+	}
+
+	frameReader := wsutil.Reader{
+		Source:         conn,
+		State:          ws.StateClientSide,
+		CheckUTF8:      true,
+		OnIntermediate: handleControlFrame,
+	}
+
+	for {
+		if uC.heartbeat.Timeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(uC.heartbeat.Timeout))
+		}
+
+		hdr, err := frameReader.NextFrame()
+
+		if err == nil && hdr.OpCode.IsControl() {
+			err = handleControlFrame(hdr, &frameReader)
+
+			if err == nil {
+				continue
+			}
+		}
+
+		var messageBytes []byte
+
+		if err == nil {
+			messageBytes, err = ioutil.ReadAll(&frameReader)
+		}
+
+		if err != nil {
+			select {
+			case reason := <-closeReasons:
+				return reason
+			default:
+			}
+
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				uyghursMetrics.Add("heartbeatsMissed", 1)
+
+				return fmt.Errorf("no frames received for %s: %s", uC.heartbeat.Timeout, err)
+			}
+
+			return err
+		}
+
+		uC.touch()
+
+		uC.handleMessage(endpoint, writer, appHeartbeat, messageBytes)
+	}
+}
+
+func (uC *uyghursClient) handleMessage(endpoint *uyghursEndpoint, writer *wsFrameWriter, appHeartbeat *heartbeatTracker, messageBytes []byte) {
+	source := endpoint.uyghursURL.Host
+
+	messageBytes = bytes.TrimSpace(messageBytes)
+
+	var message uyghursMessage
+
+	var err error
+
+	if len(messageBytes) != 0 && messageBytes[0] == '[' {
+		err = json.Unmarshal(messageBytes, &message.Projects)
+	} else {
+		err = json.Unmarshal(messageBytes, &message)
+	}
+
+	if err != nil {
+		uyghursMetrics.Add("invalidMessages", 1)
+
+		log.Printf("uyghurs: event=invalid_message endpoint=%s err=%q\n", source, err)
+
+		return
+	}
+
+	if message.Projects == nil {
+		switch uyghurs.WorkerMessageType(message.Type) {
+		case uyghurs.PingRequestType:
+			if err := writer.WriteJSON(uyghurs.WorkerMessage{Type: int(uyghurs.PingResponseType)}); err != nil {
+				log.Printf("uyghurs: event=ping_reply_failed endpoint=%s err=%q\n", source, err)
+			}
+		case uyghurs.PingResponseType:
+			appHeartbeat.Beat()
+		default:
+			log.Printf("uyghurs: event=unexpected_message endpoint=%s type=%d\n", source, message.Type)
+		}
+
+		return
+	}
+
+	if !uC.acceptRevision(endpoint, message.Revision) {
+		return
+	}
+
+	results := uC.handleUpdate(source, &message.routingUpdate)
+
+	for _, result := range results {
+		if !result.Applied {
+			uyghursMetrics.Add("rejectedProjects", 1)
+		}
+	}
+
+	if err := writer.WriteJSON(routingUpdateReply{Revision: message.Revision, Results: results}); err != nil {
+		log.Printf("uyghurs: event=update_reply_failed endpoint=%s revision=%d err=%q\n", source, message.Revision, err)
+	}
+}
+
+// acceptRevision records the revision an endpoint is at and reports whether an update at
+// that revision should be applied. Unrevisioned updates are applied until a revisioned one
+// has been, from then on only when they come from the authoritative endpoint, as there is
+// no telling whether they are older than the table.
+func (uC *uyghursClient) acceptRevision(endpoint *uyghursEndpoint, revision int64) bool {
+	uC.lock.Lock()
+
+	defer uC.lock.Unlock()
+
+	if revision == 0 {
+		if uC.appliedRevision == 0 || endpoint.uyghursURL.Host == uC.authoritative {
+			return true
+		}
+
+		uyghursMetrics.Add("staleUpdates", 1)
+
+		log.Printf("uyghurs: event=unrevisioned_update endpoint=%s applied_revision=%d authoritative=%s\n", endpoint.uyghursURL.Host, uC.appliedRevision, uC.authoritative)
+
+		return false
+	}
+
+	endpoint.lastRevision = revision
+
+	if revision < uC.appliedRevision {
+		uyghursMetrics.Add("staleUpdates", 1)
+
+		log.Printf("uyghurs: event=stale_update endpoint=%s revision=%d applied_revision=%d authoritative=%s\n", endpoint.uyghursURL.Host, revision, uC.appliedRevision, uC.authoritative)
+
+		return false
+	}
+
+	uC.authoritative = endpoint.uyghursURL.Host
+
+	if revision == uC.appliedRevision {
+		return false
+	}
+
+	uC.appliedRevision = revision
+
+	return true
+}
+
+// sendHeartbeats pings uyghurs every interval, both with websocket ping frames, which keep
+// the read deadline moving, and with uyghurs ping requests, which prove the server's
+// message loop is alive. The connection is closed once an application heartbeat is missed.
+func (uC *uyghursClient) sendHeartbeats(writer *wsFrameWriter, appHeartbeat *heartbeatTracker, done <-chan struct{}, closeConn func(error)) {
+	ticker := time.NewTicker(uC.heartbeat.Interval)
+
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		if uC.heartbeat.Application && uC.heartbeat.Timeout > 0 && appHeartbeat.Since() > uC.heartbeat.Timeout {
+			uyghursMetrics.Add("heartbeatsMissed", 1)
+
+			closeConn(fmt.Errorf("no uyghurs ping response for %s", appHeartbeat.Since().Round(time.Millisecond)))
+
+			return
+		}
+
+		err := writer.WriteFrame(ws.OpPing, nil)
+
+		if err == nil && uC.heartbeat.Application {
+			err = writer.WriteJSON(uyghurs.WorkerMessage{Type: int(uyghurs.PingRequestType)})
+		}
+
+		if err != nil {
+			closeConn(fmt.Errorf("failed to send heartbeat: %s", err))
+
+			return
+		}
+
+		uyghursMetrics.Add("heartbeatsSent", 1)
+	}
+}
+
+var errFailback = errors.New("failing back")
+
+// probeFailback periodically dials the endpoints ranked ahead of the current one and
+// closes the current connection as soon as one of them answers, so Run reconnects to it.
+func (uC *uyghursClient) probeFailback(current int, done <-chan struct{}, closeConn func(error)) {
+	ticker := time.NewTicker(uC.failbackInterval)
+
+	defer ticker.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	defer cancel()
+
+	go func() {
+		<-done
+
+		cancel()
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		for _, endpoint := range uC.endpoints[:current] {
+			conn, err := uC.dial(ctx, endpoint)
+
+			if err != nil {
+				continue
+			}
+
+			conn.Close()
+
+			uyghursMetrics.Add("failbacks", 1)
+
+			closeConn(fmt.Errorf("%w to %s", errFailback, endpoint.uyghursURL.Host))
+
+			return
+		}
+	}
+}
+
+func (uC *uyghursClient) setState(state connectionState) {
+	uC.lock.Lock()
+
+	defer uC.lock.Unlock()
+
+	uC.state = state
+}
+
+func (uC *uyghursClient) setConnected(current int) {
+	uC.lock.Lock()
+
+	defer uC.lock.Unlock()
+
+	if uC.everConnected {
+		uC.reconnects++
+
+		uyghursMetrics.Add("reconnects", 1)
+	}
+
+	if current > 0 {
+		uyghursMetrics.Add("failovers", 1)
+	}
+
+	now := time.Now()
+
+	uC.everConnected = true
+	uC.state = stateConnected
+	uC.current = current
+	uC.connectedAt = now
+	uC.failures = 0
+
+	uC.endpoints[current].lastConnectedAt = now
+	uC.endpoints[current].lastError = nil
+}
+
+func (uC *uyghursClient) setDisconnected(current int, err error) {
+	uC.lock.Lock()
+
+	defer uC.lock.Unlock()
+
+	if uC.state == stateConnecting {
+		uC.failures++
+	}
+
+	if err == nil {
+		err = errors.New("connection closed")
+	}
+
+	uC.state = stateDisconnected
+	uC.current = current
+	uC.lastError = err
+
+	uC.endpoints[current].lastError = err
+}
+
+func (uC *uyghursClient) touch() {
+	now := time.Now()
+
+	uC.lock.Lock()
+
+	uC.lastMessageAt = now
+
+	uC.lock.Unlock()
+
+	uyghursMetrics.Add("messages", 1)
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+)
+
+// fakeUyghurs is a local stand-in for uyghurs that upgrades every request and hands the
+// connection to serve, reporting when each connection was made.
+type fakeUyghurs struct {
+	server      *httptest.Server
+	connections chan time.Time
+}
+
+func newFakeUyghurs(t *testing.T, serve func(conn net.Conn)) *fakeUyghurs {
+	fU := &fakeUyghurs{connections: make(chan time.Time, 100)}
+
+	fU.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, _, err := ws.UpgradeHTTP(r, w)
+
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		select {
+		case fU.connections <- time.Now():
+		default:
+		}
+
+		serve(conn)
+	}))
+
+	t.Cleanup(fU.server.Close)
+
+	return fU
+}
+
+func (fU *fakeUyghurs) URL() url.URL {
+	uyghursURL, _ := url.Parse("ws" + strings.TrimPrefix(fU.server.URL, "http"))
+
+	return *uyghursURL
+}
+
+// serveSilently reads whatever the router sends without ever answering, like a server whose
+// process has hung.
+func serveSilently(conn net.Conn) {
+	io.Copy(ioutil.Discard, conn)
+}
+
+// servePongsOnly answers websocket pings but ignores every message, like a server whose
+// message loop has hung.
+func servePongsOnly(conn net.Conn) {
+	for {
+		if _, _, err := wsutil.ReadClientData(conn); err != nil {
+			return
+		}
+	}
+}
+
+func waitForConnections(t *testing.T, fU *fakeUyghurs, count int, timeout time.Duration) []time.Time {
+	t.Helper()
+
+	var connectedAt []time.Time
+
+	deadline := time.After(timeout)
+
+	for len(connectedAt) < count {
+		select {
+		case at := <-fU.connections:
+			connectedAt = append(connectedAt, at)
+		case <-deadline:
+			t.Fatalf("got %d connections within %s, want %d", len(connectedAt), timeout, count)
+		}
+	}
+
+	return connectedAt
+}
+
+func TestUyghursClientReadDeadlineTearsDownSilentConnection(t *testing.T) {
+	fU := newFakeUyghurs(t, serveSilently)
+
+	heartbeat := heartbeatPolicy{Interval: 20 * time.Millisecond, Timeout: 150 * time.Millisecond}
+
+	uC := newUyghursClient([]url.URL{fU.URL()}, 0, backoffPolicy{}, heartbeat, nil)
+
+	conn, err := uC.dial(context.Background(), uC.endpoints[0])
+
+	if err != nil {
+		t.Fatalf("dialing the fake uyghurs: %s", err)
+	}
+
+	defer conn.Close()
+
+	startedAt := time.Now()
+
+	errs := make(chan error, 1)
+
+	go func() { errs <- uC.readUpdates(conn, 0) }()
+
+	select {
+	case err := <-errs:
+		if err == nil || !strings.Contains(err.Error(), "no frames received") {
+			t.Fatalf("readUpdates returned %v, want a read deadline error", err)
+		}
+
+		if elapsed := time.Since(startedAt); elapsed < heartbeat.Timeout {
+			t.Fatalf("connection torn down after %s, before the %s timeout", elapsed, heartbeat.Timeout)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("readUpdates kept waiting on a silent connection")
+	}
+}
+
+func TestUyghursClientReconnectsAfterMissedApplicationHeartbeat(t *testing.T) {
+	fU := newFakeUyghurs(t, servePongsOnly)
+
+	heartbeat := heartbeatPolicy{Interval: 20 * time.Millisecond, Timeout: 150 * time.Millisecond, Application: true}
+
+	backoff := backoffPolicy{Initial: 10 * time.Millisecond, Max: 10 * time.Millisecond, Multiplier: 2}
+
+	uC := newUyghursClient([]url.URL{fU.URL()}, 0, backoff, heartbeat, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	defer cancel()
+
+	go uC.Run(ctx)
+
+	connectedAt := waitForConnections(t, fU, 2, 2*time.Second)
+
+	// Pongs keep the read deadline moving, so only the missed uyghurs ping response can end it
+	if lasted := connectedAt[1].Sub(connectedAt[0]); lasted < heartbeat.Timeout {
+		t.Fatalf("reconnected after %s, before the %s heartbeat timeout", lasted, heartbeat.Timeout)
+	}
+
+	// The client records the reconnect once the handshake response reaches it
+	status := uC.Status()
+
+	for deadline := time.Now().Add(time.Second); status.Reconnects < 1 && time.Now().Before(deadline); status = uC.Status() {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if status.Reconnects < 1 {
+		t.Fatalf("status reports %d reconnects, want at least 1", status.Reconnects)
+	}
+
+	if !strings.Contains(status.LastError, "no uyghurs ping response") {
+		t.Fatalf("status reports last error %q, want a missed heartbeat", status.LastError)
+	}
+}
+
+func TestUyghursClientZeroTimeoutKeepsConnection(t *testing.T) {
+	fU := newFakeUyghurs(t, servePongsOnly)
+
+	heartbeat := heartbeatPolicy{Interval: 10 * time.Millisecond, Application: true}
+
+	uC := newUyghursClient([]url.URL{fU.URL()}, 0, backoffPolicy{Initial: 10 * time.Millisecond, Max: 10 * time.Millisecond, Multiplier: 2}, heartbeat, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	defer cancel()
+
+	go uC.Run(ctx)
+
+	waitForConnections(t, fU, 1, 2*time.Second)
+
+	// Plenty of unanswered uyghurs pings
+	time.Sleep(200 * time.Millisecond)
+
+	if len(fU.connections) != 0 {
+		t.Fatalf("reconnected with heartbeats that never time out, last error %q", uC.Status().LastError)
+	}
+}
+
+func TestUyghursClientBacksOffWhileEndpointsAreDown(t *testing.T) {
+	attempts := make(chan time.Time, 100)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case attempts <- time.Now():
+		default:
+		}
+
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+
+	defer server.Close()
+
+	uyghursURL, _ := url.Parse("ws" + strings.TrimPrefix(server.URL, "http"))
+
+	backoff := backoffPolicy{Initial: 20 * time.Millisecond, Max: time.Second, Multiplier: 2}
+
+	uC := newUyghursClient([]url.URL{*uyghursURL}, 0, backoff, heartbeatPolicy{}, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+
+	defer cancel()
+
+	if _, _, err := uC.connect(ctx); err == nil {
+		t.Fatal("connect succeeded against an endpoint that refuses upgrades")
+	}
+
+	var attemptedAt []time.Time
+
+	for len(attempts) != 0 {
+		attemptedAt = append(attemptedAt, <-attempts)
+	}
+
+	assertBackoff(t, attemptedAt, backoff)
+
+	if status := uC.Status(); status.FailedAttempts != len(attemptedAt) {
+		t.Fatalf("status reports %d failed attempts, want %d", status.FailedAttempts, len(attemptedAt))
+	}
+}
+
+func TestUyghursClientBacksOffWhenConnectionsDropRightAway(t *testing.T) {
+	fU := newFakeUyghurs(t, func(net.Conn) {})
+
+	backoff := backoffPolicy{Initial: 20 * time.Millisecond, Max: time.Second, Multiplier: 2}
+
+	uC := newUyghursClient([]url.URL{fU.URL()}, 0, backoff, heartbeatPolicy{}, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+
+	defer cancel()
+
+	uC.Run(ctx)
+
+	var connectedAt []time.Time
+
+	for len(fU.connections) != 0 {
+		connectedAt = append(connectedAt, <-fU.connections)
+	}
+
+	assertBackoff(t, connectedAt, backoff)
+}
+
+// assertBackoff checks that attempts were spaced by at least the backoff's growing delays.
+func assertBackoff(t *testing.T, attemptedAt []time.Time, backoff backoffPolicy) {
+	t.Helper()
+
+	// 0, 20, 60, 140 and 300ms in, the next one being past 500ms
+	if len(attemptedAt) < 3 || len(attemptedAt) > 6 {
+		t.Fatalf("made %d attempts in 500ms, want 3 to 6", len(attemptedAt))
+	}
+
+	for i := 1; i < len(attemptedAt); i++ {
+		// The timer can't fire early, the slack is for when the attempts were recorded
+		if gap, want := attemptedAt[i].Sub(attemptedAt[i-1]), backoff.Delay(i-1)-5*time.Millisecond; gap < want {
+			t.Fatalf("attempt %d came %s after the previous one, want at least %s", i+1, gap, want)
+		}
+	}
+}
+
+func TestBackoffPolicyDelay(t *testing.T) {
+	backoff := backoffPolicy{Initial: time.Second, Max: 10 * time.Second, Multiplier: 2}
+
+	for attempt, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second} {
+		if delay := backoff.Delay(attempt); delay != want {
+			t.Errorf("attempt %d: delay %s, want %s", attempt, delay, want)
+		}
+	}
+
+	if delay := backoff.Delay(10000); delay != backoff.Max {
+		t.Errorf("huge attempt: delay %s, want the %s cap", delay, backoff.Max)
+	}
+
+	backoff.Jitter = 0.5
+
+	for i := 0; i < 1000; i++ {
+		if delay := backoff.Delay(1); delay < time.Second || delay > 3*time.Second {
+			t.Fatalf("jittered delay %s outside of 1s to 3s", delay)
+		}
+	}
+}
+
+func TestUyghursClientAcceptRevision(t *testing.T) {
+	primary, _ := url.Parse("wss://primary.example.com/ws")
+	secondary, _ := url.Parse("wss://secondary.example.com/ws")
+
+	uC := newUyghursClient([]url.URL{*primary, *secondary}, 0, backoffPolicy{}, heartbeatPolicy{}, nil)
+
+	primaryEndpoint, secondaryEndpoint := uC.endpoints[0], uC.endpoints[1]
+
+	for i, step := range []struct {
+		endpoint *uyghursEndpoint
+		revision int64
+		accept   bool
+	}{
+		// Servers without revisions are applied as they come
+		{primaryEndpoint, 0, true},
+		{secondaryEndpoint, 0, true},
+		{primaryEndpoint, 5, true},
+		{primaryEndpoint, 5, false},
+		{secondaryEndpoint, 3, false},
+		// A stale secondary can't overwrite the revisioned table without a revision either
+		{secondaryEndpoint, 0, false},
+		{primaryEndpoint, 0, true},
+		{secondaryEndpoint, 6, true},
+		{primaryEndpoint, 0, false},
+		{secondaryEndpoint, 0, true},
+	} {
+		if accepted := uC.acceptRevision(step.endpoint, step.revision); accepted != step.accept {
+			t.Fatalf("step %d: revision %d from %s accepted %t, want %t", i+1, step.revision, step.endpoint.uyghursURL.Host, accepted, step.accept)
+		}
+	}
+
+	if status := uC.Status(); status.Authoritative != "secondary.example.com" {
+		t.Fatalf("authoritative %q, want the endpoint with the newest revision", status.Authoritative)
+	}
+}
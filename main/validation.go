@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/the-rileyj/uyghurs"
+)
+
+// routeValidationError describes a single problem with a project's routing metadata.
+// Route is the index of the offending entry in ProjectRoutes, or -1 for the project itself.
+type routeValidationError struct {
+	Project string `json:"project"`
+	Route   int    `json:"route"`
+	Field   string `json:"field"`
+	Value   string `json:"value"`
+	Reason  string `json:"reason"`
+}
+
+func (rVE routeValidationError) Error() string {
+	if rVE.Route < 0 {
+		return fmt.Sprintf("project %q: %s %q %s", rVE.Project, rVE.Field, rVE.Value, rVE.Reason)
+	}
+
+	return fmt.Sprintf("project %q route %d: %s %q %s", rVE.Project, rVE.Route, rVE.Field, rVE.Value, rVE.Reason)
+}
+
+type validationErrors []routeValidationError
+
+func (vE validationErrors) Error() string {
+	messages := make([]string, len(vE))
+
+	for i, err := range vE {
+		messages[i] = err.Error()
+	}
+
+	return strings.Join(messages, "; ")
+}
+
+// validateProjectMetadata checks every route of a project before any of it is applied:
+// forward hosts must be absolute http(s) URLs, routes clean absolute paths, domains valid
+// patterns, and no domain and route pair may be claimed twice, whether within the project,
+// by another project in projectsMap or as the default route.
+func validateProjectMetadata(projectMetadata *uyghurs.ProjectMetadata, projectsMap map[string]*uyghurs.ProjectMetadata, defaultDomain string) error {
+	if projectMetadata == nil {
+		return validationErrors{{Route: -1, Field: "project", Reason: "is missing"}}
+	}
+
+	var errs validationErrors
+
+	projectName := projectMetadata.ProjectName
+
+	addErr := func(route int, field, value, reason string) {
+		errs = append(errs, routeValidationError{Project: projectName, Route: route, Field: field, Value: value, Reason: reason})
+	}
+
+	if projectName == "" || strings.IndexFunc(projectName, unicode.IsSpace) != -1 {
+		addErr(-1, "projectName", projectName, "must be non-empty and contain no whitespace")
+	}
+
+	// Domain and route pairs claimed by other projects, keyed by routeKey. The default route,
+	// claimed by no project, is served by the default host.
+	claimedRoutes := map[string]string{defaultDomain + "/": ""}
+
+	for otherProjectName, otherProjectMetadata := range projectsMap {
+		if otherProjectName == projectName {
+			continue
+		}
+
+		for _, routeInfo := range otherProjectMetadata.ProjectRoutes {
+			claimedRoutes[routeKey(routeInfo, defaultDomain)] = otherProjectName
+		}
+	}
+
+	seenRoutes := make(map[string]int)
+
+	for i, routeInfo := range projectMetadata.ProjectRoutes {
+		if routeInfo == nil {
+			addErr(i, "route", "", "is missing")
+
+			continue
+		}
+
+		if reason := validateForwardHost(routeInfo.ForwardHost); reason != "" {
+			addErr(i, "forwardHost", routeInfo.ForwardHost, reason)
+		}
+
+		if reason := validateRoute(routeInfo.Route); reason != "" {
+			addErr(i, "route", routeInfo.Route, reason)
+		}
+
+		if reason := validateDomain(routeInfo.Domain, defaultDomain); reason != "" {
+			addErr(i, "domain", routeInfo.Domain, reason)
+		}
+
+		key := routeKey(routeInfo, defaultDomain)
+
+		if firstIndex, seen := seenRoutes[key]; seen {
+			addErr(i, "route", routeInfo.Domain+routeInfo.Route, fmt.Sprintf("duplicates route %d", firstIndex))
+		} else {
+			seenRoutes[key] = i
+		}
+
+		if otherProjectName, claimed := claimedRoutes[key]; claimed && otherProjectName == "" {
+			addErr(i, "route", routeInfo.Domain+routeInfo.Route, "is the default route")
+		} else if claimed {
+			addErr(i, "route", routeInfo.Domain+routeInfo.Route, fmt.Sprintf("is already routed to project %q", otherProjectName))
+		}
+	}
+
+	if len(errs) != 0 {
+		return errs
+	}
+
+	return nil
+}
+
+func routeKey(routeInfo *uyghurs.RouteInfo, defaultDomain string) string {
+	domain := routeInfo.Domain
+
+	if domain == "" {
+		domain = defaultDomain
+	}
+
+	return domain + routeInfo.Route
+}
+
+func validateForwardHost(forwardHost string) string {
+	forwardHostURL, err := url.Parse(forwardHost)
+
+	switch {
+	case err != nil:
+		return fmt.Sprintf("is not a valid URL: %s", err)
+	case forwardHostURL.Scheme != "http" && forwardHostURL.Scheme != "https":
+		return "must use the http or https scheme"
+	case forwardHostURL.Hostname() == "":
+		return "must include a host"
+	case forwardHostURL.User != nil:
+		return "must not include credentials"
+	case forwardHostURL.RawQuery != "" || forwardHostURL.Fragment != "":
+		return "must not include a query or fragment"
+	}
+
+	return ""
+}
+
+func validateRoute(route string) string {
+	switch {
+	case !strings.HasPrefix(route, "/"):
+		return "must start with '/'"
+	case strings.ContainsAny(route, "?#"):
+		return "must not include a query or fragment"
+	case strings.IndexFunc(route, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsControl(r) }) != -1:
+		return "must not contain whitespace or control characters"
+	case strings.Contains(route, "//"):
+		return "must not contain empty path segments"
+	}
+
+	for _, segment := range strings.Split(route, "/") {
+		if segment == "." || segment == ".." {
+			return "must not contain relative path segments"
+		}
+	}
+
+	return ""
+}
+
+func validateDomain(domain, defaultDomain string) string {
+	if domain == "" || domain == defaultDomain {
+		return ""
+	}
+
+	if strings.IndexFunc(domain, unicode.IsSpace) != -1 {
+		return "must not contain whitespace"
+	}
+
+	domainRegexp, err := regexp.Compile(domain)
+
+	if err != nil {
+		return fmt.Sprintf("is not a valid domain pattern: %s", err)
+	}
+
+	if domainRegexp.MatchString("") {
+		return "must not match an empty host"
+	}
+
+	return ""
+}
+
+// routingUpdateResult tells uyghurs whether a project from a routing update was applied,
+// and if it wasn't, why.
+// Deferred marks a valid update held back because the routing table is pinned.
+type routingUpdateResult struct {
+	Project  string                 `json:"project"`
+	Applied  bool                   `json:"applied"`
+	Deferred bool                   `json:"deferred,omitempty"`
+	Errors   []routeValidationError `json:"errors,omitempty"`
+}
+
+func newRoutingUpdateResult(projectName string, applied bool, err error) routingUpdateResult {
+	result := routingUpdateResult{Project: projectName, Applied: applied, Deferred: !applied && err == nil}
+
+	switch err := err.(type) {
+	case nil:
+	case validationErrors:
+		result.Errors = err
+	default:
+		result.Errors = []routeValidationError{{Project: projectName, Route: -1, Field: "project", Value: projectName, Reason: err.Error()}}
+	}
+
+	return result
+}
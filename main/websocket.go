@@ -0,0 +1,551 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gobwas/ws"
+)
+
+// websocketPolicy limits the websocket connections on a route. MaxConnections caps how many may
+// be open at once, IdleTimeout closes connections no frame has crossed for that long and
+// MaxLifetime closes connections open for that long, zero leaving each unlimited.
+type websocketPolicy struct {
+	MaxConnections int            `json:"maxConnections,omitempty"`
+	IdleTimeout    configDuration `json:"idleTimeout,omitempty"`
+	MaxLifetime    configDuration `json:"maxLifetime,omitempty"`
+}
+
+type websocketConnectionStatus struct {
+	ID              uint64    `json:"id"`
+	Domain          string    `json:"domain"`
+	Project         string    `json:"project"`
+	Route           string    `json:"route"`
+	ForwardHost     string    `json:"forwardHost"`
+	ClientIP        string    `json:"clientIP"`
+	StartedAt       time.Time `json:"startedAt"`
+	LastActivityAt  time.Time `json:"lastActivityAt"`
+	BytesFromClient int64     `json:"bytesFromClient"`
+	BytesToClient   int64     `json:"bytesToClient"`
+	Draining        bool      `json:"draining"`
+}
+
+// websocketTracker proxies websocket connections frame by frame, so it can count what crosses
+// them and close them cleanly with a close frame to both ends when they time out, their route
+// changes or the router shuts down.
+type websocketTracker struct {
+	drainTimeout time.Duration
+
+	lock        *sync.Mutex
+	nextID      uint64
+	connections map[uint64]*websocketConnection
+}
+
+func newWebsocketTracker(drainTimeout time.Duration) *websocketTracker {
+	return &websocketTracker{
+		drainTimeout: drainTimeout,
+		lock:         &sync.Mutex{},
+		connections:  make(map[uint64]*websocketConnection),
+	}
+}
+
+// Proxy upgrades the request through the route's reverse proxy transport and pumps frames
+// between the client and the upstream until either side closes.
+func (wT *websocketTracker) Proxy(c *gin.Context, reverseProxy *httputil.ReverseProxy, settings routeSettings, forwardHost string) {
+	var policy websocketPolicy
+
+	if rule := settings.Lookup(func(rule *routeRule) bool { return rule.Websocket != nil }); rule != nil {
+		policy = *rule.Websocket
+	}
+
+	wC := &websocketConnection{
+		domain:      settings.domain,
+		project:     settings.project,
+		route:       settings.route,
+		forwardHost: forwardHost,
+		clientIP:    requestClientIP(c),
+		startedAt:   time.Now(),
+		done:        make(chan struct{}),
+		draining:    make(chan struct{}),
+		lock:        &sync.Mutex{},
+	}
+
+	if !wT.open(wC, policy.MaxConnections) {
+		websocketMetrics.Add("rejected", 1)
+
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"msg":  "too many websocket connections to this route",
+			"err":  true,
+			"data": gin.H{},
+		})
+
+		return
+	}
+
+	defer wT.close(wC)
+
+	// The connection outlives the handler's request context once hijacked, the values the
+	// response hooks read are kept
+	outreq := c.Request.Clone(withProxyProtocolAddrs(context.WithoutCancel(c.Request.Context()), c.Request))
+
+	outreq.RequestURI = ""
+
+	reverseProxy.Director(outreq)
+
+	if clientIP, _, err := net.SplitHostPort(c.Request.RemoteAddr); err == nil {
+		if prior := outreq.Header.Get("X-Forwarded-For"); prior != "" {
+			clientIP = prior + ", " + clientIP
+		}
+
+		outreq.Header.Set("X-Forwarded-For", clientIP)
+	}
+
+	transport := reverseProxy.Transport
+
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	resp, err := transport.RoundTrip(outreq)
+
+	if err != nil {
+		log.Printf("websocket: event=upstream_failed project=%s route=%s err=%q\n", wC.project, wC.route, err)
+
+		c.Status(http.StatusBadGateway)
+
+		return
+	}
+
+	// The same response hooks as proxied requests, for security headers, header rules and CORS
+	if reverseProxy.ModifyResponse != nil {
+		if err := reverseProxy.ModifyResponse(resp); err != nil {
+			resp.Body.Close()
+
+			log.Printf("websocket: event=modify_response_failed project=%s route=%s err=%q\n", wC.project, wC.route, err)
+
+			c.Status(http.StatusBadGateway)
+
+			return
+		}
+	}
+
+	upstreamConn, upgraded := resp.Body.(io.ReadWriteCloser)
+
+	if resp.StatusCode != http.StatusSwitchingProtocols || !upgraded {
+		defer resp.Body.Close()
+
+		for key, values := range resp.Header {
+			for _, value := range values {
+				c.Writer.Header().Add(key, value)
+			}
+		}
+
+		c.Status(resp.StatusCode)
+
+		io.Copy(c.Writer, resp.Body)
+
+		return
+	}
+
+	clientConn, clientBuffer, err := c.Writer.Hijack()
+
+	if err != nil {
+		upstreamConn.Close()
+
+		log.Printf("websocket: event=hijack_failed project=%s route=%s err=%q\n", wC.project, wC.route, err)
+
+		return
+	}
+
+	// Hijacking skips the headers the router set on the response, send them with the upstream's
+	header := c.Writer.Header().Clone()
+
+	for key, values := range resp.Header {
+		for _, value := range values {
+			header.Add(key, value)
+		}
+	}
+
+	fmt.Fprintf(clientBuffer, "HTTP/1.1 %s\r\n", resp.Status)
+
+	header.Write(clientBuffer)
+
+	clientBuffer.WriteString("\r\n")
+
+	if err := clientBuffer.Flush(); err != nil {
+		clientConn.Close()
+		upstreamConn.Close()
+
+		return
+	}
+
+	wC.attach(
+		&websocketPeer{reader: clientBuffer.Reader, writer: clientConn, closer: clientConn, lock: &sync.Mutex{}},
+		&websocketPeer{reader: upstreamConn, writer: upstreamConn, closer: upstreamConn, lock: &sync.Mutex{}, masked: true},
+	)
+
+	wC.serve(policy, wT.drainTimeout)
+}
+
+func (wT *websocketTracker) open(wC *websocketConnection, maxConnections int) bool {
+	wT.lock.Lock()
+
+	defer wT.lock.Unlock()
+
+	if maxConnections > 0 {
+		open := 0
+
+		for _, other := range wT.connections {
+			if other.domain == wC.domain && other.project == wC.project && other.route == wC.route {
+				open++
+			}
+		}
+
+		if open >= maxConnections {
+			return false
+		}
+	}
+
+	wT.nextID++
+
+	wC.id = wT.nextID
+
+	wT.connections[wC.id] = wC
+
+	websocketMetrics.Add("open", 1)
+	websocketMetrics.Add("opened", 1)
+	websocketOpenByProject.Add(metricsProjectName(wC.project), 1)
+	websocketOpenByRoute.Add(wC.domain+wC.route, 1)
+
+	return true
+}
+
+func (wT *websocketTracker) close(wC *websocketConnection) {
+	wT.lock.Lock()
+
+	defer wT.lock.Unlock()
+
+	wC.terminate()
+
+	delete(wT.connections, wC.id)
+
+	websocketMetrics.Add("open", -1)
+	websocketOpenByProject.Add(metricsProjectName(wC.project), -1)
+	websocketOpenByRoute.Add(wC.domain+wC.route, -1)
+}
+
+func (wT *websocketTracker) Connections() []websocketConnectionStatus {
+	wT.lock.Lock()
+
+	connections := make([]websocketConnectionStatus, 0, len(wT.connections))
+
+	for _, wC := range wT.connections {
+		connections = append(connections, wC.Status())
+	}
+
+	wT.lock.Unlock()
+
+	sort.Slice(connections, func(i, j int) bool { return connections[i].ID < connections[j].ID })
+
+	return connections
+}
+
+// DrainStale closes, with a close frame, connections whose route isCurrent no longer reports as
+// served by the same forward host.
+func (wT *websocketTracker) DrainStale(isCurrent func(domain, project, route, forwardHost string) bool) {
+	wT.lock.Lock()
+
+	var stale []*websocketConnection
+
+	for _, wC := range wT.connections {
+		if !isCurrent(wC.domain, wC.project, wC.route, wC.forwardHost) {
+			stale = append(stale, wC)
+		}
+	}
+
+	wT.lock.Unlock()
+
+	for _, wC := range stale {
+		log.Printf("websocket: event=draining id=%d project=%s route=%s reason=route_changed\n", wC.id, wC.project, wC.route)
+
+		wC.Drain(ws.StatusGoingAway, "route changed", wT.drainTimeout)
+	}
+}
+
+// DrainAll closes every connection with a close frame, returning once they are all closed or
+// ctx is done.
+func (wT *websocketTracker) DrainAll(ctx context.Context, reason string) {
+	wT.lock.Lock()
+
+	connections := make([]*websocketConnection, 0, len(wT.connections))
+
+	for _, wC := range wT.connections {
+		connections = append(connections, wC)
+	}
+
+	wT.lock.Unlock()
+
+	if len(connections) != 0 {
+		log.Printf("websocket: event=draining_all connections=%d reason=%q\n", len(connections), reason)
+	}
+
+	for _, wC := range connections {
+		wC.Drain(ws.StatusGoingAway, reason, wT.drainTimeout)
+	}
+
+	for _, wC := range connections {
+		select {
+		case <-wC.done:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// websocketPeer is one end of a proxied connection. Frames are written whole under lock so
+// close frames sent while draining never land in the middle of a forwarded frame.
+type websocketPeer struct {
+	reader io.Reader
+	writer io.Writer
+	closer io.Closer
+	masked bool
+
+	lock   *sync.Mutex
+	closed bool
+}
+
+// forward copies a frame, whose header has been read, from reader to the peer. Frames arriving
+// after the peer was sent a close frame are dropped.
+func (wP *websocketPeer) forward(header ws.Header, reader io.Reader) error {
+	wP.lock.Lock()
+
+	defer wP.lock.Unlock()
+
+	if wP.closed {
+		_, err := io.CopyN(ioutil.Discard, reader, header.Length)
+
+		return err
+	}
+
+	if header.OpCode == ws.OpClose {
+		wP.closed = true
+	}
+
+	if err := ws.WriteHeader(wP.writer, header); err != nil {
+		return err
+	}
+
+	_, err := io.CopyN(wP.writer, reader, header.Length)
+
+	return err
+}
+
+func (wP *websocketPeer) sendClose(code ws.StatusCode, reason string) error {
+	wP.lock.Lock()
+
+	defer wP.lock.Unlock()
+
+	if wP.closed {
+		return nil
+	}
+
+	wP.closed = true
+
+	frame := ws.NewCloseFrame(ws.NewCloseFrameBody(code, reason))
+
+	if wP.masked {
+		frame = ws.MaskFrameInPlace(frame)
+	}
+
+	return ws.WriteFrame(wP.writer, frame)
+}
+
+type websocketConnection struct {
+	id          uint64
+	domain      string
+	project     string
+	route       string
+	forwardHost string
+	clientIP    string
+	startedAt   time.Time
+
+	bytesFromClient int64
+	bytesToClient   int64
+	lastActivity    int64
+
+	done      chan struct{}
+	draining  chan struct{}
+	closeOnce sync.Once
+
+	lock         *sync.Mutex
+	client       *websocketPeer
+	upstream     *websocketPeer
+	drainCode    ws.StatusCode
+	drainReason  string
+	drainTimeout time.Duration
+}
+
+// attach hands the connection its ends once upgraded, starting a drain requested before then.
+func (wC *websocketConnection) attach(client, upstream *websocketPeer) {
+	wC.lock.Lock()
+
+	defer wC.lock.Unlock()
+
+	wC.client = client
+	wC.upstream = upstream
+
+	select {
+	case <-wC.draining:
+		wC.startDrain()
+	default:
+	}
+}
+
+func (wC *websocketConnection) Status() websocketConnectionStatus {
+	draining := false
+
+	select {
+	case <-wC.draining:
+		draining = true
+	default:
+	}
+
+	return websocketConnectionStatus{
+		ID:              wC.id,
+		Domain:          wC.domain,
+		Project:         wC.project,
+		Route:           wC.route,
+		ForwardHost:     wC.forwardHost,
+		ClientIP:        wC.clientIP,
+		StartedAt:       wC.startedAt,
+		LastActivityAt:  time.Unix(0, atomic.LoadInt64(&wC.lastActivity)),
+		BytesFromClient: atomic.LoadInt64(&wC.bytesFromClient),
+		BytesToClient:   atomic.LoadInt64(&wC.bytesToClient),
+		Draining:        draining,
+	}
+}
+
+// serve pumps frames both ways, enforcing the policy's timeouts, until either side goes away.
+func (wC *websocketConnection) serve(policy websocketPolicy, drainTimeout time.Duration) {
+	atomic.StoreInt64(&wC.lastActivity, time.Now().UnixNano())
+
+	go wC.pump(wC.client, wC.upstream, &wC.bytesFromClient, "bytesFromClient")
+	go wC.pump(wC.upstream, wC.client, &wC.bytesToClient, "bytesToClient")
+
+	var expired <-chan time.Time
+
+	if policy.IdleTimeout > 0 || policy.MaxLifetime > 0 {
+		ticker := time.NewTicker(time.Second)
+
+		defer ticker.Stop()
+
+		expired = ticker.C
+	}
+
+	for {
+		select {
+		case <-wC.done:
+			return
+		case <-expired:
+		}
+
+		now := time.Now()
+
+		if policy.MaxLifetime > 0 && now.Sub(wC.startedAt) >= time.Duration(policy.MaxLifetime) {
+			wC.Drain(ws.StatusGoingAway, "connection lifetime exceeded", drainTimeout)
+
+			expired = nil
+		} else if policy.IdleTimeout > 0 && now.Sub(time.Unix(0, atomic.LoadInt64(&wC.lastActivity))) >= time.Duration(policy.IdleTimeout) {
+			wC.Drain(ws.StatusNormalClosure, "idle timeout", drainTimeout)
+
+			expired = nil
+		}
+	}
+}
+
+func (wC *websocketConnection) pump(from, to *websocketPeer, counter *int64, metric string) {
+	defer wC.terminate()
+
+	for {
+		header, err := ws.ReadHeader(from.reader)
+
+		if err != nil {
+			return
+		}
+
+		atomic.StoreInt64(&wC.lastActivity, time.Now().UnixNano())
+
+		if err := to.forward(header, from.reader); err != nil {
+			return
+		}
+
+		atomic.AddInt64(counter, header.Length)
+
+		websocketMetrics.Add(metric, header.Length)
+	}
+}
+
+// Drain sends both ends a close frame and gives them timeout to finish the closing handshake
+// before cutting the connection.
+func (wC *websocketConnection) Drain(code ws.StatusCode, reason string, timeout time.Duration) {
+	wC.lock.Lock()
+
+	defer wC.lock.Unlock()
+
+	select {
+	case <-wC.draining:
+		return
+	default:
+	}
+
+	wC.drainCode = code
+	wC.drainReason = reason
+	wC.drainTimeout = timeout
+
+	close(wC.draining)
+
+	websocketMetrics.Add("drained", 1)
+
+	if wC.client != nil {
+		wC.startDrain()
+	}
+}
+
+// startDrain sends the close frames without holding up the caller on a peer that has stopped
+// reading, the timeout cutting such a peer off.
+func (wC *websocketConnection) startDrain() {
+	client, upstream := wC.client, wC.upstream
+
+	go client.sendClose(wC.drainCode, wC.drainReason)
+	go upstream.sendClose(wC.drainCode, wC.drainReason)
+
+	time.AfterFunc(wC.drainTimeout, wC.terminate)
+}
+
+func (wC *websocketConnection) terminate() {
+	wC.closeOnce.Do(func() {
+		wC.lock.Lock()
+
+		client, upstream := wC.client, wC.upstream
+
+		wC.lock.Unlock()
+
+		if client != nil {
+			client.closer.Close()
+			upstream.closer.Close()
+		}
+
+		close(wC.done)
+	})
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+)
+
+func TestWebsocketUpgradeCarriesResponseHeaders(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := ws.HTTPUpgrader{Header: http.Header{
+			"X-Powered-By":    {"upstream"},
+			"Referrer-Policy": {"origin"},
+		}}
+
+		conn, _, _, err := upgrader.Upgrade(r, w)
+
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		message, _, err := wsutil.ReadClientData(conn)
+
+		if err != nil {
+			return
+		}
+
+		wsutil.WriteServerText(conn, message)
+	}))
+
+	defer upstream.Close()
+
+	configPath := filepath.Join(t.TempDir(), "routes.json")
+
+	config := `{"routes": [
+		{"match": {"domain": "example.com"}, "securityHeaders": {"frameOptions": "DENY", "referrerPolicy": "no-referrer"}},
+		{"match": {"route": "/chat"}, "headers": {"response": {"set": {"X-Route": "${route}"}, "remove": ["X-Powered-By"]}}}
+	]}`
+
+	if err := ioutil.WriteFile(configPath, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	routeConfig, err := newRouteConfigStore(configPath)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target, _ := url.Parse(upstream.URL)
+
+	rM := &routesManager{routeConfig: routeConfig, websockets: newWebsocketTracker(time.Second)}
+
+	router := gin.New()
+
+	router.GET("/chat", rM.newProxyHandler(upstream.URL, target, "example.com", "chat", "/chat"))
+
+	server := httptest.NewServer(router)
+
+	defer server.Close()
+
+	var lock sync.Mutex
+
+	header := http.Header{}
+
+	dialer := ws.Dialer{OnHeader: func(key, value []byte) error {
+		lock.Lock()
+
+		defer lock.Unlock()
+
+		header.Add(string(key), string(value))
+
+		return nil
+	}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+	defer cancel()
+
+	conn, _, _, err := dialer.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http")+"/chat")
+
+	if err != nil {
+		t.Fatalf("dialing through the router: %s", err)
+	}
+
+	defer conn.Close()
+
+	lock.Lock()
+
+	for name, want := range map[string][]string{
+		"X-Frame-Options": {"DENY"},
+		"Referrer-Policy": {"origin"},
+		"X-Route":         {"/chat"},
+		"X-Powered-By":    nil,
+	} {
+		if got := header.Values(name); strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("%s: got %q on the 101, want %q", name, got, want)
+		}
+	}
+
+	lock.Unlock()
+
+	if err := wsutil.WriteClientText(conn, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	if message, err := wsutil.ReadServerText(conn); err != nil || string(message) != "hello" {
+		t.Fatalf("echo: got %q, %v", message, err)
+	}
+}